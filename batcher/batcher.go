@@ -0,0 +1,312 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrBufferFull is returned by TryEnqueue when the buffer is at capacity.
+var ErrBufferFull = errors.New("batcher: buffer is full")
+
+// ErrStopped is returned when enqueueing into a stopped Batcher.
+var ErrStopped = errors.New("batcher: stopped")
+
+// Sink receives one batch of items. A returned error makes the Batcher retry
+// the same batch with backoff.
+type Sink[T any] func(ctx context.Context, batch []T) error
+
+// Config controls when a Batcher flushes and how it retries.
+type Config struct {
+	// MaxSize flushes once this many items are buffered. 0 disables it.
+	MaxSize int
+	// MaxAge flushes once the oldest buffered item is this old. 0 disables it.
+	MaxAge time.Duration
+	// BufferSize is the number of buffered items at which Enqueue blocks and
+	// TryEnqueue fails. Defaults to 10 * MaxSize, or 10000.
+	BufferSize int
+	// MaxRetries is the number of times a failed batch is retried before it
+	// is dropped.
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry; it doubles on each
+	// further attempt. Defaults to 100ms.
+	RetryBackoff time.Duration
+	// FlushTimeout bounds each sink call. Defaults to 30s.
+	FlushTimeout time.Duration
+}
+
+// Stats are cumulative counters for a Batcher.
+type Stats struct {
+	Batches  uint64 `json:"batches"`  // batches delivered to the sink
+	Items    uint64 `json:"items"`    // items delivered to the sink
+	Failures uint64 `json:"failures"` // failed sink calls, including retried ones
+	Dropped  uint64 `json:"dropped"`  // items given up on after MaxRetries
+	Pending  int    `json:"pending"`  // items currently buffered
+}
+
+// Batcher buffers items and hands them to a Sink in batches, flushing on
+// whichever of MaxSize, MaxAge or an explicit Flush comes first.
+type Batcher[T any] struct {
+	name string
+	cfg  Config
+	sink Sink[T]
+
+	mu      sync.Mutex
+	items   []T
+	oldest  time.Time
+	started bool
+	stopped bool
+	spaceCh chan struct{} // closed and replaced whenever the buffer drains
+
+	wakeCh  chan struct{}
+	flushCh chan chan error
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+
+	batches   atomic.Uint64
+	delivered atomic.Uint64
+	failures  atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+// New returns a Batcher that delivers batches to sink. name is only used in
+// log messages. Call Start to begin flushing.
+func New[T any](name string, cfg Config, sink Sink[T]) *Batcher[T] {
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 10000
+		if cfg.MaxSize > 0 {
+			cfg.BufferSize = 10 * cfg.MaxSize
+		}
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = 100 * time.Millisecond
+	}
+	if cfg.FlushTimeout <= 0 {
+		cfg.FlushTimeout = 30 * time.Second
+	}
+	return &Batcher[T]{
+		name:    name,
+		cfg:     cfg,
+		sink:    sink,
+		spaceCh: make(chan struct{}),
+		wakeCh:  make(chan struct{}, 1),
+		flushCh: make(chan chan error),
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+}
+
+// Start begins the background flush loop. Call Stop() to end it.
+func (b *Batcher[T]) Start() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.started || b.stopped {
+		return
+	}
+	b.started = true
+	go b.run()
+}
+
+// Stop stops accepting items, flushes everything still buffered and waits
+// for the flush loop to exit.
+func (b *Batcher[T]) Stop() {
+	b.mu.Lock()
+	if b.stopped {
+		b.mu.Unlock()
+		<-b.doneCh
+		return
+	}
+	b.stopped = true
+	started := b.started
+	b.mu.Unlock()
+
+	if !started {
+		// No flush loop to hand over to: deliver what is left ourselves.
+		if err := b.flushAll(); err != nil {
+			fmt.Printf("[%s] final flush failed: %v\n", b.name, err)
+		}
+		close(b.doneCh)
+		return
+	}
+	close(b.stopCh)
+	<-b.doneCh
+}
+
+// Enqueue adds an item, blocking while the buffer is full until there is room
+// or ctx is done.
+func (b *Batcher[T]) Enqueue(ctx context.Context, item T) error {
+	for {
+		b.mu.Lock()
+		if b.stopped {
+			b.mu.Unlock()
+			return ErrStopped
+		}
+		if len(b.items) < b.cfg.BufferSize {
+			b.addLocked(item)
+			b.mu.Unlock()
+			return nil
+		}
+		space := b.spaceCh
+		b.mu.Unlock()
+
+		select {
+		case <-space:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// TryEnqueue adds an item without blocking, returning ErrBufferFull when the
+// buffer is at capacity.
+func (b *Batcher[T]) TryEnqueue(item T) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stopped {
+		return ErrStopped
+	}
+	if len(b.items) >= b.cfg.BufferSize {
+		return ErrBufferFull
+	}
+	b.addLocked(item)
+	return nil
+}
+
+// addLocked assumes b.mu is held.
+func (b *Batcher[T]) addLocked(item T) {
+	if len(b.items) == 0 {
+		b.oldest = time.Now()
+	}
+	b.items = append(b.items, item)
+	// The flush loop only needs waking to arm the age timer or to flush a
+	// full batch.
+	if len(b.items) == 1 || (b.cfg.MaxSize > 0 && len(b.items) >= b.cfg.MaxSize) {
+		select {
+		case b.wakeCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Flush delivers everything currently buffered and returns the first sink
+// error, after retries, if any. The Batcher must have been started.
+func (b *Batcher[T]) Flush(ctx context.Context) error {
+	reply := make(chan error, 1)
+	select {
+	case b.flushCh <- reply:
+	case <-b.doneCh:
+		return ErrStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stats returns the current counters.
+func (b *Batcher[T]) Stats() Stats {
+	b.mu.Lock()
+	pending := len(b.items)
+	b.mu.Unlock()
+	return Stats{
+		Batches:  b.batches.Load(),
+		Items:    b.delivered.Load(),
+		Failures: b.failures.Load(),
+		Dropped:  b.dropped.Load(),
+		Pending:  pending,
+	}
+}
+
+func (b *Batcher[T]) run() {
+	defer close(b.doneCh)
+
+	ageTimer := time.NewTimer(time.Hour)
+	ageTimer.Stop()
+	defer ageTimer.Stop()
+
+	for {
+		select {
+		case <-b.wakeCh:
+		case <-ageTimer.C:
+		case reply := <-b.flushCh:
+			reply <- b.flushAll()
+			continue
+		case <-b.stopCh:
+			if err := b.flushAll(); err != nil {
+				fmt.Printf("[%s] final flush failed: %v\n", b.name, err)
+			}
+			return
+		}
+
+		b.mu.Lock()
+		n := len(b.items)
+		age := time.Since(b.oldest)
+		b.mu.Unlock()
+
+		switch {
+		case n == 0:
+		case b.cfg.MaxSize > 0 && n >= b.cfg.MaxSize, b.cfg.MaxAge > 0 && age >= b.cfg.MaxAge:
+			if err := b.flushAll(); err != nil {
+				fmt.Printf("[%s] flush failed: %v\n", b.name, err)
+			}
+		case b.cfg.MaxAge > 0:
+			ageTimer.Reset(b.cfg.MaxAge - age)
+		}
+	}
+}
+
+// flushAll takes every buffered item and delivers it in batches of at most
+// MaxSize. It runs on the flush loop, or in Stop when the loop never started.
+func (b *Batcher[T]) flushAll() error {
+	b.mu.Lock()
+	items := b.items
+	b.items = nil
+	close(b.spaceCh)
+	b.spaceCh = make(chan struct{})
+	b.mu.Unlock()
+
+	var firstErr error
+	for len(items) > 0 {
+		n := len(items)
+		if b.cfg.MaxSize > 0 && n > b.cfg.MaxSize {
+			n = b.cfg.MaxSize
+		}
+		if err := b.deliver(items[:n]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		items = items[n:]
+	}
+	return firstErr
+}
+
+// deliver hands one batch to the sink, retrying with exponential backoff.
+func (b *Batcher[T]) deliver(batch []T) error {
+	delay := b.cfg.RetryBackoff
+	var err error
+	for attempt := 0; attempt <= b.cfg.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), b.cfg.FlushTimeout)
+		err = b.sink(ctx, batch)
+		cancel()
+		if err == nil {
+			b.batches.Add(1)
+			b.delivered.Add(uint64(len(batch)))
+			return nil
+		}
+		b.failures.Add(1)
+		fmt.Printf("[%s] attempt %d to deliver %d items failed: %v\n", b.name, attempt+1, len(batch), err)
+	}
+	b.dropped.Add(uint64(len(batch)))
+	return fmt.Errorf("%s: dropped %d items after %d attempts: %w", b.name, len(batch), b.cfg.MaxRetries+1, err)
+}
@@ -0,0 +1,170 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink collects every batch it receives.
+type recordingSink struct {
+	mu      sync.Mutex
+	batches [][]int
+}
+
+func (s *recordingSink) sink(ctx context.Context, batch []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, append([]int(nil), batch...))
+	return nil
+}
+
+func (s *recordingSink) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.batches)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("condition not met before deadline")
+}
+
+func TestBatcherFlushesOnMaxSize(t *testing.T) {
+	s := &recordingSink{}
+	b := New("test", Config{MaxSize: 3, MaxAge: time.Hour}, s.sink)
+	b.Start()
+	defer b.Stop()
+
+	for i := 0; i < 3; i++ {
+		if err := b.TryEnqueue(i); err != nil {
+			t.Fatalf("enqueue failed: %v", err)
+		}
+	}
+	waitFor(t, func() bool { return s.count() == 1 })
+	if got := len(s.batches[0]); got != 3 {
+		t.Fatalf("expected a batch of 3, got %d", got)
+	}
+}
+
+func TestBatcherFlushesOnMaxAge(t *testing.T) {
+	s := &recordingSink{}
+	b := New("test", Config{MaxSize: 100, MaxAge: 20 * time.Millisecond}, s.sink)
+	b.Start()
+	defer b.Stop()
+
+	b.TryEnqueue(1)
+	waitFor(t, func() bool { return s.count() == 1 })
+}
+
+func TestBatcherExplicitFlushAndStop(t *testing.T) {
+	s := &recordingSink{}
+	b := New("test", Config{}, s.sink)
+	b.Start()
+
+	b.TryEnqueue(1)
+	b.TryEnqueue(2)
+	if err := b.Flush(context.Background()); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if s.count() != 1 {
+		t.Fatalf("expected 1 batch after Flush, got %d", s.count())
+	}
+
+	b.TryEnqueue(3)
+	b.Stop()
+	if s.count() != 2 {
+		t.Fatalf("expected the final flush on Stop, got %d batches", s.count())
+	}
+	if err := b.TryEnqueue(4); !errors.Is(err, ErrStopped) {
+		t.Fatalf("expected ErrStopped, got %v", err)
+	}
+
+	stats := b.Stats()
+	if stats.Batches != 2 || stats.Items != 3 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestBatcherRetriesFailedSink(t *testing.T) {
+	attempts := 0
+	sink := func(ctx context.Context, batch []int) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("unavailable")
+		}
+		return nil
+	}
+	b := New("test", Config{MaxRetries: 3, RetryBackoff: time.Millisecond}, sink)
+	b.Start()
+	defer b.Stop()
+
+	b.TryEnqueue(1)
+	if err := b.Flush(context.Background()); err != nil {
+		t.Fatalf("expected the retry to succeed, got %v", err)
+	}
+	stats := b.Stats()
+	if stats.Failures != 2 || stats.Batches != 1 || stats.Dropped != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestBatcherDropsAfterMaxRetries(t *testing.T) {
+	sink := func(ctx context.Context, batch []int) error {
+		return errors.New("unavailable")
+	}
+	b := New("test", Config{MaxRetries: 1, RetryBackoff: time.Millisecond}, sink)
+	b.Start()
+	defer b.Stop()
+
+	b.TryEnqueue(1)
+	b.TryEnqueue(2)
+	if err := b.Flush(context.Background()); err == nil {
+		t.Fatal("expected an error")
+	}
+	stats := b.Stats()
+	if stats.Failures != 2 || stats.Dropped != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestBatcherBackpressure(t *testing.T) {
+	release := make(chan struct{})
+	sink := func(ctx context.Context, batch []int) error {
+		<-release
+		return nil
+	}
+	b := New("test", Config{MaxSize: 1, BufferSize: 2}, sink)
+	b.Start()
+	defer b.Stop()
+
+	// The first item is picked up by the flush loop and blocks in the sink,
+	// the next two fill the buffer.
+	b.TryEnqueue(1)
+	waitFor(t, func() bool { return b.Stats().Pending == 0 })
+	b.TryEnqueue(2)
+	b.TryEnqueue(3)
+	if err := b.TryEnqueue(4); !errors.Is(err, ErrBufferFull) {
+		t.Fatalf("expected ErrBufferFull, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := b.Enqueue(ctx, 4); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Enqueue to block until the deadline, got %v", err)
+	}
+
+	close(release)
+	if err := b.Enqueue(context.Background(), 4); err != nil {
+		t.Fatalf("expected Enqueue to succeed once the buffer drains, got %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package batcher
+
+import (
+	"M2A1-URL-Shortner/models"
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Click is a single resolution of a short code.
+type Click struct {
+	ShortCode string
+	Timestamp time.Time
+}
+
+// ClickCount is the aggregate of the clicks in one batch for one short code.
+type ClickCount struct {
+	Hits           uint
+	LastAccessedAt time.Time
+}
+
+// AggregateClicks sums a batch of clicks per short code.
+func AggregateClicks(batch []Click) map[string]*ClickCount {
+	counts := make(map[string]*ClickCount)
+	for _, click := range batch {
+		count, ok := counts[click.ShortCode]
+		if !ok {
+			count = &ClickCount{}
+			counts[click.ShortCode] = count
+		}
+		count.Hits++
+		if click.Timestamp.After(count.LastAccessedAt) {
+			count.LastAccessedAt = click.Timestamp
+		}
+	}
+	return counts
+}
+
+// ClickCountSink writes a batch of clicks to db as atomic hit_count
+// increments and the latest access time per short code, in one transaction.
+func ClickCountSink(db *gorm.DB) Sink[Click] {
+	return func(ctx context.Context, batch []Click) error {
+		counts := AggregateClicks(batch)
+		return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			for shortCode, count := range counts {
+				result := tx.Model(&models.URLShortener{}).
+					Where("short_code = ?", shortCode).
+					Updates(map[string]interface{}{
+						"hit_count":        gorm.Expr("hit_count + ?", count.Hits),
+						"last_accessed_at": count.LastAccessedAt,
+					})
+				if result.Error != nil {
+					return result.Error
+				}
+			}
+			return nil
+		})
+	}
+}
+
+// ClickEventSink inserts a batch of click events into db.
+func ClickEventSink(db *gorm.DB) Sink[models.ClickEvent] {
+	return func(ctx context.Context, batch []models.ClickEvent) error {
+		return db.WithContext(ctx).CreateInBatches(batch, 100).Error
+	}
+}
@@ -0,0 +1,68 @@
+package batcher
+
+import (
+	"M2A1-URL-Shortner/models"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s_%d?mode=memory&cache=shared", t.Name(), time.Now().UnixNano())), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	if err := db.AutoMigrate(&models.URLShortener{}, &models.User{}, &models.ClickEvent{}); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	return db
+}
+
+func TestClickCountSink(t *testing.T) {
+	db := newTestDB(t)
+	db.Create(&models.URLShortener{OriginalURL: "https://example.com/a", ShortCode: "aaa", HitCount: 2})
+	db.Create(&models.URLShortener{OriginalURL: "https://example.com/b", ShortCode: "bbb"})
+
+	last := time.Now()
+	batch := []Click{
+		{ShortCode: "aaa", Timestamp: last.Add(-time.Second)},
+		{ShortCode: "aaa", Timestamp: last},
+		{ShortCode: "aaa", Timestamp: last.Add(-2 * time.Second)},
+		{ShortCode: "bbb", Timestamp: last},
+	}
+	if err := ClickCountSink(db)(context.Background(), batch); err != nil {
+		t.Fatalf("sink failed: %v", err)
+	}
+
+	var a, b models.URLShortener
+	db.First(&a, "short_code = ?", "aaa")
+	db.First(&b, "short_code = ?", "bbb")
+	if a.HitCount != 5 || b.HitCount != 1 {
+		t.Fatalf("expected hit counts 5 and 1, got %d and %d", a.HitCount, b.HitCount)
+	}
+	if a.LastAccessedAt == nil || !a.LastAccessedAt.Equal(last) {
+		t.Errorf("expected last_accessed_at %v, got %v", last, a.LastAccessedAt)
+	}
+}
+
+func TestClickCounterFlushesOnStop(t *testing.T) {
+	db := newTestDB(t)
+	db.Create(&models.URLShortener{OriginalURL: "https://example.com", ShortCode: "abc123"})
+
+	b := New("click-counter", Config{MaxSize: 500, MaxAge: time.Hour}, ClickCountSink(db))
+	b.Start()
+	for i := 0; i < 10; i++ {
+		b.TryEnqueue(Click{ShortCode: "abc123", Timestamp: time.Now()})
+	}
+	b.Stop()
+
+	var urlShortener models.URLShortener
+	db.First(&urlShortener, "short_code = ?", "abc123")
+	if urlShortener.HitCount != 10 {
+		t.Fatalf("expected hit_count 10, got %d", urlShortener.HitCount)
+	}
+}
@@ -0,0 +1,443 @@
+// Package blocklist blocks requests by API key, IP address or CIDR range.
+// Entries come from a JSON file, reloaded when it changes, and from admin
+// endpoints, and are shared between instances through a Store.
+package blocklist
+
+import (
+	"M2A1-URL-Shortner/models"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry types. API keys are blocked by their SHA-256 hash, given as the
+// hash or the key itself, or by the ID of their record.
+const (
+	TypeAPIKey   = "api_key"
+	TypeAPIKeyID = "api_key_id"
+	TypeIP       = "ip"
+	TypeCIDR     = "cidr"
+)
+
+// Where an entry came from. File entries are replaced whenever the file is
+// loaded; admin and scanner entries stay until removed or expired.
+const (
+	SourceFile    = "file"
+	SourceAdmin   = "admin"
+	SourceScanner = "scanner"
+)
+
+// Entry blocks one API key, IP address or CIDR range. KeyID is the record
+// of a blocked api_key, when it is known, so access tokens issued for the
+// key are refused too.
+type Entry struct {
+	Type      string     `json:"type"`
+	Value     string     `json:"value"`
+	KeyID     uint       `json:"key_id,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Source    string     `json:"source"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// ID identifies the entry in a Store.
+func (e Entry) ID() string {
+	return e.Type + ":" + e.Value
+}
+
+// Redacted identifies the entry for logs without writing out API keys that
+// were stored before they were hashed.
+func (e Entry) Redacted() string {
+	if e.Type != TypeAPIKey {
+		return e.ID()
+	}
+	if isKeyHash(e.Value) {
+		return e.Type + ":" + e.Value[:8] + "…"
+	}
+	if len(e.Value) > 8 {
+		return e.Type + ":" + e.Value[:4] + "…"
+	}
+	return e.Type + ":…"
+}
+
+// isKeyHash reports whether value is a SHA-256 hash as models.HashAPIKey
+// writes it, rather than a key.
+func isKeyHash(value string) bool {
+	_, err := hex.DecodeString(value)
+	return err == nil && len(value) == 64 && strings.ToLower(value) == value
+}
+
+// keyHash returns the hash of the key an api_key entry value stands for.
+func keyHash(value string) string {
+	if isKeyHash(value) {
+		return value
+	}
+	return models.HashAPIKey(value)
+}
+
+// Expired reports whether the entry no longer applies at now.
+func (e Entry) Expired(now time.Time) bool {
+	return e.ExpiresAt != nil && !now.Before(*e.ExpiresAt)
+}
+
+// Normalize checks e and rewrites its value in canonical form, so the same
+// address or range always has the same ID.
+func (e *Entry) Normalize() error {
+	e.Value = strings.TrimSpace(e.Value)
+	if e.Value == "" {
+		return errors.New("value is required")
+	}
+	switch e.Type {
+	case TypeAPIKey:
+		e.Value = keyHash(e.Value)
+	case TypeAPIKeyID:
+		id, err := strconv.ParseUint(e.Value, 10, 64)
+		if err != nil || id == 0 {
+			return fmt.Errorf("%q is not an API key ID", e.Value)
+		}
+		e.Value = strconv.FormatUint(id, 10)
+	case TypeIP:
+		addr, err := netip.ParseAddr(e.Value)
+		if err != nil {
+			return fmt.Errorf("%q is not an IP address", e.Value)
+		}
+		e.Value = addr.Unmap().String()
+	case TypeCIDR:
+		prefix, err := netip.ParsePrefix(e.Value)
+		if err != nil {
+			return fmt.Errorf("%q is not a CIDR range", e.Value)
+		}
+		e.Value = prefix.Masked().String()
+	default:
+		return fmt.Errorf("type must be api_key, api_key_id, ip or cidr, got %q", e.Type)
+	}
+	return nil
+}
+
+// snapshot indexes the live entries for lookups.
+type snapshot struct {
+	entries []Entry
+	apiKeys map[string]Entry // by key hash
+	keyIDs  map[uint]Entry
+	ips     map[netip.Addr]Entry
+	cidrs   []Entry
+	prefix  []netip.Prefix // parsed Value of each entry in cidrs
+}
+
+func newSnapshot(entries []Entry) *snapshot {
+	s := &snapshot{entries: entries, apiKeys: map[string]Entry{}, keyIDs: map[uint]Entry{}, ips: map[netip.Addr]Entry{}}
+	for _, entry := range entries {
+		switch entry.Type {
+		case TypeAPIKey:
+			// Entries stored before keys were hashed hold the key itself.
+			s.apiKeys[keyHash(entry.Value)] = entry
+			if entry.KeyID != 0 {
+				s.keyIDs[entry.KeyID] = entry
+			}
+		case TypeAPIKeyID:
+			if id, err := strconv.ParseUint(entry.Value, 10, 64); err == nil {
+				s.keyIDs[uint(id)] = entry
+			}
+		case TypeIP:
+			if addr, err := netip.ParseAddr(entry.Value); err == nil {
+				s.ips[addr] = entry
+			}
+		case TypeCIDR:
+			if prefix, err := netip.ParsePrefix(entry.Value); err == nil {
+				s.cidrs = append(s.cidrs, entry)
+				s.prefix = append(s.prefix, prefix)
+			}
+		}
+	}
+	return s
+}
+
+// Blocklist answers lookups from an in-memory copy of the store's entries,
+// refreshed when they change.
+type Blocklist struct {
+	store Store
+
+	mu      sync.RWMutex
+	current *snapshot
+
+	fileMu    sync.Mutex
+	fileStamp string // modification time and size of the file last loaded
+}
+
+// New returns an empty Blocklist backed by store. Call Reload or Start to
+// read the store.
+func New(store Store) *Blocklist {
+	return &Blocklist{store: store, current: newSnapshot(nil)}
+}
+
+// Reload reads the entries from the store, dropping expired ones.
+func (b *Blocklist) Reload(ctx context.Context) error {
+	entries, err := b.store.List(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	live := entries[:0]
+	var expired []string
+	for _, entry := range entries {
+		if entry.Expired(now) {
+			expired = append(expired, entry.ID())
+		} else {
+			live = append(live, entry)
+		}
+	}
+	if len(expired) > 0 {
+		if err := b.store.Delete(ctx, expired...); err != nil {
+			fmt.Printf("Error removing expired blocklist entries: %v\n", err)
+		}
+	}
+	b.mu.Lock()
+	b.current = newSnapshot(live)
+	b.mu.Unlock()
+	return nil
+}
+
+// Check returns the entry blocking apiKey or ip, if any. Either may be
+// empty.
+func (b *Blocklist) Check(apiKey, ip string) (Entry, bool) {
+	if apiKey != "" {
+		if entry, ok := b.CheckAPIKey(models.HashAPIKey(apiKey), 0); ok {
+			return entry, true
+		}
+	}
+	b.mu.RLock()
+	s := b.current
+	b.mu.RUnlock()
+	now := time.Now()
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return Entry{}, false
+	}
+	addr = addr.Unmap()
+	if entry, ok := s.ips[addr]; ok && !entry.Expired(now) {
+		return entry, true
+	}
+	for i, prefix := range s.prefix {
+		if prefix.Contains(addr) && !s.cidrs[i].Expired(now) {
+			return s.cidrs[i], true
+		}
+	}
+	return Entry{}, false
+}
+
+// CheckAPIKey returns the entry blocking the API key with hash or record
+// id, if any. id is 0 for keys without a record.
+func (b *Blocklist) CheckAPIKey(hash string, id uint) (Entry, bool) {
+	b.mu.RLock()
+	s := b.current
+	b.mu.RUnlock()
+	now := time.Now()
+
+	if entry, ok := s.apiKeys[hash]; ok && hash != "" && !entry.Expired(now) {
+		return entry, true
+	}
+	if entry, ok := s.keyIDs[id]; ok && id != 0 && !entry.Expired(now) {
+		return entry, true
+	}
+	return Entry{}, false
+}
+
+// Entries returns the entries in force, sorted by ID.
+func (b *Blocklist) Entries() []Entry {
+	b.mu.RLock()
+	s := b.current
+	b.mu.RUnlock()
+	now := time.Now()
+	var live []Entry
+	for _, entry := range s.entries {
+		if !entry.Expired(now) {
+			live = append(live, entry)
+		}
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i].ID() < live[j].ID() })
+	return live
+}
+
+// Add stores entry and tells the other instances. It returns the entry as
+// stored.
+func (b *Blocklist) Add(ctx context.Context, entry Entry) (Entry, error) {
+	if err := entry.Normalize(); err != nil {
+		return entry, err
+	}
+	if entry.Expired(time.Now()) {
+		return entry, errors.New("expires_at is in the past")
+	}
+	if entry.Source == "" {
+		entry.Source = SourceAdmin
+	}
+	entry.CreatedAt = time.Now().UTC()
+	if err := b.store.Put(ctx, entry); err != nil {
+		return entry, err
+	}
+	return entry, b.changed(ctx)
+}
+
+// Remove deletes the entry of type typ for value. It reports false when
+// there was no such entry.
+func (b *Blocklist) Remove(ctx context.Context, typ, value string) (bool, error) {
+	entry := Entry{Type: typ, Value: value}
+	if err := entry.Normalize(); err != nil {
+		return false, err
+	}
+	if err := b.Reload(ctx); err != nil {
+		return false, err
+	}
+	// Compare normalized, so API key entries stored before keys were
+	// hashed are found by the key's hash too.
+	var ids []string
+	for _, e := range b.Entries() {
+		stored := e
+		if stored.Normalize() == nil && stored.ID() == entry.ID() {
+			ids = append(ids, e.ID())
+		}
+	}
+	if len(ids) == 0 {
+		return false, nil
+	}
+	if err := b.store.Delete(ctx, ids...); err != nil {
+		return false, err
+	}
+	return true, b.changed(ctx)
+}
+
+func (b *Blocklist) changed(ctx context.Context) error {
+	if err := b.Reload(ctx); err != nil {
+		return err
+	}
+	return b.store.Notify(ctx)
+}
+
+// fileFormat is the blocklist file. blacklisted_api_keys is the original
+// format and is still read.
+type fileFormat struct {
+	APIKeys []string `json:"blacklisted_api_keys"`
+	Entries []Entry  `json:"entries"`
+}
+
+// LoadFile replaces the file entries in the store with those in path.
+func (b *Blocklist) LoadFile(ctx context.Context, path string) error {
+	b.fileMu.Lock()
+	defer b.fileMu.Unlock()
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file fileFormat
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, key := range file.APIKeys {
+		file.Entries = append(file.Entries, Entry{Type: TypeAPIKey, Value: key})
+	}
+
+	wanted := map[string]Entry{}
+	for _, entry := range file.Entries {
+		if err := entry.Normalize(); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		entry.Source = SourceFile
+		entry.CreatedAt = info.ModTime().UTC()
+		wanted[entry.ID()] = entry
+	}
+	existing, err := b.store.List(ctx)
+	if err != nil {
+		return err
+	}
+	var stale []string
+	for _, entry := range existing {
+		if _, ok := wanted[entry.ID()]; !ok && entry.Source == SourceFile {
+			stale = append(stale, entry.ID())
+		}
+	}
+	entries := make([]Entry, 0, len(wanted))
+	for _, entry := range wanted {
+		entries = append(entries, entry)
+	}
+	if err := b.store.Delete(ctx, stale...); err != nil {
+		return err
+	}
+	if err := b.store.Put(ctx, entries...); err != nil {
+		return err
+	}
+	b.fileStamp = fileStamp(info)
+	return b.changed(ctx)
+}
+
+func fileStamp(info os.FileInfo) string {
+	return fmt.Sprintf("%d:%d", info.ModTime().UnixNano(), info.Size())
+}
+
+// fileChanged reports whether path differs from when it was last loaded.
+func (b *Blocklist) fileChanged(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	b.fileMu.Lock()
+	defer b.fileMu.Unlock()
+	return fileStamp(info) != b.fileStamp
+}
+
+// Start loads path, if it exists, and keeps the Blocklist current until
+// ctx is done: the file is reloaded when it changes, and the store is
+// re-read when another instance announces a change and every interval, which
+// also catches missed announcements and expired entries.
+func (b *Blocklist) Start(ctx context.Context, path string, interval time.Duration) error {
+	if path != "" {
+		if err := b.LoadFile(ctx, path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := b.Reload(ctx); err != nil {
+		return err
+	}
+	err := b.store.Subscribe(ctx, func() {
+		if err := b.Reload(ctx); err != nil {
+			fmt.Printf("Error reloading the blocklist: %v\n", err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			var err error
+			if path != "" && b.fileChanged(path) {
+				fmt.Printf("Blocklist file %s changed, reloading\n", path)
+				err = b.LoadFile(ctx, path)
+			} else {
+				err = b.Reload(ctx)
+			}
+			if err != nil {
+				fmt.Printf("Error reloading the blocklist: %v\n", err)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,120 @@
+package blocklist
+
+import (
+	"M2A1-URL-Shortner/models"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBlocklist(t *testing.T) {
+	ctx := context.Background()
+	b := New(NewMemoryStore())
+
+	path := filepath.Join(t.TempDir(), "blocklist.json")
+	os.WriteFile(path, []byte(`{"blacklisted_api_keys": ["bad-key"], "entries": [{"type": "cidr", "value": "10.1.2.3/16"}]}`), 0o644)
+	if err := b.LoadFile(ctx, path); err != nil {
+		t.Fatal(err)
+	}
+	soon := time.Now().Add(50 * time.Millisecond)
+	if _, err := b.Add(ctx, Entry{Type: TypeIP, Value: "::ffff:203.0.113.9", Reason: "scraping", ExpiresAt: &soon}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Add(ctx, Entry{Type: TypeIP, Value: "10.0.0.0/8"}); err == nil {
+		t.Fatal("expected a range given as an IP to be rejected")
+	}
+
+	for _, tt := range []struct {
+		apiKey, ip string
+		blocked    bool
+	}{
+		{"bad-key", "198.51.100.1", true},
+		{"good-key", "10.1.200.7", true},
+		{"good-key", "10.2.0.1", false},
+		{"", "203.0.113.9", true},
+		{"", "not an ip", false},
+	} {
+		if _, blocked := b.Check(tt.apiKey, tt.ip); blocked != tt.blocked {
+			t.Errorf("Check(%q, %q) = %v, want %v", tt.apiKey, tt.ip, blocked, tt.blocked)
+		}
+	}
+	if entries := b.Entries(); len(entries) != 3 || entries[1].ID() != "cidr:10.1.0.0/16" {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, blocked := b.Check("", "203.0.113.9"); blocked {
+		t.Fatal("expected the entry to expire")
+	}
+
+	// Reloading the file replaces its entries and keeps the admin ones.
+	b.Add(ctx, Entry{Type: TypeAPIKey, Value: "admin-key"})
+	os.WriteFile(path, []byte(`{"entries": [{"type": "ip", "value": "198.51.100.1"}]}`), 0o644)
+	if err := b.LoadFile(ctx, path); err != nil {
+		t.Fatal(err)
+	}
+	if _, blocked := b.Check("bad-key", "198.51.100.2"); blocked {
+		t.Fatal("expected bad-key to be gone with the file entry")
+	}
+	if _, blocked := b.Check("admin-key", "198.51.100.1"); !blocked {
+		t.Fatal("expected the admin and new file entries to apply")
+	}
+	if removed, err := b.Remove(ctx, TypeAPIKey, "admin-key"); err != nil || !removed {
+		t.Fatalf("Remove = %v, %v", removed, err)
+	}
+	if removed, _ := b.Remove(ctx, TypeAPIKey, "admin-key"); removed {
+		t.Fatal("expected a second Remove to find nothing")
+	}
+}
+
+func TestBlockAPIKeysByHashOrID(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	b := New(store)
+
+	// Keys are stored as their hash, which admins can also give directly.
+	entry, err := b.Add(ctx, Entry{Type: TypeAPIKey, Value: "usk_leaked"})
+	if err != nil || entry.Value != models.HashAPIKey("usk_leaked") {
+		t.Fatalf("expected the key's hash to be stored, got %+v, %v", entry, err)
+	}
+	if _, err := b.Add(ctx, Entry{Type: TypeAPIKey, Value: models.HashAPIKey("usk_other"), KeyID: 9}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Add(ctx, Entry{Type: TypeAPIKeyID, Value: "07"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Add(ctx, Entry{Type: TypeAPIKeyID, Value: "usk_leaked"}); err == nil {
+		t.Fatal("expected a key given as an ID to be rejected")
+	}
+	// An entry stored before keys were hashed.
+	store.Put(ctx, Entry{Type: TypeAPIKey, Value: "legacy-key"})
+	b.Reload(ctx)
+
+	for _, tt := range []struct {
+		hash    string
+		id      uint
+		blocked bool
+	}{
+		{models.HashAPIKey("usk_leaked"), 1, true},
+		{models.HashAPIKey("usk_other"), 0, true},
+		{"", 9, true},
+		{models.HashAPIKey("usk_fine"), 7, true},
+		{models.HashAPIKey("legacy-key"), 0, true},
+		{models.HashAPIKey("usk_fine"), 8, false},
+	} {
+		if _, blocked := b.CheckAPIKey(tt.hash, tt.id); blocked != tt.blocked {
+			t.Errorf("CheckAPIKey(%q, %d) = %v, want %v", tt.hash, tt.id, blocked, tt.blocked)
+		}
+	}
+	if _, blocked := b.Check("usk_leaked", ""); !blocked {
+		t.Fatal("expected Check to match the key by its hash")
+	}
+	if removed, err := b.Remove(ctx, TypeAPIKey, "legacy-key"); err != nil || !removed {
+		t.Fatalf("Remove = %v, %v", removed, err)
+	}
+	if _, blocked := b.Check("legacy-key", ""); blocked {
+		t.Fatal("expected the legacy entry to be removed")
+	}
+}
@@ -0,0 +1,156 @@
+package blocklist
+
+import (
+	"M2A1-URL-Shortner/cache"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Redis key and channel of the shared blocklist, before the store's key
+// prefix.
+const (
+	redisEntriesKey = "blocklist:entries"
+	redisChannel    = "blocklist:changed"
+)
+
+// Store keeps blocklist entries by ID. RedisStore shares them between
+// instances; MemoryStore keeps them in this process.
+type Store interface {
+	List(ctx context.Context) ([]Entry, error)
+	Put(ctx context.Context, entries ...Entry) error
+	Delete(ctx context.Context, ids ...string) error
+	// Subscribe calls onChange whenever another instance changes the
+	// entries, until ctx is done.
+	Subscribe(ctx context.Context, onChange func()) error
+	// Notify tells the other instances the entries changed.
+	Notify(ctx context.Context) error
+}
+
+// RedisStore keeps the entries in one Redis hash, keyed by entry ID, and
+// announces changes on a pub/sub channel.
+type RedisStore struct {
+	redis *cache.RedisStore
+}
+
+// NewRedisStore keeps the blocklist in store.
+func NewRedisStore(store *cache.RedisStore) *RedisStore {
+	return &RedisStore{redis: store}
+}
+
+func (s *RedisStore) List(ctx context.Context) ([]Entry, error) {
+	fields, err := s.redis.Client.HGetAll(ctx, s.redis.Key(redisEntriesKey)).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(fields))
+	for id, data := range fields {
+		var entry Entry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			fmt.Printf("Skipping unreadable blocklist entry %s: %v\n", id, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (s *RedisStore) Put(ctx context.Context, entries ...Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	values := make([]interface{}, 0, 2*len(entries))
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		values = append(values, entry.ID(), data)
+	}
+	return s.redis.Client.HSet(ctx, s.redis.Key(redisEntriesKey), values...).Err()
+}
+
+func (s *RedisStore) Delete(ctx context.Context, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return s.redis.Client.HDel(ctx, s.redis.Key(redisEntriesKey), ids...).Err()
+}
+
+func (s *RedisStore) Subscribe(ctx context.Context, onChange func()) error {
+	sub := s.redis.Client.Subscribe(ctx, s.redis.Key(redisChannel))
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return err
+	}
+	go func() {
+		defer sub.Close()
+		ch := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-ch:
+				if !ok {
+					return
+				}
+				onChange()
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *RedisStore) Notify(ctx context.Context) error {
+	return s.redis.Client.Publish(ctx, s.redis.Key(redisChannel), "changed").Err()
+}
+
+// MemoryStore keeps the entries in this process, for running without Redis.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]Entry
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]Entry)}
+}
+
+func (s *MemoryStore) List(ctx context.Context) ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make([]Entry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (s *MemoryStore) Put(ctx context.Context, entries ...Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, entry := range entries {
+		s.entries[entry.ID()] = entry
+	}
+	return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, ids ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		delete(s.entries, id)
+	}
+	return nil
+}
+
+// Subscribe does nothing: there are no other instances.
+func (s *MemoryStore) Subscribe(ctx context.Context, onChange func()) error {
+	return nil
+}
+
+// Notify does nothing: there are no other instances.
+func (s *MemoryStore) Notify(ctx context.Context) error {
+	return nil
+}
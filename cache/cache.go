@@ -2,7 +2,9 @@ package cache
 
 import (
 	"M2A1-URL-Shortner/models"
-	"encoding/json"
+	"context"
+	"errors"
+	"strings"
 	"time"
 
 	"github.com/allegro/bigcache"
@@ -14,27 +16,47 @@ import (
 // 	// You can add more fields if needed.
 // }
 
-// URLCache defines the interface for our cache.
+// URLCache defines the interface for our cache. All backends are safe for
+// concurrent use.
 type URLCache interface {
-	Set(key string, value models.URLShortener) error
-	Get(key string) (models.URLShortener, error)
-	Delete(key string) error
+	// Get returns the link cached under key. Keys cached by SetNotFound
+	// return ErrNotFound.
+	Get(ctx context.Context, key string) (models.URLShortener, error)
+	// GetMany returns the cached links among keys. Missing keys and keys
+	// cached as not found are left out of the result.
+	GetMany(ctx context.Context, keys []string) (map[string]models.URLShortener, error)
+	// Set caches value under key for ttl; use TTLFor to derive it from the
+	// link's expiry.
+	Set(ctx context.Context, key string, value models.URLShortener, ttl time.Duration) error
+	// SetNotFound remembers for ttl that key does not exist.
+	SetNotFound(ctx context.Context, key string, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+	// DeletePrefix removes every key starting with prefix.
+	DeletePrefix(ctx context.Context, prefix string) error
 	Close() error
 }
 
 // BigCacheStore is an implementation of URLCache using BigCache.
 type BigCacheStore struct {
-	cache *bigcache.BigCache
+	cache  *bigcache.BigCache
+	maxTTL time.Duration
 }
 
 // NewBigCacheStore initializes a new BigCacheStore.
 func NewBigCacheStore() (*BigCacheStore, error) {
+	return NewBigCacheStoreWithLimits(8192, 0)
+}
+
+// NewBigCacheStoreWithLimits initializes a BigCacheStore that holds at most
+// maxSizeMB megabytes and keeps entries for at most maxTTL on top of TTLFor;
+// 0 leaves the entry TTL uncapped.
+func NewBigCacheStoreWithLimits(maxSizeMB int, maxTTL time.Duration) (*BigCacheStore, error) {
 	config := bigcache.Config{
 		Shards:           1024,
 		LifeWindow:       10 * time.Minute,
 		CleanWindow:      5 * time.Minute,
 		MaxEntrySize:     500,
-		HardMaxCacheSize: 8192,
+		HardMaxCacheSize: maxSizeMB,
 		Verbose:          false,
 	}
 	bc, err := bigcache.NewBigCache(config)
@@ -42,13 +64,27 @@ func NewBigCacheStore() (*BigCacheStore, error) {
 		return nil, err
 	}
 	return &BigCacheStore{
-		cache: bc,
+		cache:  bc,
+		maxTTL: maxTTL,
 	}, nil
 }
 
-// Set stores a value in the cache.
-func (b *BigCacheStore) Set(key string, value models.URLShortener) error {
-	data, err := json.Marshal(value)
+// Set stores a value in the cache for ttl, capped by the store's maximum
+// TTL. BigCache has no per-entry expiry, so the deadline is checked by Get.
+func (b *BigCacheStore) Set(ctx context.Context, key string, value models.URLShortener, ttl time.Duration) error {
+	if b.maxTTL > 0 && ttl > b.maxTTL {
+		ttl = b.maxTTL
+	}
+	data, err := encodeEntry(value, ttl)
+	if err != nil {
+		return err
+	}
+	return b.cache.Set(key, data)
+}
+
+// SetNotFound caches key as missing for ttl.
+func (b *BigCacheStore) SetNotFound(ctx context.Context, key string, ttl time.Duration) error {
+	data, err := encodeNotFound(ttl)
 	if err != nil {
 		return err
 	}
@@ -56,25 +92,67 @@ func (b *BigCacheStore) Set(key string, value models.URLShortener) error {
 }
 
 // Get retrieves a value from the cache.
-func (b *BigCacheStore) Get(key string) (models.URLShortener, error) {
+func (b *BigCacheStore) Get(ctx context.Context, key string) (models.URLShortener, error) {
 	data, err := b.cache.Get(key)
 	if err != nil {
 		return models.URLShortener{}, err
 	}
-	var value models.URLShortener
-	err = json.Unmarshal(data, &value)
+	value, fresh, err := decodeEntry(data)
 	if err != nil {
 		return models.URLShortener{}, err
 	}
+	if !fresh {
+		b.cache.Delete(key)
+		return models.URLShortener{}, bigcache.ErrEntryNotFound
+	}
 	return value, nil
 }
 
+// GetMany looks keys up one by one; BigCache has no bulk read.
+func (b *BigCacheStore) GetMany(ctx context.Context, keys []string) (map[string]models.URLShortener, error) {
+	return getEach(ctx, b, keys)
+}
+
 // Delete removes a value from the cache.
-func (b *BigCacheStore) Delete(key string) error {
-	return b.cache.Delete(key)
+func (b *BigCacheStore) Delete(ctx context.Context, key string) error {
+	err := b.cache.Delete(key)
+	if errors.Is(err, bigcache.ErrEntryNotFound) {
+		return nil
+	}
+	return err
+}
+
+// DeletePrefix walks every entry, so it is slow on a large cache.
+func (b *BigCacheStore) DeletePrefix(ctx context.Context, prefix string) error {
+	var keys []string
+	it := b.cache.Iterator()
+	for it.SetNext() {
+		info, err := it.Value()
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(info.Key(), prefix) {
+			keys = append(keys, info.Key())
+		}
+	}
+	for _, key := range keys {
+		b.cache.Delete(key)
+	}
+	return nil
 }
 
 // Close stops the cache (BigCache doesn't need explicit closing, so we return nil).
 func (b *BigCacheStore) Close() error {
 	return nil
 }
+
+// getEach implements GetMany on top of Get for stores without a bulk read.
+func getEach(ctx context.Context, store URLCache, keys []string) (map[string]models.URLShortener, error) {
+	found := make(map[string]models.URLShortener, len(keys))
+	for _, key := range keys {
+		if value, err := store.Get(ctx, key); err == nil {
+			found[key] = value
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"M2A1-URL-Shortner/models"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// MaxTTL caps how long a link stays cached. main sets it from CACHE_MAX_TTL.
+var MaxTTL = 24 * time.Hour
+
+// NegativeTTL is how long a short code that does not exist is remembered as
+// missing. main sets it from CACHE_NEGATIVE_TTL.
+var NegativeTTL = 30 * time.Second
+
+// ErrNotFound is returned by Get for keys cached by SetNotFound.
+var ErrNotFound = errors.New("cache: key is cached as not found")
+
+// TTLFor returns how long link may be cached: until it expires, but never
+// longer than MaxTTL. Links that have already expired are cached for MaxTTL
+// so they keep answering 410 without reaching the database.
+func TTLFor(link models.URLShortener, now time.Time) time.Duration {
+	if link.ExpiredAt != nil && link.ExpiredAt.After(now) {
+		if untilExpiry := link.ExpiredAt.Sub(now); untilExpiry < MaxTTL {
+			return untilExpiry
+		}
+	}
+	return MaxTTL
+}
+
+// entry is the cached form of a URLShortener. The password hash is left out
+// of the model's JSON so it never reaches API clients, but redirects served
+// from the cache still need it. CachedUntil lets stores without per-entry
+// expiry drop stale entries on read. NotFound marks a negative entry.
+type entry struct {
+	models.URLShortener
+	Password    *string   `json:"password,omitempty"`
+	CachedUntil time.Time `json:"cached_until"`
+	NotFound    bool      `json:"not_found,omitempty"`
+}
+
+func encodeEntry(value models.URLShortener, ttl time.Duration) ([]byte, error) {
+	return json.Marshal(entry{URLShortener: value, Password: value.Password, CachedUntil: time.Now().Add(ttl)})
+}
+
+func encodeNotFound(ttl time.Duration) ([]byte, error) {
+	return json.Marshal(entry{CachedUntil: time.Now().Add(ttl), NotFound: true})
+}
+
+// decodeEntry returns the cached link and whether it is still fresh. Entries
+// written before CachedUntil existed are treated as stale. Fresh negative
+// entries return ErrNotFound.
+func decodeEntry(data []byte) (models.URLShortener, bool, error) {
+	var e entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return models.URLShortener{}, false, err
+	}
+	if !time.Now().Before(e.CachedUntil) {
+		return models.URLShortener{}, false, nil
+	}
+	if e.NotFound {
+		return models.URLShortener{}, true, ErrNotFound
+	}
+	e.URLShortener.Password = e.Password
+	return e.URLShortener, true, nil
+}
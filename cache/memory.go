@@ -0,0 +1,135 @@
+package cache
+
+import (
+	"M2A1-URL-Shortner/models"
+	"container/list"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrMemoryEntryNotFound is returned by MemoryStore.Get for keys it does not
+// hold.
+var ErrMemoryEntryNotFound = errors.New("cache: key not in memory cache")
+
+// MemoryStore is an in-process URLCache that evicts the least recently used
+// link once it holds maxEntries. It needs no external service, which makes
+// it the backend for local development and tests.
+type MemoryStore struct {
+	mu         sync.Mutex
+	maxEntries int
+	order      *list.List // front is most recently used
+	items      map[string]*list.Element
+}
+
+type memoryItem struct {
+	key      string
+	value    models.URLShortener
+	notFound bool
+	expires  time.Time
+}
+
+// NewMemoryStore returns a MemoryStore holding at most maxEntries links.
+func NewMemoryStore(maxEntries int) *MemoryStore {
+	return &MemoryStore{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+func (m *MemoryStore) put(key string, item *memoryItem) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.items[key]; ok {
+		el.Value = item
+		m.order.MoveToFront(el)
+		return
+	}
+	m.items[key] = m.order.PushFront(item)
+	for m.maxEntries > 0 && m.order.Len() > m.maxEntries {
+		m.removeElement(m.order.Back())
+	}
+}
+
+func (m *MemoryStore) removeElement(el *list.Element) {
+	m.order.Remove(el)
+	delete(m.items, el.Value.(*memoryItem).key)
+}
+
+// Set caches value under key for ttl.
+func (m *MemoryStore) Set(ctx context.Context, key string, value models.URLShortener, ttl time.Duration) error {
+	m.put(key, &memoryItem{key: key, value: value, expires: time.Now().Add(ttl)})
+	return nil
+}
+
+// SetNotFound caches key as missing for ttl.
+func (m *MemoryStore) SetNotFound(ctx context.Context, key string, ttl time.Duration) error {
+	m.put(key, &memoryItem{key: key, notFound: true, expires: time.Now().Add(ttl)})
+	return nil
+}
+
+// Get returns the link cached under key and marks it recently used.
+func (m *MemoryStore) Get(ctx context.Context, key string) (models.URLShortener, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.items[key]
+	if !ok {
+		return models.URLShortener{}, ErrMemoryEntryNotFound
+	}
+	item := el.Value.(*memoryItem)
+	if !time.Now().Before(item.expires) {
+		m.removeElement(el)
+		return models.URLShortener{}, ErrMemoryEntryNotFound
+	}
+	m.order.MoveToFront(el)
+	if item.notFound {
+		return models.URLShortener{}, ErrNotFound
+	}
+	return item.value, nil
+}
+
+// GetMany returns the cached links among keys.
+func (m *MemoryStore) GetMany(ctx context.Context, keys []string) (map[string]models.URLShortener, error) {
+	return getEach(ctx, m, keys)
+}
+
+// Delete removes key.
+func (m *MemoryStore) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.items[key]; ok {
+		m.removeElement(el)
+	}
+	return nil
+}
+
+// DeletePrefix removes every key starting with prefix.
+func (m *MemoryStore) DeletePrefix(ctx context.Context, prefix string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, el := range m.items {
+		if strings.HasPrefix(key, prefix) {
+			m.removeElement(el)
+		}
+	}
+	return nil
+}
+
+// Len returns the number of entries, including expired ones not yet evicted.
+func (m *MemoryStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.order.Len()
+}
+
+// Close drops every entry.
+func (m *MemoryStore) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.order.Init()
+	m.items = make(map[string]*list.Element)
+	return nil
+}
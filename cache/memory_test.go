@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"M2A1-URL-Shortner/models"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore(2)
+	m.Set(ctx, "a", models.URLShortener{ShortCode: "a"}, time.Minute)
+	m.Set(ctx, "b", models.URLShortener{ShortCode: "b"}, time.Minute)
+	m.Get(ctx, "a")
+	m.Set(ctx, "c", models.URLShortener{ShortCode: "c"}, time.Minute)
+
+	if _, err := m.Get(ctx, "b"); !errors.Is(err, ErrMemoryEntryNotFound) {
+		t.Fatalf("expected b to be evicted, got %v", err)
+	}
+	found, _ := m.GetMany(ctx, []string{"a", "b", "c"})
+	if len(found) != 2 || found["a"].ShortCode != "a" || found["c"].ShortCode != "c" {
+		t.Fatalf("unexpected entries %+v", found)
+	}
+}
+
+func TestMemoryStoreExpiryAndPrefixes(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore(0)
+	m.Set(ctx, "short", models.URLShortener{}, time.Millisecond)
+	m.SetNotFound(ctx, "missing", time.Minute)
+	m.Set(ctx, "user:1:a", models.URLShortener{}, time.Minute)
+	m.Set(ctx, "user:1:b", models.URLShortener{}, time.Minute)
+	m.Set(ctx, "user:2:a", models.URLShortener{}, time.Minute)
+	time.Sleep(5 * time.Millisecond)
+
+	if _, err := m.Get(ctx, "short"); !errors.Is(err, ErrMemoryEntryNotFound) {
+		t.Fatalf("expected the entry to expire, got %v", err)
+	}
+	if _, err := m.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	m.DeletePrefix(ctx, "user:1:")
+	if m.Len() != 2 {
+		t.Fatalf("expected missing and user:2:a to remain, have %d entries", m.Len())
+	}
+}
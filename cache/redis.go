@@ -3,86 +3,214 @@ package cache
 import (
 	"M2A1-URL-Shortner/models"
 	"context"
-	"encoding/json"
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
-type RedisURLCache interface {
-	Set(key string, value models.URLShortener) error
-	Get(key string) (models.URLShortener, error)
-	Delete(key string) error
-	Close() error
-}
-
-// RedisStore is an implementation of URLCache using Redis.
+// RedisStore is an implementation of URLCache using Redis. Client is a
+// single-node, Sentinel failover or Cluster client depending on how the store
+// was configured.
 type RedisStore struct {
-	Client *redis.Client
+	Client redis.UniversalClient
 	Ctx    context.Context
+	prefix string
 }
 
-// NewRedisStore initializes a new RedisStore instance.
+// NewRedisStore connects to the single Redis server at addr.
 func NewRedisStore(addr, password string, db int) (*RedisStore, error) {
-	// Create a Redis client.
-	REDIS_USERNAME := os.Getenv("REDIS_USER")
-
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     addr,
-		Username: REDIS_USERNAME, // e.g., "localhost:6379"
-		Password: password,       // leave empty if no password
-		DB:       db,             // use default DB 0 or specify another one
-	})
+	cfg := RedisConfig{Mode: RedisStandalone}
+	cfg.Addrs = []string{addr}
+	cfg.Username = os.Getenv("REDIS_USER")
+	cfg.Password = password
+	cfg.DB = db
+	return NewRedisStoreFromConfig(cfg)
+}
+
+// NewRedisStoreFromConfig connects to Redis as described by cfg.
+func NewRedisStoreFromConfig(cfg RedisConfig) (*RedisStore, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	rdb := cfg.newClient()
 
 	ctx := context.Background()
 	// Ping Redis to ensure connectivity.
 	if err := rdb.Ping(ctx).Err(); err != nil {
+		rdb.Close()
 		return nil, err
 	}
 
-	appEnv := os.Getenv("APP_ENV")
-	if appEnv == "" {
-		appEnv = "development" // default to development if not set
+	// REDIS_MAXMEMORY_POLICY is applied with CONFIG SET; "none" skips it.
+	// Development and staging default to allkeys-lru. Managed Redis providers
+	// usually reject CONFIG SET, so failing to apply it is only logged.
+	policy := os.Getenv("REDIS_MAXMEMORY_POLICY")
+	if policy == "" {
+		appEnv := os.Getenv("APP_ENV")
+		if appEnv == "" {
+			appEnv = "development" // default to development if not set
+		}
+		if appEnv == "development" || appEnv == "staging" {
+			policy = "allkeys-lru"
+		}
 	}
-
-	if appEnv == "development" || appEnv == "staging" {
-		// Set eviction policy to LRU (allkeys-lru) explicitly.
-		if err := rdb.ConfigSet(ctx, "maxmemory-policy", "allkeys-lru").Err(); err != nil {
-			return nil, err
+	if policy != "" && policy != "none" {
+		if err := configSet(ctx, rdb, "maxmemory-policy", policy); err != nil {
+			fmt.Printf("Could not set Redis maxmemory-policy to %s: %v\n", policy, err)
 		}
 	}
 	return &RedisStore{
 		Client: rdb,
 		Ctx:    ctx,
+		prefix: cfg.KeyPrefix,
 	}, nil
 }
 
-// Set stores a value in Redis with no expiration (0 means persist indefinitely).
-func (r *RedisStore) Set(key string, value models.URLShortener) error {
-	data, err := json.Marshal(value)
+// configSet runs CONFIG SET on every master of a cluster, or on the one
+// server otherwise.
+func configSet(ctx context.Context, rdb redis.UniversalClient, parameter, value string) error {
+	if cluster, ok := rdb.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return node.ConfigSet(ctx, parameter, value).Err()
+		})
+	}
+	return rdb.ConfigSet(ctx, parameter, value).Err()
+}
+
+// Key returns key with the store's key prefix. Everything this service keeps
+// in Redis, channel names included, goes through it.
+func (r *RedisStore) Key(key string) string {
+	return r.prefix + key
+}
+
+// Set stores a value in Redis for ttl.
+func (r *RedisStore) Set(ctx context.Context, key string, value models.URLShortener, ttl time.Duration) error {
+	data, err := encodeEntry(value, ttl)
+	if err != nil {
+		return err
+	}
+	return r.Client.Set(ctx, r.Key(key), data, ttl).Err()
+}
+
+// SetNotFound caches key as missing for ttl.
+func (r *RedisStore) SetNotFound(ctx context.Context, key string, ttl time.Duration) error {
+	data, err := encodeNotFound(ttl)
 	if err != nil {
 		return err
 	}
-	return r.Client.Set(r.Ctx, key, data, 0).Err()
+	return r.Client.Set(ctx, r.Key(key), data, ttl).Err()
 }
 
 // Get retrieves a value from Redis.
-func (r *RedisStore) Get(key string) (models.URLShortener, error) {
-	var result models.URLShortener
-	data, err := r.Client.Get(r.Ctx, key).Result()
+func (r *RedisStore) Get(ctx context.Context, key string) (models.URLShortener, error) {
+	data, err := r.Client.Get(ctx, r.Key(key)).Result()
+	if err != nil {
+		return models.URLShortener{}, err
+	}
+	value, fresh, err := decodeEntry([]byte(data))
 	if err != nil {
-		return result, err
+		return models.URLShortener{}, err
+	}
+	if !fresh {
+		// Written without a TTL by an earlier version.
+		r.Client.Del(ctx, r.Key(key))
+		return models.URLShortener{}, redis.Nil
+	}
+	return value, nil
+}
+
+// GetMany reads keys in one pipeline of GETs. Unlike MGET this works in a
+// cluster, where the keys usually live in different hash slots.
+func (r *RedisStore) GetMany(ctx context.Context, keys []string) (map[string]models.URLShortener, error) {
+	found := make(map[string]models.URLShortener, len(keys))
+	if len(keys) == 0 {
+		return found, nil
 	}
-	err = json.Unmarshal([]byte(data), &result)
-	return result, err
+	cmds := make([]*redis.StringCmd, len(keys))
+	_, err := r.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.Get(ctx, r.Key(key))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	for i, cmd := range cmds {
+		data, err := cmd.Bytes()
+		if err != nil {
+			continue
+		}
+		if value, fresh, err := decodeEntry(data); err == nil && fresh {
+			found[keys[i]] = value
+		}
+	}
+	return found, nil
 }
 
 // Delete removes a value from Redis.
-func (r *RedisStore) Delete(key string) error {
-	return r.Client.Del(r.Ctx, key).Err()
+func (r *RedisStore) Delete(ctx context.Context, key string) error {
+	return r.Client.Del(ctx, r.Key(key)).Err()
+}
+
+// DeletePrefix removes the keys starting with prefix, found with SCAN so
+// Redis is never blocked by a KEYS over the whole keyspace. In a cluster
+// every master is scanned, since SCAN only sees the node it runs on.
+func (r *RedisStore) DeletePrefix(ctx context.Context, prefix string) error {
+	pattern := escapeGlob(r.Key(prefix)) + "*"
+	if cluster, ok := r.Client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return r.deleteMatching(ctx, node, pattern)
+		})
+	}
+	return r.deleteMatching(ctx, r.Client, pattern)
 }
 
-// Close closes the Redis C.
+// deleteMatching deletes the keys scanner finds for pattern, 500 at a time.
+// Each key gets its own DEL, pipelined through r.Client, because a
+// multi-key DEL fails in a cluster when the keys are in different slots.
+func (r *RedisStore) deleteMatching(ctx context.Context, scanner redis.Cmdable, pattern string) error {
+	iter := scanner.Scan(ctx, 0, pattern, 500).Iterator()
+	var batch []string
+	for iter.Next(ctx) {
+		batch = append(batch, iter.Val())
+		if len(batch) == 500 {
+			if err := r.deleteKeys(ctx, batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	return r.deleteKeys(ctx, batch)
+}
+
+func (r *RedisStore) deleteKeys(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := r.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Del(ctx, key)
+		}
+		return nil
+	})
+	return err
+}
+
+// escapeGlob quotes the characters SCAN MATCH treats as patterns.
+func escapeGlob(s string) string {
+	return globChars.Replace(s)
+}
+
+var globChars = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// Close closes the Redis client.
 func (r *RedisStore) Close() error {
 	return r.Client.Close()
 }
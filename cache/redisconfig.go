@@ -0,0 +1,206 @@
+package cache
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis deployment modes accepted by RedisConfig.Mode.
+const (
+	RedisStandalone = "standalone"
+	RedisSentinel   = "sentinel"
+	RedisCluster    = "cluster"
+)
+
+// RedisConfig describes how to reach Redis. The embedded options hold the
+// addresses, credentials, TLS, pool and timeout settings; which of them apply
+// depends on Mode:
+//   - standalone: Addrs[0] is the server
+//   - sentinel: Addrs are the sentinels and MasterName the monitored master
+//   - cluster: Addrs are seed nodes; DB must be 0
+type RedisConfig struct {
+	Mode string
+	// KeyPrefix is prepended to every key and channel, so several
+	// deployments can share one Redis.
+	KeyPrefix string
+	redis.UniversalOptions
+}
+
+// RedisConfigFromEnv reads the Redis configuration from the environment.
+// REDIS_URL is either a redis:// or rediss:// URL, parsed like go-redis does
+// (cluster URLs list more nodes with addr= parameters), or a bare host:port.
+// The other REDIS_* variables override what the URL sets.
+func RedisConfigFromEnv() (RedisConfig, error) {
+	cfg := RedisConfig{Mode: os.Getenv("REDIS_MODE"), KeyPrefix: os.Getenv("REDIS_KEY_PREFIX")}
+	if cfg.Mode == "" {
+		cfg.Mode = RedisStandalone
+	}
+
+	if url := os.Getenv("REDIS_URL"); strings.Contains(url, "://") {
+		if err := cfg.applyURL(url); err != nil {
+			return cfg, fmt.Errorf("REDIS_URL: %w", err)
+		}
+	} else if url != "" {
+		cfg.Addrs = []string{url}
+	}
+	if v := os.Getenv("REDIS_ADDRS"); v != "" {
+		cfg.Addrs = nil
+		for _, addr := range strings.Split(v, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				cfg.Addrs = append(cfg.Addrs, addr)
+			}
+		}
+	}
+
+	for name, target := range map[string]*string{
+		"REDIS_USER":              &cfg.Username,
+		"REDIS_PASSWORD":          &cfg.Password,
+		"REDIS_SENTINEL_MASTER":   &cfg.MasterName,
+		"REDIS_SENTINEL_USER":     &cfg.SentinelUsername,
+		"REDIS_SENTINEL_PASSWORD": &cfg.SentinelPassword,
+	} {
+		if v := os.Getenv(name); v != "" {
+			*target = v
+		}
+	}
+	for name, target := range map[string]*int{
+		"REDIS_DB":             &cfg.DB,
+		"REDIS_POOL_SIZE":      &cfg.PoolSize,
+		"REDIS_MIN_IDLE_CONNS": &cfg.MinIdleConns,
+	} {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return cfg, fmt.Errorf("%s must be a non-negative number, got %q", name, v)
+			}
+			*target = n
+		}
+	}
+	for name, target := range map[string]*time.Duration{
+		"REDIS_DIAL_TIMEOUT":  &cfg.DialTimeout,
+		"REDIS_READ_TIMEOUT":  &cfg.ReadTimeout,
+		"REDIS_WRITE_TIMEOUT": &cfg.WriteTimeout,
+		"REDIS_POOL_TIMEOUT":  &cfg.PoolTimeout,
+	} {
+		if v := os.Getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return cfg, fmt.Errorf("%s must be a positive duration such as 3s, got %q", name, v)
+			}
+			*target = d
+		}
+	}
+
+	if err := cfg.applyTLSEnv(); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.validate()
+}
+
+// applyURL fills cfg from a redis:// or rediss:// URL.
+func (cfg *RedisConfig) applyURL(url string) error {
+	if cfg.Mode == RedisCluster {
+		opts, err := redis.ParseClusterURL(url)
+		if err != nil {
+			return err
+		}
+		cfg.Addrs = opts.Addrs
+		cfg.Username, cfg.Password = opts.Username, opts.Password
+		cfg.TLSConfig = opts.TLSConfig
+		cfg.DialTimeout, cfg.ReadTimeout, cfg.WriteTimeout = opts.DialTimeout, opts.ReadTimeout, opts.WriteTimeout
+		cfg.PoolSize, cfg.MinIdleConns, cfg.PoolTimeout = opts.PoolSize, opts.MinIdleConns, opts.PoolTimeout
+		return nil
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return err
+	}
+	cfg.Addrs = []string{opts.Addr}
+	cfg.Username, cfg.Password, cfg.DB = opts.Username, opts.Password, opts.DB
+	cfg.TLSConfig = opts.TLSConfig
+	cfg.DialTimeout, cfg.ReadTimeout, cfg.WriteTimeout = opts.DialTimeout, opts.ReadTimeout, opts.WriteTimeout
+	cfg.PoolSize, cfg.MinIdleConns, cfg.PoolTimeout = opts.PoolSize, opts.MinIdleConns, opts.PoolTimeout
+	return nil
+}
+
+// applyTLSEnv turns on TLS for REDIS_TLS=true, on top of a rediss:// URL.
+// REDIS_TLS_CA_FILE trusts a private CA, REDIS_TLS_SERVER_NAME overrides the
+// name checked against the certificate and REDIS_TLS_INSECURE_SKIP_VERIFY
+// disables the check altogether.
+func (cfg *RedisConfig) applyTLSEnv() error {
+	if os.Getenv("REDIS_TLS") == "true" && cfg.TLSConfig == nil {
+		cfg.TLSConfig = &tls.Config{}
+	}
+	if cfg.TLSConfig == nil {
+		return nil
+	}
+	cfg.TLSConfig.MinVersion = tls.VersionTLS12
+	if name := os.Getenv("REDIS_TLS_SERVER_NAME"); name != "" {
+		cfg.TLSConfig.ServerName = name
+	}
+	if path := os.Getenv("REDIS_TLS_CA_FILE"); path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("REDIS_TLS_CA_FILE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("REDIS_TLS_CA_FILE: no certificates found in %s", path)
+		}
+		cfg.TLSConfig.RootCAs = pool
+	}
+	cfg.TLSConfig.InsecureSkipVerify = os.Getenv("REDIS_TLS_INSECURE_SKIP_VERIFY") == "true"
+	return nil
+}
+
+func (cfg RedisConfig) validate() error {
+	switch cfg.Mode {
+	case RedisStandalone:
+		if len(cfg.Addrs) > 1 {
+			return fmt.Errorf("standalone Redis takes one address, got %d; set REDIS_MODE=cluster or sentinel", len(cfg.Addrs))
+		}
+	case RedisSentinel:
+		if cfg.MasterName == "" {
+			return fmt.Errorf("REDIS_MODE=sentinel needs REDIS_SENTINEL_MASTER")
+		}
+		if len(cfg.Addrs) == 0 {
+			return fmt.Errorf("REDIS_MODE=sentinel needs the sentinel addresses in REDIS_URL or REDIS_ADDRS")
+		}
+	case RedisCluster:
+		if len(cfg.Addrs) == 0 {
+			return fmt.Errorf("REDIS_MODE=cluster needs seed nodes in REDIS_URL or REDIS_ADDRS")
+		}
+		if cfg.DB != 0 {
+			return fmt.Errorf("Redis Cluster only has database 0, got REDIS_DB=%d", cfg.DB)
+		}
+		// A hash tag in the prefix would put every key in the same slot.
+		if strings.ContainsAny(cfg.KeyPrefix, "{}") {
+			return fmt.Errorf("REDIS_KEY_PREFIX must not contain { or } in cluster mode, got %q", cfg.KeyPrefix)
+		}
+	default:
+		return fmt.Errorf("unknown REDIS_MODE %q, want standalone, sentinel or cluster", cfg.Mode)
+	}
+	return nil
+}
+
+// newClient returns the go-redis client for cfg.Mode. The mode is explicit
+// rather than guessed from the number of addresses as NewUniversalClient
+// does, so a cluster reached through a single seed node still gets a
+// ClusterClient.
+func (cfg RedisConfig) newClient() redis.UniversalClient {
+	switch cfg.Mode {
+	case RedisSentinel:
+		return redis.NewFailoverClient(cfg.Failover())
+	case RedisCluster:
+		return redis.NewClusterClient(cfg.Cluster())
+	default:
+		return redis.NewClient(cfg.Simple())
+	}
+}
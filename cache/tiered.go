@@ -0,0 +1,243 @@
+package cache
+
+import (
+	"M2A1-URL-Shortner/models"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// InvalidationChannel is the Redis pub/sub channel TieredStores use to tell
+// each other which keys changed, before the store's key prefix.
+const InvalidationChannel = "cache:invalidate"
+
+// invalidation is published whenever a TieredStore writes or deletes a key,
+// or deletes every key with a prefix.
+type invalidation struct {
+	Key    string `json:"key"`
+	Prefix bool   `json:"prefix,omitempty"`
+	Origin string `json:"origin"`
+}
+
+// TierStats counts lookups answered by one tier.
+type TierStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+// Stats describes a TieredStore, for sizing its tiers.
+type Stats struct {
+	L1            TierStats `json:"l1"`
+	L2            TierStats `json:"l2"`
+	L1Entries     int       `json:"l1_entries"`
+	L1Capacity    int       `json:"l1_capacity_bytes"`
+	Invalidations uint64    `json:"invalidations_received"`
+}
+
+// TieredStore is a URLCache that checks an in-process BigCache (L1) before
+// Redis (L2). Writes go to both tiers and are broadcast over Redis pub/sub so
+// other instances drop their L1 copy; missed broadcasts are bounded by the
+// L1 store's maximum TTL.
+type TieredStore struct {
+	l1      *BigCacheStore
+	l2      URLCache
+	redis   *RedisStore
+	id      string
+	sub     *redis.PubSub
+	publish func(msg invalidation) error
+
+	l1Hits, l1Misses atomic.Uint64
+	l2Hits, l2Misses atomic.Uint64
+	invalidations    atomic.Uint64
+}
+
+// NewTieredStore layers l1 in front of l2. Call Listen to receive other
+// instances' invalidations.
+func NewTieredStore(l1 *BigCacheStore, l2 *RedisStore) *TieredStore {
+	t := &TieredStore{l1: l1, l2: l2, redis: l2, id: instanceID()}
+	t.publish = t.publishInvalidation
+	return t
+}
+
+func instanceID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Listen subscribes to InvalidationChannel and evicts keys other instances
+// change from L1 until Close is called.
+func (t *TieredStore) Listen() error {
+	t.sub = t.redis.Client.Subscribe(t.redis.Ctx, t.redis.Key(InvalidationChannel))
+	// Wait for the subscription so no invalidation published after Listen
+	// returns is missed.
+	if _, err := t.sub.Receive(t.redis.Ctx); err != nil {
+		t.sub.Close()
+		return err
+	}
+	go func() {
+		for msg := range t.sub.Channel() {
+			t.handleInvalidation([]byte(msg.Payload))
+		}
+	}()
+	return nil
+}
+
+func (t *TieredStore) handleInvalidation(payload []byte) {
+	var msg invalidation
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		fmt.Println("Error decoding cache invalidation:", err)
+		return
+	}
+	if msg.Origin == t.id {
+		return
+	}
+	t.invalidations.Add(1)
+	ctx := context.Background()
+	if msg.Prefix {
+		t.l1.DeletePrefix(ctx, msg.Key)
+	} else {
+		t.l1.Delete(ctx, msg.Key)
+	}
+}
+
+func (t *TieredStore) publishInvalidation(msg invalidation) error {
+	msg.Origin = t.id
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return t.redis.Client.Publish(t.redis.Ctx, t.redis.Key(InvalidationChannel), data).Err()
+}
+
+// Get returns key from L1, or from L2 and copies it into L1. Negative
+// entries count as hits.
+func (t *TieredStore) Get(ctx context.Context, key string) (models.URLShortener, error) {
+	if value, err := t.l1.Get(ctx, key); err == nil || errors.Is(err, ErrNotFound) {
+		t.l1Hits.Add(1)
+		return value, err
+	}
+	t.l1Misses.Add(1)
+
+	value, err := t.l2.Get(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		t.l2Hits.Add(1)
+		t.l1.SetNotFound(ctx, key, NegativeTTL)
+		return value, err
+	}
+	if err != nil {
+		t.l2Misses.Add(1)
+		return models.URLShortener{}, err
+	}
+	t.l2Hits.Add(1)
+	t.fillL1(ctx, key, value)
+	return value, nil
+}
+
+// GetMany serves what it can from L1 and reads the rest from L2 in one go.
+func (t *TieredStore) GetMany(ctx context.Context, keys []string) (map[string]models.URLShortener, error) {
+	found := make(map[string]models.URLShortener, len(keys))
+	var missing []string
+	for _, key := range keys {
+		if value, err := t.l1.Get(ctx, key); err == nil {
+			t.l1Hits.Add(1)
+			found[key] = value
+		} else {
+			t.l1Misses.Add(1)
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) == 0 {
+		return found, nil
+	}
+	fromL2, err := t.l2.GetMany(ctx, missing)
+	if err != nil {
+		return found, err
+	}
+	t.l2Hits.Add(uint64(len(fromL2)))
+	t.l2Misses.Add(uint64(len(missing) - len(fromL2)))
+	for key, value := range fromL2 {
+		found[key] = value
+		t.fillL1(ctx, key, value)
+	}
+	return found, nil
+}
+
+// fillL1 copies a link read from L2 into L1 until it expires.
+func (t *TieredStore) fillL1(ctx context.Context, key string, value models.URLShortener) {
+	if err := t.l1.Set(ctx, key, value, TTLFor(value, time.Now())); err != nil {
+		t.l1.Delete(ctx, key)
+	}
+}
+
+// Set writes value to L2, then L1, then tells other instances to drop their
+// L1 copy. L2 is written first so they reload the new value.
+func (t *TieredStore) Set(ctx context.Context, key string, value models.URLShortener, ttl time.Duration) error {
+	if err := t.l2.Set(ctx, key, value, ttl); err != nil {
+		t.l1.Delete(ctx, key)
+		return err
+	}
+	if err := t.l1.Set(ctx, key, value, ttl); err != nil {
+		t.l1.Delete(ctx, key)
+	}
+	return t.publish(invalidation{Key: key})
+}
+
+// SetNotFound caches key as missing in both tiers. Nothing is broadcast:
+// keys only stop existing through Delete, which already told the others.
+func (t *TieredStore) SetNotFound(ctx context.Context, key string, ttl time.Duration) error {
+	if err := t.l2.SetNotFound(ctx, key, ttl); err != nil {
+		return err
+	}
+	return t.l1.SetNotFound(ctx, key, ttl)
+}
+
+// Delete removes key from both tiers and from other instances' L1.
+func (t *TieredStore) Delete(ctx context.Context, key string) error {
+	err := t.l2.Delete(ctx, key)
+	t.l1.Delete(ctx, key)
+	if pubErr := t.publish(invalidation{Key: key}); err == nil {
+		err = pubErr
+	}
+	return err
+}
+
+// DeletePrefix removes the keys starting with prefix from both tiers and
+// from other instances' L1.
+func (t *TieredStore) DeletePrefix(ctx context.Context, prefix string) error {
+	err := t.l2.DeletePrefix(ctx, prefix)
+	t.l1.DeletePrefix(ctx, prefix)
+	if pubErr := t.publish(invalidation{Key: prefix, Prefix: true}); err == nil {
+		err = pubErr
+	}
+	return err
+}
+
+// Stats returns the hit and miss counters of both tiers.
+func (t *TieredStore) Stats() Stats {
+	return Stats{
+		L1:            TierStats{Hits: t.l1Hits.Load(), Misses: t.l1Misses.Load()},
+		L2:            TierStats{Hits: t.l2Hits.Load(), Misses: t.l2Misses.Load()},
+		L1Entries:     t.l1.cache.Len(),
+		L1Capacity:    t.l1.cache.Capacity(),
+		Invalidations: t.invalidations.Load(),
+	}
+}
+
+// Close stops listening for invalidations. The tiers are left open; they
+// belong to the caller.
+func (t *TieredStore) Close() error {
+	if t.sub != nil {
+		return t.sub.Close()
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package cache
+
+import (
+	"M2A1-URL-Shortner/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestTiers returns two instances sharing l2, which stands in for Redis.
+// Their invalidations reach each other directly instead of through pub/sub.
+func newTestTiers(t *testing.T, l2 URLCache) (*TieredStore, *TieredStore) {
+	t.Helper()
+	stores := make([]*TieredStore, 2)
+	for i := range stores {
+		l1, err := NewBigCacheStoreWithLimits(16, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores[i] = &TieredStore{l1: l1, l2: l2, id: instanceID()}
+	}
+	for _, store := range stores {
+		origin := store
+		origin.publish = func(msg invalidation) error {
+			msg.Origin = origin.id
+			payload, _ := json.Marshal(msg)
+			for _, other := range stores {
+				other.handleInvalidation(payload)
+			}
+			return nil
+		}
+	}
+	return stores[0], stores[1]
+}
+
+func TestTieredStoreKeepsInstancesCoherent(t *testing.T) {
+	ctx := context.Background()
+	a, b := newTestTiers(t, NewMemoryStore(100))
+
+	if err := a.Set(ctx, "abc", models.URLShortener{ShortCode: "abc", OriginalURL: "https://example.com/v1"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if got, err := b.Get(ctx, "abc"); err != nil || got.OriginalURL != "https://example.com/v1" {
+			t.Fatalf("Get = %+v, %v", got, err)
+		}
+	}
+	if stats := b.Stats(); stats.L1 != (TierStats{Hits: 1, Misses: 1}) || stats.L2 != (TierStats{Hits: 1}) {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// An edit on a must not leave b serving v1 from its L1.
+	a.Set(ctx, "abc", models.URLShortener{ShortCode: "abc", OriginalURL: "https://example.com/v2"}, time.Minute)
+	if got, _ := b.Get(ctx, "abc"); got.OriginalURL != "https://example.com/v2" {
+		t.Fatalf("b still serves %s after the edit", got.OriginalURL)
+	}
+
+	a.Delete(ctx, "abc")
+	if _, err := b.Get(ctx, "abc"); err == nil {
+		t.Fatal("b still serves the deleted key")
+	}
+	if stats := b.Stats(); stats.Invalidations != 3 {
+		t.Fatalf("expected 3 invalidations, got %d", stats.Invalidations)
+	}
+	if stats := a.Stats(); stats.Invalidations != 0 {
+		t.Fatalf("a counted its own invalidations: %d", stats.Invalidations)
+	}
+}
+
+func TestTieredStoreNegativeEntries(t *testing.T) {
+	ctx := context.Background()
+	a, b := newTestTiers(t, NewMemoryStore(100))
+
+	if err := a.SetNotFound(ctx, "new", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	for _, store := range []*TieredStore{a, b} {
+		if _, err := store.Get(ctx, "new"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+	}
+	if _, err := b.Get(ctx, "new"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound from b's L1, got %v", err)
+	}
+	if stats := b.Stats(); stats.L1.Hits != 1 || stats.L2.Hits != 1 {
+		t.Fatalf("negative entries should count as hits: %+v", stats)
+	}
+
+	// Creating the code evicts the negative entry everywhere.
+	a.Delete(ctx, "new")
+	if _, err := b.Get(ctx, "new"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected a plain miss after the eviction, got %v", err)
+	}
+}
@@ -4,13 +4,14 @@ import (
 	"M2A1-URL-Shortner/cache"
 	"M2A1-URL-Shortner/pubsub"
 	"log"
-	"os"
 )
 
 func main() {
-	REDIS_URL := os.Getenv("REDIS_URL")
-	REDIS_PASSWORD := os.Getenv("REDIS_PASSWORD")
-	redisStore, err := cache.NewRedisStore(REDIS_URL, REDIS_PASSWORD, 0)
+	redisConfig, err := cache.RedisConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid Redis configuration: %v", err)
+	}
+	redisStore, err := cache.NewRedisStoreFromConfig(redisConfig)
 	if err != nil {
 		log.Fatalf("Failed to initialize Redis cache: %v", err)
 	}
@@ -5,13 +5,14 @@ import (
 	"M2A1-URL-Shortner/pubsub"
 	"M2A1-URL-Shortner/utils"
 	"log"
-	"os"
 )
 
 func main() {
-	REDIS_URL := os.Getenv("REDIS_URL")
-	REDIS_PASSWORD := os.Getenv("REDIS_PASSWORD")
-	redisStore, err := cache.NewRedisStore(REDIS_URL, REDIS_PASSWORD, 0)
+	redisConfig, err := cache.RedisConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid Redis configuration: %v", err)
+	}
+	redisStore, err := cache.NewRedisStoreFromConfig(redisConfig)
 	if err != nil {
 		log.Fatalf("Failed to initialize Redis cache: %v", err)
 	}
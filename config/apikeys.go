@@ -0,0 +1,111 @@
+package config
+
+import (
+	"M2A1-URL-Shortner/models"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrInvalidAPIKey is returned by FindAPIKey for keys that are unknown,
+// revoked or expired.
+var ErrInvalidAPIKey = errors.New("invalid API key")
+
+// lastUsedPrecision is how stale APIKey.LastUsedAt may get, so a busy key
+// is not written to on every request.
+const lastUsedPrecision = time.Minute
+
+// FindAPIKey returns the record of apiKey, with its User loaded. Plaintext
+// keys in users.api_key, from before keys were hashed or inserted directly by
+// onboarding scripts, are accepted until HashPlaintextAPIKeys moves them;
+// their record has no ID and the default scopes.
+func FindAPIKey(apiKey string) (models.APIKey, error) {
+	var key models.APIKey
+	if apiKey == "" {
+		return key, ErrInvalidAPIKey
+	}
+	// The user's images are not needed to authenticate them.
+	withoutImages := func(db *gorm.DB) *gorm.DB { return db.Omit("profile_img", "thumbnail") }
+	err := DB.Preload("User", withoutImages).Where("hash = ?", models.HashAPIKey(apiKey)).First(&key).Error
+	if err == nil {
+		if !key.Active(time.Now()) {
+			return models.APIKey{}, ErrInvalidAPIKey
+		}
+		return key, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return key, err
+	}
+
+	var user models.User
+	err = DB.Where("api_key = ?", apiKey).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return key, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return key, err
+	}
+	return models.APIKey{UserID: user.ID, User: user, Prefix: models.APIKeyPrefix(apiKey)}, nil
+}
+
+// RecordAPIKeyUse sets key's last use to now, unless it was recorded less
+// than lastUsedPrecision ago, and reports whether it did.
+func RecordAPIKeyUse(key *models.APIKey, now time.Time) bool {
+	if key.ID == 0 || (key.LastUsedAt != nil && now.Sub(*key.LastUsedAt) < lastUsedPrecision) {
+		return false
+	}
+	now = now.UTC()
+	if err := DB.Model(&models.APIKey{}).Where("id = ?", key.ID).Update("last_used_at", now).Error; err != nil {
+		fmt.Printf("Error recording use of API key %s: %v\n", key.Prefix, err)
+		return false
+	}
+	key.LastUsedAt = &now
+	return true
+}
+
+// HashPlaintextAPIKeys moves the plaintext keys in users.api_key into
+// api_keys as hashes. Links created with such a key stored it too; those
+// are given the key's owner and keep only its prefix. It returns the number
+// of keys it moved and the short codes of the links it changed, so their
+// cache entries can be dropped.
+func HashPlaintextAPIKeys() (int, []string, error) {
+	var users []models.User
+	if err := DB.Select("id", "api_key").Where("api_key IS NOT NULL AND api_key <> ''").Find(&users).Error; err != nil {
+		return 0, nil, err
+	}
+
+	moved := 0
+	var changed []string
+	for _, user := range users {
+		var shortCodes []string
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			key := models.APIKey{UserID: user.ID, Name: "legacy", Prefix: models.APIKeyPrefix(user.ApiKey), Hash: models.HashAPIKey(user.ApiKey), Scopes: models.DefaultScopes}
+			if err := tx.Create(&key).Error; err != nil {
+				return err
+			}
+			err := tx.Model(&models.URLShortener{}).Where("api_key = ?", user.ApiKey).Pluck("short_code", &shortCodes).Error
+			if err != nil {
+				return err
+			}
+			err = tx.Model(&models.URLShortener{}).
+				Where("api_key = ? AND (user_id IS NULL OR user_id = 0)", user.ApiKey).
+				Update("user_id", user.ID).Error
+			if err != nil {
+				return err
+			}
+			err = tx.Model(&models.URLShortener{}).Where("api_key = ?", user.ApiKey).Update("api_key", key.Prefix).Error
+			if err != nil {
+				return err
+			}
+			return tx.Model(&models.User{}).Where("id = ?", user.ID).Update("api_key", nil).Error
+		})
+		if err != nil {
+			return moved, changed, err
+		}
+		moved++
+		changed = append(changed, shortCodes...)
+	}
+	return moved, changed, nil
+}
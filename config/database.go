@@ -2,6 +2,8 @@ package config
 
 import (
 	"M2A1-URL-Shortner/models"
+	"errors"
+	"fmt"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -12,17 +14,64 @@ var DB *gorm.DB
 
 func InitDB() error {
 	var err error
-	// Open SQLite database with GORM
-	DB, err = gorm.Open(sqlite.Open("url_shortener.db"), &gorm.Config{})
+	// Open SQLite database with GORM. TranslateError turns unique index
+	// violations into gorm.ErrDuplicatedKey so callers can retry on conflict.
+	DB, err = gorm.Open(sqlite.Open("url_shortener.db"), &gorm.Config{TranslateError: true})
 	if err != nil {
 		return err
 	}
 
 	// Auto migrate the schema
-	err = DB.AutoMigrate(&models.URLShortener{}, &models.User{})
+	err = DB.AutoMigrate(&models.URLShortener{}, &models.User{}, &models.ClickEvent{}, &models.LinkRevision{}, &models.APIKey{}, &models.SigningKey{}, &models.RefreshToken{}, &models.Session{}, &models.SSOLink{})
 	if err != nil {
 		return err
 	}
 
+	// One account per email address. Users from before signup have no
+	// email, so empty ones are left out; if existing rows already share an
+	// address the index cannot be built and signup falls back to checking
+	// before inserting.
+	err = DB.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email ON users(email) WHERE email <> ''").Error
+	if err != nil {
+		fmt.Printf("Not enforcing unique user emails: %v\n", err)
+	}
+
 	return nil
 }
+
+// RehashPlaintextPasswords replaces link passwords stored in plain text, from
+// before passwords were hashed, with their bcrypt hash. Empty plaintext
+// passwords never protected anything and are cleared. Passwords too long for
+// bcrypt are left in plain text, where they keep working, and logged so
+// their owners can set a shorter one. It returns the short codes it changed
+// so stale cache entries can be dropped.
+func RehashPlaintextPasswords() ([]string, error) {
+	var links []models.URLShortener
+	if err := DB.Select("id", "short_code", "password").Where("password IS NOT NULL").Find(&links).Error; err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	for _, link := range links {
+		if models.IsPasswordHash(*link.Password) {
+			continue
+		}
+		var hash *string
+		if *link.Password != "" {
+			hashed, err := models.HashPassword(*link.Password)
+			if errors.Is(err, models.ErrPasswordTooLong) {
+				fmt.Printf("Not hashing the password of %s: it is over %d bytes\n", link.ShortCode, models.MaxPasswordLength)
+				continue
+			}
+			if err != nil {
+				return changed, fmt.Errorf("hashing password of %s: %w", link.ShortCode, err)
+			}
+			hash = &hashed
+		}
+		if err := DB.Model(&models.URLShortener{}).Where("id = ?", link.ID).Update("password", hash).Error; err != nil {
+			return changed, err
+		}
+		changed = append(changed, link.ShortCode)
+	}
+	return changed, nil
+}
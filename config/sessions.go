@@ -0,0 +1,28 @@
+package config
+
+import (
+	"M2A1-URL-Shortner/models"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrInvalidSession is returned by FindSession for session cookies that are
+// unknown or expired.
+var ErrInvalidSession = errors.New("invalid session")
+
+// FindSession returns the session of a session cookie, with its User
+// loaded.
+func FindSession(token string) (models.Session, error) {
+	var session models.Session
+	if token == "" {
+		return session, ErrInvalidSession
+	}
+	withoutImages := func(db *gorm.DB) *gorm.DB { return db.Omit("profile_img", "thumbnail") }
+	err := DB.Preload("User", withoutImages).Where("hash = ?", models.HashAPIKey(token)).First(&session).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && !time.Now().Before(session.ExpiresAt)) {
+		return models.Session{}, ErrInvalidSession
+	}
+	return session, err
+}
@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"M2A1-URL-Shortner/batcher"
+	"M2A1-URL-Shortner/config"
+	"M2A1-URL-Shortner/middlewares"
+	"M2A1-URL-Shortner/models"
+	"M2A1-URL-Shortner/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// ClickEvents batches click event inserts for redirects.
+var ClickEvents *batcher.Batcher[models.ClickEvent]
+
+// recordClick stores a click event for a resolved short code, through
+// ClickEvents when it is configured and has room. Failures are only logged
+// so analytics can never break a redirect.
+func recordClick(r *http.Request, shortCode string, urlShortenerID uint) {
+	device, osName, browser := utils.ParseUserAgent(r.UserAgent())
+	click := models.ClickEvent{
+		URLShortenerID: urlShortenerID,
+		ShortCode:      shortCode,
+		Referrer:       r.Referer(),
+		UserAgent:      r.UserAgent(),
+		Device:         device,
+		OS:             osName,
+		Browser:        browser,
+		IPAddress:      utils.AnonymizeIP(middlewares.ClientIP(r)),
+		CreatedAt:      time.Now().UTC(),
+	}
+	if ClickEvents != nil && ClickEvents.TryEnqueue(click) == nil {
+		return
+	}
+	if err := config.DB.Create(&click).Error; err != nil {
+		fmt.Printf("Error recording click for %s: %v\n", shortCode, err)
+	}
+}
+
+// countByColumn is one row of a GROUP BY breakdown of click events.
+type countByColumn struct {
+	Value  string `json:"value"`
+	Clicks int64  `json:"clicks"`
+}
+
+// timeBucket is one point of the click time series.
+type timeBucket struct {
+	Start  time.Time `json:"start"`
+	Clicks int64     `json:"clicks"`
+}
+
+// maxStatsBuckets caps the length of the time series a single request can ask for.
+const maxStatsBuckets = 1000
+
+// maxStatsRange caps the period a single request can count clicks over.
+const maxStatsRange = 366 * 24 * time.Hour
+
+// bucketCount is one row of the click time series query.
+type bucketCount struct {
+	Bucket int64
+	Clicks int64
+}
+
+// LinkStatsHandler returns click analytics for a short code owned by the
+// authenticated user.
+func LinkStatsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := r.Context().Value(middlewares.UserContextKey).(*models.User)
+	if !ok || user == nil {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+	shortCode := mux.Vars(r)["code"]
+
+	var urlShortener models.URLShortener
+	result := ownedBy(config.DB.Model(&models.URLShortener{}), r, user).Where("short_code = ?", shortCode).First(&urlShortener)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		http.Error(w, "Short code not found", http.StatusNotFound)
+		return
+	}
+	if result.Error != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+
+	queryParams := r.URL.Query()
+	interval := queryParams.Get("interval")
+	var bucketSize, defaultRange time.Duration
+	switch interval {
+	case "hour":
+		bucketSize, defaultRange = time.Hour, 48*time.Hour
+	case "", "day":
+		interval = "day"
+		bucketSize, defaultRange = 24*time.Hour, 30*24*time.Hour
+	default:
+		http.Error(w, "interval must be hour or day", http.StatusBadRequest)
+		return
+	}
+
+	to := time.Now().UTC()
+	if toStr := queryParams.Get("to"); toStr != "" {
+		parsed, err := time.Parse(time.RFC3339, toStr)
+		if err != nil {
+			http.Error(w, "to must be an RFC3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		to = parsed.UTC()
+	}
+	from := to.Add(-defaultRange)
+	if fromStr := queryParams.Get("from"); fromStr != "" {
+		parsed, err := time.Parse(time.RFC3339, fromStr)
+		if err != nil {
+			http.Error(w, "from must be an RFC3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		from = parsed.UTC()
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+	if to.Sub(from) > maxStatsBuckets*bucketSize {
+		http.Error(w, fmt.Sprintf("range covers more than %d %ss", maxStatsBuckets, interval), http.StatusBadRequest)
+		return
+	}
+	if to.Sub(from) > maxStatsRange {
+		http.Error(w, "range covers more than 366 days", http.StatusBadRequest)
+		return
+	}
+
+	clicks := config.DB.Model(&models.ClickEvent{}).Where("short_code = ? AND created_at >= ? AND created_at < ?", shortCode, from, to)
+
+	// Clicks are counted per bucket in the database, which returns each
+	// bucket's start as a Unix time.
+	var counts []bucketCount
+	seconds := int64(bucketSize.Seconds())
+	err := clicks.Session(&gorm.Session{}).
+		Select("CAST(strftime('%s', created_at) AS INTEGER) / ? * ? AS bucket, COUNT(*) AS clicks", seconds, seconds).
+		Group("bucket").
+		Scan(&counts).Error
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	// Emit every bucket in the range, including empty ones, so clients can
+	// plot the series directly.
+	timeSeries := []timeBucket{}
+	index := map[int64]int{}
+	for start := from.Truncate(bucketSize); start.Before(to); start = start.Add(bucketSize) {
+		index[start.Unix()] = len(timeSeries)
+		timeSeries = append(timeSeries, timeBucket{Start: start})
+	}
+	var totalClicks int64
+	for _, count := range counts {
+		if i, ok := index[count.Bucket]; ok {
+			timeSeries[i].Clicks += count.Clicks
+			totalClicks += count.Clicks
+		}
+	}
+
+	breakdowns := map[string][]countByColumn{}
+	for key, column := range map[string]string{
+		"top_referrers":     "referrer",
+		"devices":           "device",
+		"operating_systems": "os",
+		"browsers":          "browser",
+	} {
+		rows := []countByColumn{}
+		err := clicks.Session(&gorm.Session{}).
+			Select(column + " AS value, COUNT(*) AS clicks").
+			Group(column).
+			Order("clicks DESC").
+			Limit(10).
+			Scan(&rows).Error
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		for i := range rows {
+			if rows[i].Value == "" {
+				rows[i].Value = "(none)"
+			}
+		}
+		breakdowns[key] = rows
+	}
+
+	response := map[string]interface{}{
+		"short_code":        shortCode,
+		"hit_count":         urlShortener.HitCount,
+		"last_accessed_at":  urlShortener.LastAccessedAt,
+		"from":              from,
+		"to":                to,
+		"interval":          interval,
+		"total_clicks":      totalClicks,
+		"time_series":       timeSeries,
+		"top_referrers":     breakdowns["top_referrers"],
+		"devices":           breakdowns["devices"],
+		"operating_systems": breakdowns["operating_systems"],
+		"browsers":          breakdowns["browsers"],
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
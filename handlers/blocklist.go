@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"M2A1-URL-Shortner/blocklist"
+	"M2A1-URL-Shortner/config"
+	"M2A1-URL-Shortner/middlewares"
+	"M2A1-URL-Shortner/models"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ListBlocklistHandler lists the blocklist entries in force.
+func ListBlocklistHandler(w http.ResponseWriter, r *http.Request) {
+	if middlewares.Blocklist == nil {
+		http.Error(w, "Blocklist is not configured", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"entries": middlewares.Blocklist.Entries()})
+}
+
+// AddBlocklistEntryHandler blocks an API key, IP address or CIDR range,
+// until expires_at or for expires_in if either is given. The refresh tokens
+// of a blocked API key are revoked.
+func AddBlocklistEntryHandler(w http.ResponseWriter, r *http.Request) {
+	if middlewares.Blocklist == nil {
+		http.Error(w, "Blocklist is not configured", http.StatusServiceUnavailable)
+		return
+	}
+	var request struct {
+		Type      string     `json:"type"`
+		Value     string     `json:"value"`
+		Reason    string     `json:"reason"`
+		ExpiresAt *time.Time `json:"expires_at"`
+		ExpiresIn string     `json:"expires_in"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	entry := blocklist.Entry{Type: request.Type, Value: request.Value, Reason: request.Reason, ExpiresAt: request.ExpiresAt}
+	if request.ExpiresIn != "" {
+		ttl, err := time.ParseDuration(request.ExpiresIn)
+		if err != nil || ttl <= 0 || request.ExpiresAt != nil {
+			http.Error(w, "expires_in must be a positive duration such as 24h, and cannot be combined with expires_at", http.StatusBadRequest)
+			return
+		}
+		expiresAt := time.Now().Add(ttl).UTC()
+		entry.ExpiresAt = &expiresAt
+	}
+	if err := entry.Normalize(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, found := blockedKey(entry)
+	if found && entry.Type == blocklist.TypeAPIKey {
+		entry.KeyID = key.ID
+	}
+	entry, err := middlewares.Blocklist.Add(r.Context(), entry)
+	if err != nil {
+		http.Error(w, "Error saving blocklist entry: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if found {
+		revokeAPIKeyTokens(key.ID, time.Now())
+	}
+	expires := "never"
+	if entry.ExpiresAt != nil {
+		expires = entry.ExpiresAt.Format(time.RFC3339)
+	}
+	middlewares.AuditLogger.Printf("Blocklist entry added | Entry: %s | Reason: %s | Expires: %s | Admin IP: %s", entry.Redacted(), entry.Reason, expires, middlewares.ClientIP(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(entry)
+}
+
+// blockedKey finds the API key an api_key or api_key_id entry blocks.
+func blockedKey(entry blocklist.Entry) (models.APIKey, bool) {
+	var key models.APIKey
+	var err error
+	switch entry.Type {
+	case blocklist.TypeAPIKey:
+		err = config.DB.Where("hash = ?", entry.Value).First(&key).Error
+	case blocklist.TypeAPIKeyID:
+		id, _ := strconv.ParseUint(entry.Value, 10, 64)
+		err = config.DB.First(&key, id).Error
+	default:
+		return key, false
+	}
+	return key, err == nil
+}
+
+// RemoveBlocklistEntryHandler unblocks the entry given by the type and value
+// query parameters. Entries from the blocklist file come back when the file
+// is next loaded unless they are removed from it too.
+func RemoveBlocklistEntryHandler(w http.ResponseWriter, r *http.Request) {
+	if middlewares.Blocklist == nil {
+		http.Error(w, "Blocklist is not configured", http.StatusServiceUnavailable)
+		return
+	}
+	entry := blocklist.Entry{Type: r.URL.Query().Get("type"), Value: r.URL.Query().Get("value")}
+	if err := entry.Normalize(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	removed, err := middlewares.Blocklist.Remove(r.Context(), entry.Type, entry.Value)
+	if err != nil {
+		http.Error(w, "Error removing blocklist entry: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		http.Error(w, "Blocklist entry not found", http.StatusNotFound)
+		return
+	}
+	middlewares.AuditLogger.Printf("Blocklist entry removed | Entry: %s | Admin IP: %s", entry.Redacted(), middlewares.ClientIP(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Removed"})
+}
+
+// ScanStatsHandler reports the scan detector's settings and counters, and
+// the clients it currently blocks.
+func ScanStatsHandler(w http.ResponseWriter, r *http.Request) {
+	d := middlewares.ScanDetection
+	blocked := []blocklist.Entry{}
+	if middlewares.Blocklist != nil {
+		for _, entry := range middlewares.Blocklist.Entries() {
+			if entry.Source == blocklist.SourceScanner {
+				blocked = append(blocked, entry)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"threshold": d.Threshold,
+		"window":    d.Window.String(),
+		"block_for": d.BlockFor.String(),
+		"slowdown":  d.Slowdown.String(),
+		"counters":  d.Stats(),
+		"blocked":   blocked,
+	})
+}
@@ -0,0 +1,18 @@
+package handlers
+
+import (
+	"M2A1-URL-Shortner/cache"
+	"encoding/json"
+	"net/http"
+)
+
+// CacheStatsHandler reports the hit and miss counters of each cache tier.
+func CacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	tiered, ok := URLCache.(interface{ Stats() cache.Stats })
+	if !ok {
+		http.Error(w, "Cache statistics are only kept for the tiered cache", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tiered.Stats())
+}
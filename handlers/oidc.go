@@ -0,0 +1,319 @@
+package handlers
+
+import (
+	"M2A1-URL-Shortner/config"
+	"M2A1-URL-Shortner/middlewares"
+	"M2A1-URL-Shortner/models"
+	"M2A1-URL-Shortner/oidc"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SSO is the identity provider users sign in with. main sets it when
+// OIDC_ISSUER is configured; single sign-on is off while it is nil.
+var SSO *oidc.Provider
+
+// SSOTier is the tier of users created by their first single sign-on.
+var SSOTier = "hobby"
+
+const (
+	// loginCookieName holds the state of a login in progress, between the
+	// redirect to the identity provider and its callback.
+	loginCookieName = "oidc_login"
+	loginCookieTTL  = 10 * time.Minute
+	// defaultReturnTo is where a login ends without return_to.
+	defaultReturnTo = "/auth/session"
+)
+
+var (
+	errSSONoEmail       = errors.New("the identity provider shared no email")
+	errSSOEmailTaken    = errors.New("email belongs to another user")
+	errSSOLinkExpired   = errors.New("unknown or expired link")
+	errSSOAlreadyLinked = errors.New("identity or user already linked")
+)
+
+// pendingLogin is kept in the login cookie. Link marks logins started by
+// OIDCLinkHandler; the user they link is stored server side.
+type pendingLogin struct {
+	oidc.Login
+	ReturnTo string `json:"return_to"`
+	Link     bool   `json:"link,omitempty"`
+}
+
+// OIDCLoginHandler starts a single sign-on: it sends the browser to the
+// identity provider, which sends it back to OIDCCallbackHandler.
+func OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if SSO == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+	login, err := oidc.NewLogin()
+	if err != nil {
+		http.Error(w, "Error starting the login", http.StatusInternalServerError)
+		return
+	}
+	value, _ := json.Marshal(pendingLogin{Login: login, ReturnTo: returnPath(r)})
+	setLoginCookie(w, r, base64.RawURLEncoding.EncodeToString(value), int(loginCookieTTL.Seconds()))
+	http.Redirect(w, r, SSO.AuthCodeURL(login), http.StatusFound)
+}
+
+// OIDCLinkHandler starts linking the caller's account to their identity at
+// the identity provider. Existing accounts are never linked by email, so this
+// is how a user who signed up with an API key starts using single sign-on.
+// The browser that sent the request must open the returned URL. The route
+// needs keys:manage, since logging in with the linked identity gives a
+// session with every signup scope.
+func OIDCLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if SSO == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+	caller, ok := middlewares.ContextCaller(r)
+	if !ok {
+		http.Error(w, "Please log in", http.StatusUnauthorized)
+		return
+	}
+	login, err := oidc.NewLogin()
+	if err != nil {
+		http.Error(w, "Error starting the login", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UTC()
+	link := models.SSOLink{UserID: caller.User.ID, StateHash: models.HashAPIKey(login.State), ExpiresAt: now.Add(loginCookieTTL)}
+	config.DB.Where("user_id = ? AND expires_at < ?", caller.User.ID, now).Delete(&models.SSOLink{})
+	if err := config.DB.Create(&link).Error; err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	value, _ := json.Marshal(pendingLogin{Login: login, ReturnTo: returnPath(r), Link: true})
+	setLoginCookie(w, r, base64.RawURLEncoding.EncodeToString(value), int(loginCookieTTL.Seconds()))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{"url": SSO.AuthCodeURL(login)})
+}
+
+// returnPath returns r's return_to. Only paths on this site are allowed, so
+// a login cannot be used to redirect elsewhere.
+func returnPath(r *http.Request) string {
+	returnTo := r.URL.Query().Get("return_to")
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.HasPrefix(returnTo, "/\\") {
+		return defaultReturnTo
+	}
+	return returnTo
+}
+
+func setLoginCookie(w http.ResponseWriter, r *http.Request, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookieName,
+		Value:    value,
+		Path:     "/auth/oidc",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		// Lax, so the cookie comes along on the provider's redirect back.
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func readLoginCookie(r *http.Request) (pendingLogin, bool) {
+	var login pendingLogin
+	cookie, err := r.Cookie(loginCookieName)
+	if err != nil {
+		return login, false
+	}
+	value, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil || json.Unmarshal(value, &login) != nil || login.State == "" {
+		return login, false
+	}
+	return login, true
+}
+
+// OIDCCallbackHandler finishes a single sign-on: it redeems the code the
+// identity provider sent back, finds or creates the user and logs the
+// browser in.
+func OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if SSO == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+	login, ok := readLoginCookie(r)
+	setLoginCookie(w, r, "", -1)
+	query := r.URL.Query()
+	if !ok || subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(login.State)) != 1 {
+		http.Error(w, "This login has expired or was started in another browser; please log in again", http.StatusBadRequest)
+		return
+	}
+	if reason := query.Get("error"); reason != "" {
+		http.Error(w, "The identity provider refused the login: "+reason, http.StatusUnauthorized)
+		return
+	}
+	identity, err := SSO.Exchange(r.Context(), query.Get("code"), login.Login)
+	if err != nil {
+		fmt.Printf("Error completing a single sign-on: %v\n", err)
+		http.Error(w, "The login could not be verified with the identity provider", http.StatusUnauthorized)
+		return
+	}
+
+	var user models.User
+	created := false
+	if login.Link {
+		user, err = linkSSOUser(login.State, identity)
+	} else {
+		user, created, err = ssoUser(identity)
+	}
+	if errors.Is(err, errSSONoEmail) {
+		http.Error(w, "The identity provider did not share your email address", http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, errSSOEmailTaken) {
+		http.Error(w, "This email address belongs to an existing account; log in to it and link this login with POST /auth/oidc/link", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, errSSOLinkExpired) {
+		http.Error(w, "This link has expired; please start it again", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errSSOAlreadyLinked) {
+		http.Error(w, "This login or account is already linked to another one", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error finding the user of a single sign-on: %v\n", err)
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	session, err := middlewares.StartSession(w, r, user)
+	if err != nil {
+		fmt.Printf("Error starting a session: %v\n", err)
+		http.Error(w, "Error starting the session", http.StatusInternalServerError)
+		return
+	}
+	if login.Link {
+		middlewares.AuditLogger.Printf("SSO linked | User: %d | Subject: %s | IP: %s", user.ID, identity.Subject, middlewares.ClientIP(r))
+	}
+	middlewares.AuditLogger.Printf("SSO login | User: %d | Subject: %s | New: %t | Session: %d | IP: %s", user.ID, identity.Subject, created, session.ID, middlewares.ClientIP(r))
+	http.Redirect(w, r, login.ReturnTo, http.StatusSeeOther)
+}
+
+// ssoUser returns the user identity signs in as, and whether it was just
+// created. Users are never linked by email: this service does not verify
+// addresses, so whoever signed up first with an email is not known to own
+// it. Such users link their identity with OIDCLinkHandler instead.
+func ssoUser(identity oidc.Identity) (models.User, bool, error) {
+	var user models.User
+	created := false
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Omit("profile_img", "thumbnail").Where("oidc_issuer = ? AND oidc_subject = ?", identity.Issuer, identity.Subject).First(&user).Error
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		email := strings.ToLower(strings.TrimSpace(identity.Email))
+		if email == "" {
+			return errSSONoEmail
+		}
+		var taken int64
+		if err := tx.Model(&models.User{}).Where("email = ?", email).Count(&taken).Error; err != nil {
+			return err
+		}
+		if taken > 0 {
+			return errSSOEmailTaken
+		}
+
+		name := identity.Name
+		if len(name) > 100 {
+			name = name[:100]
+		}
+		user = models.User{Email: email, Name: name, Tier: SSOTier, OIDCIssuer: &identity.Issuer, OIDCSubject: &identity.Subject}
+		created = true
+		return tx.Create(&user).Error
+	})
+	return user, created, err
+}
+
+// linkSSOUser links identity to the user who started the link with state.
+func linkSSOUser(state string, identity oidc.Identity) (models.User, error) {
+	var user models.User
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		var link models.SSOLink
+		err := tx.Where("state_hash = ?", models.HashAPIKey(state)).First(&link).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errSSOLinkExpired
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Delete(&link).Error; err != nil {
+			return err
+		}
+		if !time.Now().Before(link.ExpiresAt) {
+			return errSSOLinkExpired
+		}
+
+		if err := tx.Omit("profile_img", "thumbnail").First(&user, link.UserID).Error; err != nil {
+			return err
+		}
+		if user.OIDCSubject != nil {
+			if *user.OIDCIssuer == identity.Issuer && *user.OIDCSubject == identity.Subject {
+				return nil
+			}
+			return errSSOAlreadyLinked
+		}
+		var linked int64
+		if err := tx.Model(&models.User{}).Where("oidc_issuer = ? AND oidc_subject = ?", identity.Issuer, identity.Subject).Count(&linked).Error; err != nil {
+			return err
+		}
+		if linked > 0 {
+			return errSSOAlreadyLinked
+		}
+		user.OIDCIssuer, user.OIDCSubject = &identity.Issuer, &identity.Subject
+		return tx.Model(&user).Select("oidc_issuer", "oidc_subject").Updates(&user).Error
+	})
+	return user, err
+}
+
+// SessionHandler returns the logged in user and the CSRF token the browser
+// must send in X-CSRF-Token on requests that change anything.
+func SessionHandler(w http.ResponseWriter, r *http.Request) {
+	caller, ok := middlewares.ContextCaller(r)
+	if !ok || caller.Session == nil {
+		http.Error(w, "Please log in", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user": map[string]interface{}{
+			"id":    caller.User.ID,
+			"email": caller.User.Email,
+			"name":  caller.User.Name,
+			"tier":  caller.Tier,
+		},
+		"csrf_token": caller.Session.CSRFToken,
+		"expires_at": caller.Session.ExpiresAt,
+	})
+}
+
+// LogoutHandler ends the caller's session.
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	caller, ok := middlewares.ContextCaller(r)
+	if !ok || caller.Session == nil {
+		http.Error(w, "Please log in", http.StatusUnauthorized)
+		return
+	}
+	if err := middlewares.EndSession(w, r, caller.Session); err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	middlewares.AuditLogger.Printf("SSO logout | User: %d | Session: %d | IP: %s", caller.User.ID, caller.Session.ID, middlewares.ClientIP(r))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out"})
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"embed"
+	"encoding/json"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+// pages holds one parsed template set per page, each sharing the common layout.
+var pages = map[string]*template.Template{}
+
+func init() {
+	for _, name := range []string{"not_found", "expired", "password", "redirect"} {
+		pages[name] = template.Must(template.ParseFS(templateFS, "templates/layout.html", "templates/"+name+".html"))
+	}
+}
+
+// pageData is the data passed to every link page template.
+type pageData struct {
+	Title        string
+	ShortCode    string
+	Message      string
+	URL          string
+	RedirectType string
+}
+
+// renderPage writes the named HTML page with the given status code.
+func renderPage(w http.ResponseWriter, status int, name string, data pageData) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := pages[name].ExecuteTemplate(w, "layout", data); err != nil {
+		log.Printf("Error rendering %s page: %v", name, err)
+	}
+}
+
+// wantsJSON reports whether the client prefers a JSON response over HTML,
+// based on the first of application/json or text/html listed in Accept.
+func wantsJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+		switch mediaType {
+		case "application/json":
+			return true
+		case "text/html":
+			return false
+		}
+	}
+	return false
+}
+
+// writeLinkError reports a failed short code lookup either as a JSON error
+// or as the matching HTML page.
+func writeLinkError(w http.ResponseWriter, asJSON bool, status int, shortCode, message string) {
+	if asJSON {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": message})
+		return
+	}
+
+	switch status {
+	case http.StatusNotFound:
+		renderPage(w, status, "not_found", pageData{Title: "Link not found", ShortCode: shortCode})
+	case http.StatusGone:
+		renderPage(w, status, "expired", pageData{Title: "Link expired", ShortCode: shortCode})
+	default:
+		http.Error(w, message, status)
+	}
+}
+
+// writePasswordRequired asks the client for the link password, flagging a
+// wrong password when one was supplied.
+func writePasswordRequired(w http.ResponseWriter, asJSON bool, shortCode string, attempted bool) {
+	message := "Please pass password"
+	if attempted {
+		message = "Incorrect password"
+	}
+	if asJSON {
+		writeLinkError(w, true, http.StatusUnauthorized, shortCode, message)
+		return
+	}
+
+	data := pageData{Title: "Password required", ShortCode: shortCode}
+	if attempted {
+		data.Message = message
+	}
+	renderPage(w, http.StatusUnauthorized, "password", data)
+}
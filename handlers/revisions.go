@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"M2A1-URL-Shortner/config"
+	"M2A1-URL-Shortner/middlewares"
+	"M2A1-URL-Shortner/models"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// linkState is the editable part of a link, as stored in revision snapshots.
+type linkState struct {
+	OriginalURL  string     `json:"long_url"`
+	ExpiredAt    *time.Time `json:"expired_at"`
+	Password     *string    `json:"password"`
+	RedirectType string     `json:"redirect_type"`
+}
+
+// fieldChange is one entry of LinkRevision.Changes.
+type fieldChange struct {
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+func stateOf(link models.URLShortener) linkState {
+	return linkState{
+		OriginalURL:  link.OriginalURL,
+		ExpiredAt:    link.ExpiredAt,
+		Password:     link.Password,
+		RedirectType: link.RedirectType,
+	}
+}
+
+// maskPassword stands in for password hashes in revision changes, which are
+// returned to clients.
+func maskPassword(hash *string) interface{} {
+	if hash == nil {
+		return nil
+	}
+	return "********"
+}
+
+// diffStates returns the fields that differ between old and next.
+func diffStates(old, next linkState) map[string]fieldChange {
+	changes := map[string]fieldChange{}
+	if old.OriginalURL != next.OriginalURL {
+		changes["long_url"] = fieldChange{old.OriginalURL, next.OriginalURL}
+	}
+	if (old.ExpiredAt == nil) != (next.ExpiredAt == nil) ||
+		(old.ExpiredAt != nil && !old.ExpiredAt.Equal(*next.ExpiredAt)) {
+		changes["expired_at"] = fieldChange{old.ExpiredAt, next.ExpiredAt}
+	}
+	if (old.Password == nil) != (next.Password == nil) ||
+		(old.Password != nil && *old.Password != *next.Password) {
+		changes["password"] = fieldChange{maskPassword(old.Password), maskPassword(next.Password)}
+	}
+	if old.RedirectType != next.RedirectType {
+		changes["redirect_type"] = fieldChange{old.RedirectType, next.RedirectType}
+	}
+	return changes
+}
+
+// insertRevision appends a revision for link to its history.
+func insertRevision(tx *gorm.DB, link models.URLShortener, action string, userID uint, changes map[string]fieldChange, rollbackOf *uint, createdAt time.Time) (*models.LinkRevision, error) {
+	var latest uint
+	if err := tx.Model(&models.LinkRevision{}).Where("url_shortener_id = ?", link.ID).
+		Select("COALESCE(MAX(revision), 0)").Scan(&latest).Error; err != nil {
+		return nil, err
+	}
+	changesJSON, err := json.Marshal(changes)
+	if err != nil {
+		return nil, err
+	}
+	snapshotJSON, err := json.Marshal(stateOf(link))
+	if err != nil {
+		return nil, err
+	}
+	revision := models.LinkRevision{
+		URLShortenerID: link.ID,
+		Revision:       latest + 1,
+		ShortCode:      link.ShortCode,
+		Action:         action,
+		UserID:         userID,
+		RollbackOf:     rollbackOf,
+		Changes:        string(changesJSON),
+		Snapshot:       string(snapshotJSON),
+		CreatedAt:      createdAt,
+	}
+	if err := tx.Create(&revision).Error; err != nil {
+		return nil, err
+	}
+	return &revision, nil
+}
+
+// recordLinkCreated starts the history of a newly created link. Failures
+// are only logged; the link itself is already saved.
+func recordLinkCreated(link models.URLShortener) {
+	changes := diffStates(linkState{}, stateOf(link))
+	if _, err := insertRevision(config.DB, link, models.RevisionCreate, link.UserID, changes, nil, link.CreatedAt); err != nil {
+		fmt.Printf("Error recording creation of %s: %v\n", link.ShortCode, err)
+	}
+}
+
+// recordLinkDeleted adds the deletion of the link with shortCode to its
+// history. Failures are only logged.
+func recordLinkDeleted(shortCode string) {
+	var link models.URLShortener
+	if err := config.DB.Where("short_code = ?", shortCode).First(&link).Error; err != nil {
+		fmt.Printf("Error recording deletion of %s: %v\n", shortCode, err)
+		return
+	}
+	changes := map[string]fieldChange{"deleted_at": {nil, link.DeletedAt}}
+	if _, err := insertRevision(config.DB, link, models.RevisionDelete, link.UserID, changes, nil, time.Now()); err != nil {
+		fmt.Printf("Error recording deletion of %s: %v\n", shortCode, err)
+	}
+}
+
+// updateLink changes link to next inside tx and records the change as a
+// revision made by userID. Links created before revisions were tracked first
+// get a baseline revision of their current state. It returns nil when next
+// changes nothing. link is updated in place.
+func updateLink(tx *gorm.DB, link *models.URLShortener, next linkState, userID uint, action string, rollbackOf *uint) (*models.LinkRevision, error) {
+	changes := diffStates(stateOf(*link), next)
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	var count int64
+	if err := tx.Model(&models.LinkRevision{}).Where("url_shortener_id = ?", link.ID).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		baseline := diffStates(linkState{}, stateOf(*link))
+		if _, err := insertRevision(tx, *link, models.RevisionCreate, link.UserID, baseline, nil, link.CreatedAt); err != nil {
+			return nil, err
+		}
+	}
+
+	result := tx.Model(&models.URLShortener{}).Where("id = ?", link.ID).Updates(map[string]interface{}{
+		"original_url":  next.OriginalURL,
+		"expired_at":    next.ExpiredAt,
+		"password":      next.Password,
+		"redirect_type": next.RedirectType,
+	})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	link.OriginalURL = next.OriginalURL
+	link.ExpiredAt = next.ExpiredAt
+	link.Password = next.Password
+	link.RedirectType = next.RedirectType
+
+	return insertRevision(tx, *link, action, userID, changes, rollbackOf, time.Now())
+}
+
+// findOwnedLink loads the link with shortCode owned by the authenticated
+// user, writing a 404 or 500 response when it cannot.
+func findOwnedLink(w http.ResponseWriter, r *http.Request, shortCode string, onlyActive bool) (*models.User, *models.URLShortener, bool) {
+	user, ok := r.Context().Value(middlewares.UserContextKey).(*models.User)
+	if !ok || user == nil {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	query := ownedBy(config.DB.Model(&models.URLShortener{}), r, user).Where("short_code = ?", shortCode)
+	if onlyActive {
+		query = query.Where("deleted_at IS NULL")
+	}
+	var link models.URLShortener
+	result := query.First(&link)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		http.Error(w, "Short code not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	if result.Error != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	return user, &link, true
+}
+
+// LinkHistoryHandler lists every recorded change to a link owned by the
+// authenticated user, oldest first.
+func LinkHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	shortCode := mux.Vars(r)["code"]
+	_, link, ok := findOwnedLink(w, r, shortCode, false)
+	if !ok {
+		return
+	}
+
+	var revisions []models.LinkRevision
+	if err := config.DB.Where("url_shortener_id = ?", link.ID).Order("revision").Find(&revisions).Error; err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+
+	history := []map[string]interface{}{}
+	for _, revision := range revisions {
+		var changes map[string]fieldChange
+		if err := json.Unmarshal([]byte(revision.Changes), &changes); err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		entry := map[string]interface{}{
+			"revision":   revision.Revision,
+			"action":     revision.Action,
+			"user_id":    revision.UserID,
+			"created_at": revision.CreatedAt,
+			"changes":    changes,
+		}
+		if revision.RollbackOf != nil {
+			entry["rollback_of"] = *revision.RollbackOf
+		}
+		history = append(history, entry)
+	}
+
+	response := map[string]interface{}{
+		"short_code": shortCode,
+		"revisions":  history,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// LinkRollbackHandler restores a link owned by the authenticated user to the
+// state it had after a previous revision. The rollback is itself recorded as
+// a new revision.
+func LinkRollbackHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Revision uint `json:"revision"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Revision == 0 {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	shortCode := mux.Vars(r)["code"]
+	user, link, ok := findOwnedLink(w, r, shortCode, true)
+	if !ok {
+		return
+	}
+
+	var target models.LinkRevision
+	result := config.DB.Where("url_shortener_id = ? AND revision = ?", link.ID, request.Revision).First(&target)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+	if result.Error != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	var snapshot linkState
+	if err := json.Unmarshal([]byte(target.Snapshot), &snapshot); err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+
+	var revision *models.LinkRevision
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		revision, err = updateLink(tx, link, snapshot, user.ID, models.RevisionRollback, &target.Revision)
+		return err
+	})
+	if err != nil {
+		http.Error(w, "Error in db", http.StatusInternalServerError)
+		return
+	}
+	refreshCachedLink(r.Context(), *link)
+
+	response := map[string]interface{}{"message": "Link already matches revision", "rollback_of": target.Revision}
+	if revision != nil {
+		response = map[string]interface{}{"message": "Rolled back", "revision": revision.Revision, "rollback_of": target.Revision}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"M2A1-URL-Shortner/config"
+	"M2A1-URL-Shortner/models"
+	"M2A1-URL-Shortner/shortcode"
+	"context"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// CodeGenerator produces short codes for links created without a custom code.
+// main replaces it according to SHORT_CODE_GENERATOR and SHORT_CODE_ALPHABET.
+var CodeGenerator shortcode.CodeGenerator = mustRandomGenerator(shortcode.Base62)
+
+// CodeLength is the length generated codes start at; it grows when codes keep
+// colliding.
+var CodeLength = shortcode.NewLength(6, 3, 12)
+
+// maxCodeAttempts bounds how many generated codes are tried for one link.
+const maxCodeAttempts = 10
+
+var errShortCodeTaken = errors.New("short code already exists")
+
+func mustRandomGenerator(alphabet string) shortcode.CodeGenerator {
+	generator, err := shortcode.NewRandomGenerator(alphabet)
+	if err != nil {
+		panic(err)
+	}
+	return generator
+}
+
+// saveWithShortCode inserts urlShortener under customCode, or under a freshly
+// generated code when customCode is empty. The unique index on short_code is
+// the source of truth: a custom code that is already taken returns
+// errShortCodeTaken, and a generated one is replaced and retried. The saved
+// code is evicted from the cache, which may remember it as not found.
+func saveWithShortCode(ctx context.Context, urlShortener *models.URLShortener, customCode string) error {
+	if customCode != "" {
+		urlShortener.ShortCode = customCode
+		err := config.DB.Create(urlShortener).Error
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return errShortCodeTaken
+		}
+		if err == nil {
+			evictCachedLink(ctx, customCode)
+		}
+		return err
+	}
+
+	for attempt := 0; attempt < maxCodeAttempts; attempt++ {
+		length := CodeLength.Current()
+		code, err := CodeGenerator.Generate(length)
+		if err != nil {
+			return err
+		}
+		urlShortener.ID = 0
+		urlShortener.ShortCode = code
+		err = config.DB.Create(urlShortener).Error
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			fmt.Printf("Generated short code %s already exists, retrying\n", code)
+			CodeLength.Collided(length)
+			continue
+		}
+		if err == nil {
+			CodeLength.Succeeded()
+			evictCachedLink(ctx, code)
+		}
+		return err
+	}
+	return fmt.Errorf("no free short code after %d attempts", maxCodeAttempts)
+}
@@ -1,12 +1,15 @@
 package handlers
 
 import (
+	"M2A1-URL-Shortner/batcher"
 	"M2A1-URL-Shortner/cache"
 	"M2A1-URL-Shortner/middlewares"
 	"M2A1-URL-Shortner/models"
 	"M2A1-URL-Shortner/pubsub"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -19,19 +22,45 @@ import (
 
 	"M2A1-URL-Shortner/utils"
 
+	"github.com/gorilla/mux"
+	"golang.org/x/sync/singleflight"
 	"gorm.io/gorm"
 )
 
-var URLCache cache.RedisURLCache
+var URLCache cache.URLCache
+
+// linkLookups collapses concurrent database lookups of the same short code.
+var linkLookups singleflight.Group
 var PS *pubsub.PubSub
 
+// refreshCachedLink replaces the cached copy of link after it changed. If
+// the write fails the entry is dropped instead, so redirects fall back to the
+// database rather than serving the old version.
+func refreshCachedLink(ctx context.Context, link models.URLShortener) {
+	if err := URLCache.Set(ctx, link.ShortCode, link, cache.TTLFor(link, time.Now())); err != nil {
+		fmt.Printf("Error caching %s: %v\n", link.ShortCode, err)
+		evictCachedLink(ctx, link.ShortCode)
+	}
+}
+
+// evictCachedLink drops shortCode from the cache.
+func evictCachedLink(ctx context.Context, shortCode string) {
+	if err := URLCache.Delete(ctx, shortCode); err != nil {
+		fmt.Printf("Error evicting %s from cache: %v\n", shortCode, err)
+	}
+}
+
+// ClickCounter batches hit_count and last_accessed_at updates for redirects.
+var ClickCounter *batcher.Batcher[batcher.Click]
+
 // Handler to shorten URLs
 func ShortenHandler(w http.ResponseWriter, r *http.Request) {
 	var request struct {
-		LongURL    string     `json:"long_url"`
-		ExpiredAt  *time.Time `json:"expired_at"`
-		CustomCode string     `json:"custom_code"`
-		Password   *string    `json:"password,omitempty"`
+		LongURL      string     `json:"long_url"`
+		ExpiredAt    *time.Time `json:"expired_at"`
+		CustomCode   string     `json:"custom_code"`
+		Password     *string    `json:"password,omitempty"`
+		RedirectType string     `json:"redirect_type"`
 	}
 
 	// var user models.User
@@ -41,58 +70,57 @@ func ShortenHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "User not found in context", http.StatusInternalServerError)
 		return
 	}
-	apiKey, ok := r.Context().Value(middlewares.APIContextKey).(string)
-	if !ok || apiKey == "" {
-		http.Error(w, "apiKey not found in context", http.StatusInternalServerError)
-		return
-	}
+	// Callers with an access token have no api_key.
+	apiKey, _ := r.Context().Value(middlewares.APIContextKey).(string)
 
 	// Decode the JSON request body into the request struct
 	err := json.NewDecoder(r.Body).Decode(&request)
-	if err != nil || request.LongURL == "" {
+	if err != nil {
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
-
-	// Check whether customCode is aval for not
-	var shortCode string
-	if request.CustomCode != "" {
-		var urlShortenerExists models.URLShortener
-		result := config.DB.Model(&models.URLShortener{}).Where("short_code = ?", request.CustomCode).First(&urlShortenerExists)
-		if result.RowsAffected != 0 {
-			http.Error(w, "code already exists please try different code", http.StatusConflict)
-			return
-		}
-		shortCode = request.CustomCode
-	} else {
-		// Generate a unique short code for the provided URL
-		shortCode = utils.GenerateShortCode(6)
+	input := linkInput{LongURL: request.LongURL, CustomCode: request.CustomCode, RedirectType: request.RedirectType, Password: request.Password}
+	if fieldErrors := validateLinkInput(r, &input); len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+	passwordHash, err := hashLinkPassword(input.Password)
+	if err != nil {
+		http.Error(w, "Error in saving", http.StatusInternalServerError)
+		return
 	}
 
 	// Create a new URLShortener record with the original URL, short code, and API key
 	// TODO: Check if expired_at default value
 	fmt.Printf("userId before url_shortner insertion:  %d\n", user.ID)
-	fmt.Printf("request.Password before url_shortner insertion:  %v\n", request.Password)
 	urlShortener := models.URLShortener{
-		OriginalURL: request.LongURL,
-		ShortCode:   shortCode,
-		ApiKey:      apiKey,
-		ExpiredAt:   request.ExpiredAt,
-		UserID:      user.ID,
-		Password:    request.Password,
+		OriginalURL:  input.LongURL,
+		ApiKey:       models.APIKeyPrefix(apiKey),
+		ExpiredAt:    request.ExpiredAt,
+		UserID:       user.ID,
+		Password:     passwordHash,
+		RedirectType: input.RedirectType,
+	}
+
+	// Save the URLShortener record to the database under the custom code or
+	// a generated one
+	err = saveWithShortCode(r.Context(), &urlShortener, input.CustomCode)
+	if errors.Is(err, errShortCodeTaken) {
+		http.Error(w, "code already exists please try different code", http.StatusConflict)
+		return
 	}
-
-	// Save the URLShortener record to the database
-	result := config.DB.Create(&urlShortener)
-	if result.Error != nil {
+	if err != nil {
+		fmt.Printf("Error saving short code: %v\n", err)
 		http.Error(w, "Error in saving", http.StatusInternalServerError)
 		return
 	}
+	shortCode := urlShortener.ShortCode
+	recordLinkCreated(urlShortener)
 
 	// Retrieve all existing records in the database with the same original URL
 	var currentLongUrlList []models.URLShortener
 	// check if long_url already exists
-	result = config.DB.Model(&models.URLShortener{}).Find(&currentLongUrlList, "original_url = ?", urlShortener.OriginalURL)
+	result := config.DB.Model(&models.URLShortener{}).Find(&currentLongUrlList, "original_url = ?", urlShortener.OriginalURL)
 	if result.Error != nil {
 		http.Error(w, "Error in saving", http.StatusInternalServerError)
 		return
@@ -112,45 +140,88 @@ func ShortenHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// RedirectHandler resolves a short code to its original URL. Codes requested
+// as GET /{code} redirect the browser unless the client asks for JSON via the
+// Accept header; the legacy GET /redirect?code= API always answers with JSON.
 func RedirectHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("redirect handler called")
 	queryParams := r.URL.Query()
-	shortCode := queryParams.Get("code")
-	password := queryParams.Get("password")
-
-	var urlShortener models.URLShortener
-	// Set up a circuit breaker that opens after 3 failures and resets after 10 seconds.
-	cb := utils.NewCircuitBreaker(3, 10*time.Second)
+	shortCode, fromPath := mux.Vars(r)["code"]
+	if !fromPath {
+		shortCode = queryParams.Get("code")
+	}
+	asJSON := !fromPath || wantsJSON(r)
 
 	// 1. Check Cache First
-	if data, err := URLCache.Get(shortCode); err == nil {
+	data, err := URLCache.Get(r.Context(), shortCode)
+	if errors.Is(err, cache.ErrNotFound) {
+		// Looked up recently and not found; don't ask the database again
+		// until the negative entry expires.
+		w.Header().Set("X-Cache", "HIT")
+		writeLinkError(w, asJSON, http.StatusNotFound, shortCode, "Short code not found")
+		return
+	}
+	if err == nil {
 		// Cache hit: Decode JSON into struct
-		if data.Password != nil && *data.Password != password {
-			http.Error(w, "Please pass password", http.StatusUnauthorized)
+		if data.DeletedAt != nil {
+			evictCachedLink(r.Context(), shortCode)
+			writeLinkError(w, asJSON, http.StatusNotFound, shortCode, "Short code not found")
+			return
+		}
+		if !checkLinkAccess(w, r, data, asJSON) {
 			return
 		}
 		if data.ExpiredAt != nil && data.ExpiredAt.Before(time.Now()) {
-			http.Error(w, "Short code has expired", http.StatusGone)
+			writeLinkError(w, asJSON, http.StatusGone, shortCode, "Short code has expired")
 			return
 		}
 
-		response := map[string]string{"long_url": data.OriginalURL}
-		w.Header().Set("Content-Type", "application/json")
+		countClick(shortCode)
+		recordClick(r, shortCode, data.ID)
+
 		// Set header to indicate a cache hit.
 		w.Header().Set("X-Cache", "HIT")
-		w.Header().Set("Cache-Control", "public, max-age=86400")
-		// w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, proxy-revalidate")
-		// w.Header().Set("Pragma", "no-cache")
-		// w.Header().Set("Expires", "0")
-		json.NewEncoder(w).Encode(response)
+		writeRedirect(w, r, data, asJSON)
 	} else {
-		// Use GORM to query the original URL based on the short code
-		// result := config.DB.Model(&models.URLShortener{}).Where("short_code = ?  AND deleted_at IS NULL", shortCode).First(&urlShortener)
-		// if result.Error != nil {
-		// 	fmt.Println("errors ::")
-		// 	fmt.Print(result.Error.Error())
-		// }
-		var result *gorm.DB
+		urlShortener, err := loadLink(r.Context(), shortCode)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				writeLinkError(w, asJSON, http.StatusNotFound, shortCode, "Short code not found")
+				return
+			}
+			fmt.Printf("Error fetching record from DB: %v\n", err)
+			writeLinkError(w, asJSON, http.StatusInternalServerError, shortCode, "DB error")
+			return
+		}
+
+		if !checkLinkAccess(w, r, urlShortener, asJSON) {
+			return
+		}
+
+		if urlShortener.ExpiredAt != nil && urlShortener.ExpiredAt.Before(time.Now()) {
+			writeLinkError(w, asJSON, http.StatusGone, shortCode, "Short code has expired")
+			return
+		}
+
+		countClick(shortCode)
+		recordClick(r, shortCode, urlShortener.ID)
+
+		// Set header to indicate a cache miss.
+		w.Header().Set("X-Cache", "MISS")
+		writeRedirect(w, r, urlShortener, asJSON)
+	}
+}
+
+// loadLink reads the active link with shortCode from the database and caches
+// the result, remembering codes that don't exist for cache.NegativeTTL.
+// Concurrent misses for the same code share one lookup, which is not
+// cancelled with the request that started it.
+func loadLink(ctx context.Context, shortCode string) (models.URLShortener, error) {
+	ctx = context.WithoutCancel(ctx)
+	value, err, _ := linkLookups.Do(shortCode, func() (interface{}, error) {
+		var urlShortener models.URLShortener
+		// Set up a circuit breaker that opens after 3 failures and resets after 10 seconds.
+		cb := utils.NewCircuitBreaker(3, 10*time.Second)
 		fetchOp := func() error {
 			result := config.DB.
 				Model(&models.URLShortener{}).
@@ -162,128 +233,209 @@ func RedirectHandler(w http.ResponseWriter, r *http.Request) {
 		maxRetries := 3
 		initialDelay := 100 * time.Millisecond
 		if err := utils.RetryWithCircuitBreaker(cb, fetchOp, maxRetries, initialDelay); err != nil {
-			fmt.Printf("Error fetching record from DB: %v\n", err)
-			http.Error(w, "DB error", http.StatusInternalServerError)
-			return
-		}
-
-		URLCache.Set(shortCode, urlShortener)
-
-		if urlShortener.Password != nil && *urlShortener.Password != password {
-			http.Error(w, "Please pass password", http.StatusUnauthorized)
-			return
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				if err := URLCache.SetNotFound(ctx, shortCode, cache.NegativeTTL); err != nil {
+					fmt.Printf("Error caching missing %s: %v\n", shortCode, err)
+				}
+			}
+			return urlShortener, err
 		}
+		URLCache.Set(ctx, shortCode, urlShortener, cache.TTLFor(urlShortener, time.Now()))
+		return urlShortener, nil
+	})
+	return value.(models.URLShortener), err
+}
 
-		if result.RowsAffected == 0 {
-			http.Error(w, "Short code not found", http.StatusNotFound)
+// countClick queues a hit for shortCode, updating the database directly when
+// no ClickCounter is configured or its buffer is full.
+func countClick(shortCode string) {
+	now := time.Now()
+	if ClickCounter != nil {
+		err := ClickCounter.TryEnqueue(batcher.Click{ShortCode: shortCode, Timestamp: now})
+		if err == nil {
 			return
 		}
+		fmt.Printf("Click counter unavailable, updating directly: %v\n", err)
+	}
+	result := config.DB.Model(&models.URLShortener{}).
+		Where("short_code = ?", shortCode).
+		Updates(map[string]interface{}{
+			"hit_count":        gorm.Expr("hit_count + ?", 1),
+			"last_accessed_at": now,
+		})
+	if result.Error != nil {
+		fmt.Printf("Error in update: %s", result.Error.Error())
+	}
+}
 
-		if urlShortener.ExpiredAt != nil && urlShortener.ExpiredAt.Before(time.Now()) {
-			http.Error(w, "Short code has expired", http.StatusGone)
-			return
-		}
+// writeRedirect sends the client on to the original URL using the link's
+// redirect type, or describes the link as JSON for API clients.
+func writeRedirect(w http.ResponseWriter, r *http.Request, urlShortener models.URLShortener, asJSON bool) {
+	redirectType := urlShortener.RedirectType
+	if redirectType == "" {
+		redirectType = models.RedirectFound
+	}
+	// Caches must not replay a password protected link without the password.
+	cacheControl := "public, max-age=86400"
+	if urlShortener.Password != nil {
+		cacheControl = "private, no-store"
+	}
 
-		if result.Error != nil {
-			fmt.Printf("error %s", result.Error.Error())
-			http.Error(w, "DB error", http.StatusInternalServerError)
-			return
-		}
+	if asJSON {
+		response := map[string]string{"long_url": urlShortener.OriginalURL, "redirect_type": redirectType}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", cacheControl)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
 
-		// increment hit_count and update last_accessed_at column
-		// TODO: Try to use single config.DB query
-		// TODO: Update last_accessed_at and hit-count for cache hit too
-		result = config.DB.Model(&models.URLShortener{}).Where("short_code = ? AND deleted_at IS NULL", shortCode).Update("last_accessed_at", time.Now()).Update("hit_count", urlShortener.HitCount+1)
-		if result.Error != nil {
-			fmt.Printf("Error in update: %s", result.Error.Error())
+	switch redirectType {
+	case models.RedirectMovedPermanently, models.RedirectPermanent:
+		// Permanent redirects are meant to be cached by browsers and crawlers.
+		w.Header().Set("Cache-Control", cacheControl)
+		status, _ := strconv.Atoi(redirectType)
+		http.Redirect(w, r, urlShortener.OriginalURL, status)
+	case models.RedirectMetaRefresh, models.RedirectJavaScript:
+		// The URL ends up in a script or meta tag on our own origin, so a
+		// javascript: or data: URL stored before destinations were
+		// validated must never get here.
+		if !isWebURL(urlShortener.OriginalURL) {
+			fmt.Printf("Refusing to render redirect page of %s to a non-http URL\n", urlShortener.ShortCode)
+			writeLinkError(w, false, http.StatusNotFound, urlShortener.ShortCode, "Short code not found")
 			return
 		}
-
-		updateOp := func() error {
-			result := config.DB.Model(&models.URLShortener{}).Where("short_code = ? AND deleted_at IS NULL", shortCode).Update("last_accessed_at", time.Now()).Update("hit_count", urlShortener.HitCount+1)
-			return result.Error
-		}
-		if err := utils.RetryWithCircuitBreaker(cb, updateOp, maxRetries, initialDelay); err != nil {
-			fmt.Printf("Error updating record in DB: %v\n", err)
-			http.Error(w, "DB update error", http.StatusInternalServerError)
-			return
+		// Redirecting from a page of our own lets us strip the referrer.
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		renderPage(w, http.StatusOK, "redirect", pageData{
+			Title:        "Redirecting",
+			ShortCode:    urlShortener.ShortCode,
+			URL:          urlShortener.OriginalURL,
+			RedirectType: redirectType,
+		})
+	default:
+		// Keep browsers from caching temporary redirects so every visit reaches us.
+		status, err := strconv.Atoi(redirectType)
+		if err != nil || (status != http.StatusFound && status != http.StatusTemporaryRedirect) {
+			status = http.StatusFound
 		}
+		w.Header().Set("Cache-Control", "private, no-cache")
+		http.Redirect(w, r, urlShortener.OriginalURL, status)
+	}
+}
 
-		// Redirect the user to the original URL
-		response := map[string]string{"long_url": urlShortener.OriginalURL}
-		w.Header().Set("Content-Type", "application/json")
-		// Set header to indicate a cache miss.
-		w.Header().Set("X-Cache", "MISS")
-		w.Header().Set("Cache-Control", "public, max-age=86400")
-		// w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, proxy-revalidate")
-		// w.Header().Set("Pragma", "no-cache")
-		// w.Header().Set("Expires", "0")
-		json.NewEncoder(w).Encode(response)
-		// http.Redirect(w, r, urlShortener.OriginalURL, http.StatusFound)
+// ownedBy limits query to the links the authenticated caller may change:
+// those of their user, and those that stored their key itself before keys
+// were hashed.
+func ownedBy(query *gorm.DB, r *http.Request, user *models.User) *gorm.DB {
+	apiKey, _ := r.Context().Value(middlewares.APIContextKey).(string)
+	if apiKey == "" {
+		return query.Where("user_id = ?", user.ID)
 	}
+	return query.Where("(api_key = ? OR user_id = ?)", apiKey, user.ID)
 }
 
 func EditRedirectExpiryHandler(w http.ResponseWriter, r *http.Request) {
 	var request struct {
-		ExpiredAt *time.Time `json:"expired_at"`
-		Password  *string    `json:"password,omitempty"`
+		LongURL      *string    `json:"long_url,omitempty"`
+		ExpiredAt    *time.Time `json:"expired_at"`
+		Password     *string    `json:"password,omitempty"`
+		RedirectType *string    `json:"redirect_type,omitempty"`
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	queryParams := r.URL.Query()
 	shortCode := queryParams.Get("code")
 
-	// Retrieve the API key from the request headers
-	apiKey := r.Header.Get("api_key")
-	if apiKey == "" {
-		http.Error(w, "Please pass api_key", http.StatusUnauthorized)
+	user, ok := contextUser(w, r)
+	if !ok {
 		return
 	}
 
 	// Decode the JSON request body into the request struct
 	err := json.NewDecoder(r.Body).Decode(&request)
-	if err != nil || shortCode == "" || (request.ExpiredAt == nil && request.Password == nil) {
+	if err != nil || shortCode == "" || (request.LongURL == nil && request.ExpiredAt == nil && request.Password == nil && request.RedirectType == nil) {
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
+	var fieldErrors []*utils.FieldError
+	if request.LongURL != nil {
+		normalized, fieldErr := utils.NormalizeURL("long_url", *request.LongURL, shortDomains(r))
+		if fieldErr != nil {
+			fieldErrors = append(fieldErrors, fieldErr)
+		} else {
+			request.LongURL = &normalized
+		}
+	}
+	if fieldErr := validatePassword(request.Password); fieldErr != nil {
+		fieldErrors = append(fieldErrors, fieldErr)
+	}
+	if request.RedirectType != nil && !models.IsValidRedirectType(*request.RedirectType) {
+		fieldErrors = append(fieldErrors, redirectTypeError())
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
 	fmt.Printf("date : %s\n", request.ExpiredAt)
-	fmt.Printf("apiKey : %s\n", apiKey)
 	fmt.Printf("shortCode : %s\n", shortCode)
 
-	updates := map[string]interface{}{}
+	var urlShortener models.URLShortener
+	result := ownedBy(config.DB.Model(&models.URLShortener{}), r, user).
+		Where("short_code = ? AND deleted_at IS NULL", shortCode).
+		First(&urlShortener)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		http.Error(w, "No rows updated, check short code and API key", http.StatusNotFound)
+		return
+	}
+	if result.Error != nil {
+		http.Error(w, "Error in db", http.StatusInternalServerError)
+		return
+	}
 
+	next := stateOf(urlShortener)
+	if request.LongURL != nil {
+		next.OriginalURL = *request.LongURL
+	}
 	if request.ExpiredAt != nil {
-		updates["expired_at"] = request.ExpiredAt
+		next.ExpiredAt = request.ExpiredAt
 	}
-
 	if request.Password != nil {
-		updates["password"] = request.Password
-	}
-
-	if len(updates) > 0 {
-		result := config.DB.Model(&models.URLShortener{}).
-			Where("short_code = ? AND api_key = ? AND deleted_at IS NULL", shortCode, apiKey).
-			Updates(updates)
-
-		if result.RowsAffected == 0 {
-			http.Error(w, "No rows updated, check short code and API key", http.StatusNotFound)
-			return
-		}
-
-		if result.Error != nil {
-			http.Error(w, "Error in db", http.StatusInternalServerError)
-			return
-		}
-		var urlShortener models.URLShortener
-		err := config.DB.Model(&models.URLShortener{}).Where("short_code = ? AND api_key = ? AND deleted_at IS NULL", shortCode, apiKey).First(&urlShortener)
+		// An empty password removes the protection.
+		passwordHash, err := hashLinkPassword(request.Password)
 		if err != nil {
 			http.Error(w, "Error in db", http.StatusInternalServerError)
 			return
 		}
-		URLCache.Set(shortCode, urlShortener)
+		next.Password = passwordHash
+	}
+	if request.RedirectType != nil {
+		next.RedirectType = *request.RedirectType
+		// Page redirects put the URL in a script or meta tag, which is only
+		// safe for destinations that pass today's validation.
+		if next.RedirectType == models.RedirectMetaRefresh || next.RedirectType == models.RedirectJavaScript {
+			if _, fieldErr := utils.NormalizeURL("long_url", next.OriginalURL, shortDomains(r)); fieldErr != nil {
+				writeValidationErrors(w, []*utils.FieldError{{Field: "redirect_type", Code: "unsafe_url", Message: "cannot be " + next.RedirectType + " for a link whose long_url is not a valid http or https URL; change long_url first"}})
+				return
+			}
+		}
+	}
+
+	var revision *models.LinkRevision
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		revision, err = updateLink(tx, &urlShortener, next, user.ID, models.RevisionUpdate, nil)
+		return err
+	})
+	if err != nil {
+		http.Error(w, "Error in db", http.StatusInternalServerError)
+		return
 	}
+	refreshCachedLink(r.Context(), urlShortener)
 
-	response := map[string]string{"message": "Update Successfull"}
+	response := map[string]interface{}{"message": "Update Successfull"}
+	if revision != nil {
+		response["revision"] = revision.Revision
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 
@@ -292,19 +444,19 @@ func EditRedirectExpiryHandler(w http.ResponseWriter, r *http.Request) {
 func ShortenBulkHandler(w http.ResponseWriter, r *http.Request) {
 	var request struct {
 		URLs []struct {
-			LongURL    string     `json:"long_url"`
-			ExpiredAt  *time.Time `json:"expired_at"`
-			CustomCode string     `json:"custom_code"`
-			Password   *string    `json:"password,omitempty"`
+			LongURL      string     `json:"long_url"`
+			ExpiredAt    *time.Time `json:"expired_at"`
+			CustomCode   string     `json:"custom_code"`
+			Password     *string    `json:"password,omitempty"`
+			RedirectType string     `json:"redirect_type"`
 		} `json:"urls"`
 	}
 
-	// Retrieve the API key from the request headers
-	apiKey := r.Header.Get("api_key")
-	if apiKey == "" {
-		http.Error(w, "Please pass api_key", http.StatusUnauthorized)
+	user, ok := contextUser(w, r)
+	if !ok {
 		return
 	}
+	apiKey, _ := r.Context().Value(middlewares.APIContextKey).(string)
 
 	// Debug payload
 	body, _ := io.ReadAll(r.Body)
@@ -322,75 +474,66 @@ func ShortenBulkHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var user models.User
-	result := config.DB.Model(&models.User{}).First(&user, "api_key = ?", apiKey)
-	fmt.Print(result)
-	if result.RowsAffected == 0 {
-		http.Error(w, "Please provide a valid api key", http.StatusUnauthorized)
-		return
-	}
-	if result.Error != nil {
-		http.Error(w, "DB Error", http.StatusInternalServerError)
-		return
-	}
-
 	var successes []map[string]string
-	var errors []map[string]string
+	var failures []map[string]interface{}
 
 	for _, urlRequest := range request.URLs {
-		if urlRequest.LongURL == "" {
-			errors = append(errors, map[string]string{
+		input := linkInput{LongURL: urlRequest.LongURL, CustomCode: urlRequest.CustomCode, RedirectType: urlRequest.RedirectType, Password: urlRequest.Password}
+		if fieldErrors := validateLinkInput(r, &input); len(fieldErrors) > 0 {
+			failures = append(failures, map[string]interface{}{
 				"long_url": urlRequest.LongURL,
-				"error":    "Long URL is required",
+				"error":    "Invalid request payload",
+				"fields":   fieldErrors,
 			})
 			continue
 		}
-
-		// Check whether customCode is aval for not
-		var shortCode string
-		if urlRequest.CustomCode != "" {
-			var urlShortenerExists models.URLShortener
-			result := config.DB.Model(&models.URLShortener{}).Where("short_code = ?", urlRequest.CustomCode).First(&urlShortenerExists)
-			if result.RowsAffected != 0 {
-				errors = append(errors, map[string]string{
-					"long_url": urlRequest.LongURL,
-					"error":    "Short code already exists",
-				})
-				continue
-			}
-			shortCode = urlRequest.CustomCode
-		} else {
-			// Generate a unique short code for the provided URL
-			shortCode = utils.GenerateShortCode(6)
+		passwordHash, err := hashLinkPassword(input.Password)
+		if err != nil {
+			failures = append(failures, map[string]interface{}{
+				"long_url": urlRequest.LongURL,
+				"error":    "Failed to save short code",
+			})
+			continue
 		}
 
 		// Create a new URLShortener record with the original URL, short code, and API key
 		// TODO: Check if expired_at default value
 		urlShortener := models.URLShortener{
-			OriginalURL: urlRequest.LongURL,
-			ShortCode:   shortCode,
-			ApiKey:      apiKey,
-			ExpiredAt:   urlRequest.ExpiredAt,
-			UserID:      user.ID,
-			Password:    urlRequest.Password,
+			OriginalURL:  input.LongURL,
+			ApiKey:       models.APIKeyPrefix(apiKey),
+			ExpiredAt:    urlRequest.ExpiredAt,
+			UserID:       user.ID,
+			Password:     passwordHash,
+			RedirectType: input.RedirectType,
 		}
 
-		// Save the URLShortener record to the database
-		result := config.DB.Create(&urlShortener)
-		if result.Error != nil {
-			errors = append(errors, map[string]string{
+		// Save the URLShortener record to the database under the custom code
+		// or a generated one
+		err = saveWithShortCode(r.Context(), &urlShortener, input.CustomCode)
+		if errors.Is(err, errShortCodeTaken) {
+			failures = append(failures, map[string]interface{}{
+				"long_url": urlRequest.LongURL,
+				"error":    "Short code already exists",
+			})
+			continue
+		}
+		if err != nil {
+			fmt.Printf("Error saving short code: %v\n", err)
+			failures = append(failures, map[string]interface{}{
 				"long_url": urlRequest.LongURL,
 				"error":    "Failed to save short code",
 			})
 			continue
 		}
+		shortCode := urlShortener.ShortCode
+		recordLinkCreated(urlShortener)
 
 		// Retrieve all existing records in the database with the same original URL
 		var currentLongUrlList []models.URLShortener
 		// check if long_url already exists
-		result = config.DB.Model(&models.URLShortener{}).Find(&currentLongUrlList, "original_url = ?", urlShortener.OriginalURL)
+		result := config.DB.Model(&models.URLShortener{}).Find(&currentLongUrlList, "original_url = ?", urlShortener.OriginalURL)
 		if result.Error != nil {
-			errors = append(errors, map[string]string{
+			failures = append(failures, map[string]interface{}{
 				"long_url": urlRequest.LongURL,
 				"error":    "DB Error",
 			})
@@ -412,7 +555,7 @@ func ShortenBulkHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	response := map[string]interface{}{
 		"success": successes,
-		"errors":  errors,
+		"errors":  failures,
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
@@ -426,15 +569,12 @@ func DeleteShortenHandler(w http.ResponseWriter, r *http.Request) {
 
 	// var urlShortener URLShortener
 
-	// Retrieve the API key from the request headers
-	apiKey := r.Header.Get("api_key")
-	if apiKey == "" {
-		http.Error(w, "Please pass api_key", http.StatusUnauthorized)
+	user, ok := contextUser(w, r)
+	if !ok {
 		return
 	}
 
-	result := config.DB.Model(&models.URLShortener{}).Where("short_code = ? AND api_key = ? AND deleted_at IS NULL", shortCode, apiKey).Update("deleted_at", time.Now())
-	fmt.Printf("short_code and api_key is: %s,  %s\n", shortCode, apiKey)
+	result := ownedBy(config.DB.Model(&models.URLShortener{}), r, user).Where("short_code = ? AND deleted_at IS NULL", shortCode).Update("deleted_at", time.Now())
 	if result.RowsAffected == 0 {
 		response := map[string]string{"error": "short code not found"}
 		w.WriteHeader(http.StatusNotFound)
@@ -449,21 +589,17 @@ func DeleteShortenHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	evictCachedLink(r.Context(), shortCode)
+	recordLinkDeleted(shortCode)
+
 	response := map[string]string{"message": "short code deleted successfully"}
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
 }
 
 func GetUserUrlsHandler(w http.ResponseWriter, r *http.Request) {
-	apiKey := r.Header.Get("api_key")
-	if apiKey == "" {
-		http.Error(w, "Please pass api_key", http.StatusUnauthorized)
-		return
-	}
-	var user models.User
-	result := config.DB.Model(&models.User{}).First(&user, "api_key = ?", apiKey)
-	if result.Error != nil {
-		http.Error(w, "Invalid API Key", http.StatusUnauthorized)
+	user, ok := contextUser(w, r)
+	if !ok {
 		return
 	}
 
@@ -481,7 +617,7 @@ func GetUserUrlsHandler(w http.ResponseWriter, r *http.Request) {
 	offset := (page - 1) * limit
 
 	var urls []models.URLShortener
-	result = config.DB.Model(&models.URLShortener{}).Where("user_id = ?", user.ID).Limit(limit).Offset(offset).Find(&urls)
+	result := config.DB.Model(&models.URLShortener{}).Where("user_id = ?", user.ID).Limit(limit).Offset(offset).Find(&urls)
 	if result.Error != nil {
 		http.Error(w, "Error fetching URLs", http.StatusInternalServerError)
 		return
@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"M2A1-URL-Shortner/config"
+	"M2A1-URL-Shortner/middlewares"
+	"M2A1-URL-Shortner/models"
+	"M2A1-URL-Shortner/tokens"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RefreshTokenTTL is how long a refresh token can be exchanged. Each
+// exchange issues a new one with a fresh lifetime.
+var RefreshTokenTTL = 30 * 24 * time.Hour
+
+var errRefreshTokenUsed = errors.New("refresh token already used")
+
+// TokenHandler issues an access token and a refresh token. With grant_type
+// "api_key" they are issued for the request's api_key, limited to scope if
+// given; with "refresh_token" the refresh_token is exchanged for new ones.
+func TokenHandler(w http.ResponseWriter, r *http.Request) {
+	if middlewares.AccessTokens == nil {
+		http.Error(w, "Access tokens are not configured", http.StatusServiceUnavailable)
+		return
+	}
+	var request struct {
+		GrantType    string `json:"grant_type"`
+		Scope        string `json:"scope"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	switch request.GrantType {
+	case "api_key":
+		tokenForAPIKey(w, r, request.Scope)
+	case "refresh_token":
+		refreshTokens(w, r, request.RefreshToken)
+	default:
+		http.Error(w, `grant_type must be "api_key" or "refresh_token"`, http.StatusBadRequest)
+	}
+}
+
+// tokenForAPIKey starts a token family for the api_key AuthMiddleware
+// resolved. Access tokens cannot be used here, so a family always ends with
+// the key it was issued for.
+func tokenForAPIKey(w http.ResponseWriter, r *http.Request, scope string) {
+	caller, ok := middlewares.ContextCaller(r)
+	if !ok || caller.Key == nil {
+		http.Error(w, "Please provide a valid api key", http.StatusUnauthorized)
+		return
+	}
+	scopes := caller.Scopes
+	if scope != "" {
+		scopes = strings.Fields(scope)
+		for _, s := range scopes {
+			if !slices.Contains(caller.Scopes, s) {
+				http.Error(w, fmt.Sprintf("This API key does not have the %s scope", s), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	var apiKeyID *uint
+	if caller.Key.ID != 0 {
+		apiKeyID = &caller.Key.ID
+	}
+	family := make([]byte, 16)
+	if _, err := rand.Read(family); err != nil {
+		http.Error(w, "Error issuing tokens", http.StatusInternalServerError)
+		return
+	}
+
+	refreshToken, record, err := models.NewRefreshToken(caller.User.ID, apiKeyID, hex.EncodeToString(family), scopes, RefreshTokenTTL)
+	if err == nil {
+		err = config.DB.Create(&record).Error
+	}
+	if err != nil {
+		fmt.Printf("Error issuing a refresh token: %v\n", err)
+		http.Error(w, "Error issuing tokens", http.StatusInternalServerError)
+		return
+	}
+	middlewares.AuditLogger.Printf("Tokens issued | User: %d | Key: %s | Scopes: %s | IP: %s", caller.User.ID, caller.Key.Prefix, strings.Join(scopes, ","), middlewares.ClientIP(r))
+	writeTokens(w, *caller.User, apiKeyID, scopes, refreshToken)
+}
+
+// refreshTokens exchanges a refresh token for a new access token and
+// refresh token. A token exchanged twice has leaked, so its whole family is
+// revoked; so is a family whose API key no longer works or is blocked.
+func refreshTokens(w http.ResponseWriter, r *http.Request, refreshToken string) {
+	var old models.RefreshToken
+	err := config.DB.Where("hash = ?", models.HashAPIKey(refreshToken)).First(&old).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || refreshToken == "" {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	if old.UsedAt != nil && old.RevokedAt == nil {
+		revokeReusedTokenFamily(r, old, now)
+	}
+	if !old.Usable(now) {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if old.APIKeyID != nil {
+		var key models.APIKey
+		err := config.DB.First(&key, *old.APIKeyID).Error
+		if err != nil || !key.Active(now) {
+			revokeTokenFamily(old.FamilyID, now)
+			http.Error(w, "The API key these tokens were issued for no longer works", http.StatusUnauthorized)
+			return
+		}
+		if entry, blocked := middlewares.BlockedAPIKey(key.Hash, key.ID); blocked {
+			revokeTokenFamily(old.FamilyID, now)
+			middlewares.AuditLogger.Printf("Refresh refused, family revoked | User: %d | Key: %s | Entry: %s | IP: %s", old.UserID, key.Prefix, entry.Redacted(), middlewares.ClientIP(r))
+			http.Error(w, "Forbidden: API key is blacklisted", http.StatusForbidden)
+			return
+		}
+	}
+	// The user is read again, so a new tier shows in the access token.
+	var user models.User
+	if err := config.DB.Omit("profile_img", "thumbnail").First(&user, old.UserID).Error; err != nil {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	var next string
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.RefreshToken{}).Where("id = ? AND used_at IS NULL AND revoked_at IS NULL", old.ID).Update("used_at", now.UTC())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errRefreshTokenUsed
+		}
+		var record models.RefreshToken
+		var err error
+		next, record, err = models.NewRefreshToken(old.UserID, old.APIKeyID, old.FamilyID, old.Scopes, RefreshTokenTTL)
+		if err != nil {
+			return err
+		}
+		return tx.Create(&record).Error
+	})
+	if errors.Is(err, errRefreshTokenUsed) {
+		// Another request exchanged the token since it was read: a reuse
+		// all the same.
+		revokeReusedTokenFamily(r, old, now)
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error refreshing tokens: %v\n", err)
+		http.Error(w, "Error issuing tokens", http.StatusInternalServerError)
+		return
+	}
+	writeTokens(w, user, old.APIKeyID, old.Scopes, next)
+}
+
+// revokeReusedTokenFamily revokes the family of a refresh token exchanged
+// twice.
+func revokeReusedTokenFamily(r *http.Request, token models.RefreshToken, now time.Time) {
+	revokeTokenFamily(token.FamilyID, now)
+	middlewares.AuditLogger.Printf("Refresh token reused, family revoked | User: %d | Family: %s | IP: %s", token.UserID, token.FamilyID, middlewares.ClientIP(r))
+}
+
+// revokeAPIKeyTokens revokes every refresh token issued for the API key with
+// id.
+func revokeAPIKeyTokens(id uint, now time.Time) {
+	err := config.DB.Model(&models.RefreshToken{}).Where("api_key_id = ? AND revoked_at IS NULL", id).Update("revoked_at", now.UTC()).Error
+	if err != nil {
+		fmt.Printf("Error revoking refresh tokens of API key %d: %v\n", id, err)
+	}
+}
+
+// revokeTokenFamily revokes every refresh token of family.
+func revokeTokenFamily(family string, now time.Time) {
+	err := config.DB.Model(&models.RefreshToken{}).Where("family_id = ? AND revoked_at IS NULL", family).Update("revoked_at", now.UTC()).Error
+	if err != nil {
+		fmt.Printf("Error revoking refresh tokens of family %s: %v\n", family, err)
+	}
+}
+
+// writeTokens signs an access token for user and writes it with
+// refreshToken.
+func writeTokens(w http.ResponseWriter, user models.User, apiKeyID *uint, scopes []string, refreshToken string) {
+	tier := user.Tier
+	if tier == "" {
+		tier = middlewares.TierHobby
+	}
+	claims := tokens.Claims{
+		Subject: strconv.FormatUint(uint64(user.ID), 10),
+		Email:   user.Email,
+		Name:    user.Name,
+		Tier:    tier,
+		Scope:   strings.Join(scopes, " "),
+	}
+	if apiKeyID != nil {
+		claims.APIKeyID = *apiKeyID
+	}
+	accessToken, claims, err := middlewares.AccessTokens.Sign(claims)
+	if err != nil {
+		fmt.Printf("Error signing an access token: %v\n", err)
+		http.Error(w, "Error issuing tokens", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":             accessToken,
+		"token_type":               "Bearer",
+		"expires_in":               claims.ExpiresAt - claims.IssuedAt,
+		"scope":                    claims.Scope,
+		"refresh_token":            refreshToken,
+		"refresh_token_expires_in": int64(RefreshTokenTTL.Seconds()),
+	})
+}
+
+// RevokeTokenHandler logs out: it revokes the family of refresh_token. It
+// answers 200 whether or not the token was known.
+func RevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.RefreshToken == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	var token models.RefreshToken
+	err := config.DB.Where("hash = ?", models.HashAPIKey(request.RefreshToken)).First(&token).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	if err == nil {
+		revokeTokenFamily(token.FamilyID, time.Now())
+		middlewares.AuditLogger.Printf("Refresh tokens revoked | User: %d | Family: %s | IP: %s", token.UserID, token.FamilyID, middlewares.ClientIP(r))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Revoked"})
+}
+
+// JWKSHandler publishes the public keys access tokens are signed with.
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	if middlewares.AccessTokens == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	// Keys change at rotation; verifiers should refetch on an unknown kid.
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": middlewares.AccessTokens.JWKS()})
+}
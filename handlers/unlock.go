@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"M2A1-URL-Shortner/config"
+	"M2A1-URL-Shortner/middlewares"
+	"M2A1-URL-Shortner/models"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// UnlockSecret signs the cookies that unlock password protected links. main
+// sets it from UNLOCK_COOKIE_SECRET; the random default only works for a
+// single instance, and cookies stop verifying when it restarts.
+var UnlockSecret = randomSecret()
+
+// LockoutStore counts failed password attempts per short code and client IP.
+// Without it there is no lockout.
+var LockoutStore middlewares.RateLimitStore
+
+const (
+	// unlockCookieTTL is how long a correct password unlocks a link for.
+	unlockCookieTTL = 15 * time.Minute
+	// maxUnlockFailures wrong passwords within unlockLockout lock the client
+	// out of the link for the rest of unlockLockout.
+	maxUnlockFailures = 5
+	unlockLockout     = 15 * time.Minute
+)
+
+func randomSecret() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+func unlockCookieName(shortCode string) string {
+	return "unlock_" + shortCode
+}
+
+// unlockSignature binds a cookie to the short code, its expiry and the current
+// password hash, so changing the password invalidates issued cookies.
+func unlockSignature(link models.URLShortener, expires int64) string {
+	mac := hmac.New(sha256.New, UnlockSecret)
+	fmt.Fprintf(mac, "%s|%d|%s", link.ShortCode, expires, *link.Password)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// setUnlockCookie lets the client follow link without the password until the
+// cookie expires. The cookie is only sent for the link's own path.
+func setUnlockCookie(w http.ResponseWriter, r *http.Request, link models.URLShortener) {
+	expires := time.Now().Add(unlockCookieTTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     unlockCookieName(link.ShortCode),
+		Value:    strconv.FormatInt(expires.Unix(), 10) + "." + unlockSignature(link, expires.Unix()),
+		Path:     "/" + link.ShortCode,
+		Expires:  expires,
+		MaxAge:   int(unlockCookieTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// hasUnlockCookie reports whether r carries a valid, unexpired unlock cookie
+// for link.
+func hasUnlockCookie(r *http.Request, link models.URLShortener) bool {
+	cookie, err := r.Cookie(unlockCookieName(link.ShortCode))
+	if err != nil {
+		return false
+	}
+	expiresStr, signature, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return false
+	}
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(unlockSignature(link, expires)))
+}
+
+func unlockFailureKey(r *http.Request, shortCode string) string {
+	return "unlock_fail:" + shortCode + ":" + middlewares.ClientIP(r)
+}
+
+// unlockLockedFor returns how long the client is still locked out of the
+// short code, or 0. Store errors fail open, like the rate limiters.
+func unlockLockedFor(ctx context.Context, key string) time.Duration {
+	if LockoutStore == nil {
+		return 0
+	}
+	count, ttl, err := LockoutStore.Count(ctx, key)
+	if err != nil || count < maxUnlockFailures {
+		return 0
+	}
+	if ttl <= 0 {
+		return unlockLockout
+	}
+	return ttl
+}
+
+func recordUnlockFailure(ctx context.Context, key string) {
+	if LockoutStore == nil {
+		return
+	}
+	// The window starts on the first failure.
+	count, _, err := LockoutStore.Incr(ctx, key, unlockLockout)
+	if err != nil {
+		fmt.Printf("Error recording failed unlock %s: %v\n", key, err)
+		return
+	}
+	// Lock out for the full period once the limit is reached.
+	if count == maxUnlockFailures {
+		LockoutStore.Expire(ctx, key, unlockLockout)
+	}
+}
+
+func clearUnlockFailures(ctx context.Context, key string) {
+	if LockoutStore == nil {
+		return
+	}
+	LockoutStore.Reset(ctx, key)
+}
+
+// writeLockedOut tells the client to stop guessing for retryAfter.
+func writeLockedOut(w http.ResponseWriter, asJSON bool, shortCode string, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Round(time.Second).Seconds())))
+	message := fmt.Sprintf("Too many incorrect passwords, try again in %d minutes", int(retryAfter.Minutes())+1)
+	if asJSON {
+		writeLinkError(w, true, http.StatusTooManyRequests, shortCode, message)
+		return
+	}
+	renderPage(w, http.StatusTooManyRequests, "password", pageData{Title: "Password required", ShortCode: shortCode, Message: message})
+}
+
+// checkLinkAccess reports whether the request may follow link, answering it
+// with the password form or an error when it may not. Browsers unlock links
+// through UnlockHandler; API clients may still pass ?password=, which is
+// deprecated because the password ends up in logs and browser history.
+func checkLinkAccess(w http.ResponseWriter, r *http.Request, link models.URLShortener, asJSON bool) bool {
+	if link.Password == nil || hasUnlockCookie(r, link) {
+		return true
+	}
+	password := r.URL.Query().Get("password")
+	if !asJSON || password == "" {
+		writePasswordRequired(w, asJSON, link.ShortCode, false)
+		return false
+	}
+
+	w.Header().Set("Deprecation", "true")
+	key := unlockFailureKey(r, link.ShortCode)
+	if retryAfter := unlockLockedFor(r.Context(), key); retryAfter > 0 {
+		writeLockedOut(w, true, link.ShortCode, retryAfter)
+		return false
+	}
+	if !link.CheckPassword(password) {
+		recordUnlockFailure(r.Context(), key)
+		writePasswordRequired(w, true, link.ShortCode, true)
+		return false
+	}
+	clearUnlockFailures(r.Context(), key)
+	return true
+}
+
+// UnlockHandler checks the password posted from the password form and, when
+// it is correct, sets an unlock cookie and sends the browser back to the link.
+func UnlockHandler(w http.ResponseWriter, r *http.Request) {
+	shortCode := mux.Vars(r)["code"]
+	asJSON := wantsJSON(r)
+
+	var link models.URLShortener
+	result := config.DB.Model(&models.URLShortener{}).Where("short_code = ? AND deleted_at IS NULL", shortCode).First(&link)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		writeLinkError(w, asJSON, http.StatusNotFound, shortCode, "Short code not found")
+		return
+	}
+	if result.Error != nil {
+		writeLinkError(w, asJSON, http.StatusInternalServerError, shortCode, "DB error")
+		return
+	}
+	if link.ExpiredAt != nil && link.ExpiredAt.Before(time.Now()) {
+		writeLinkError(w, asJSON, http.StatusGone, shortCode, "Short code has expired")
+		return
+	}
+	if link.Password == nil {
+		http.Redirect(w, r, "/"+shortCode, http.StatusSeeOther)
+		return
+	}
+
+	key := unlockFailureKey(r, shortCode)
+	if retryAfter := unlockLockedFor(r.Context(), key); retryAfter > 0 {
+		writeLockedOut(w, asJSON, shortCode, retryAfter)
+		return
+	}
+	if !link.CheckPassword(r.PostFormValue("password")) {
+		recordUnlockFailure(r.Context(), key)
+		writePasswordRequired(w, asJSON, shortCode, true)
+		return
+	}
+	clearUnlockFailures(r.Context(), key)
+
+	setUnlockCookie(w, r, link)
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, "/"+shortCode, http.StatusSeeOther)
+}
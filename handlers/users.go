@@ -0,0 +1,387 @@
+package handlers
+
+import (
+	"M2A1-URL-Shortner/config"
+	"M2A1-URL-Shortner/middlewares"
+	"M2A1-URL-Shortner/models"
+	"M2A1-URL-Shortner/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// maxAPIKeys caps the usable keys a user can hold, counting rotated keys
+// still in their grace period.
+const maxAPIKeys = 10
+
+// Grace period of rotated keys: how long the old key keeps working next to
+// the new one.
+const (
+	defaultRotationGrace = 24 * time.Hour
+	maxRotationGrace     = 7 * 24 * time.Hour
+)
+
+var (
+	errEmailTaken  = errors.New("email is already registered")
+	errTooManyKeys = errors.New("too many API keys")
+	errLastKey     = errors.New("last usable API key")
+)
+
+// CreateUserHandler signs up a hobby user and issues their first API key.
+// The key is only returned in this response.
+func CreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Email string `json:"email"`
+		Name  string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	email := strings.ToLower(strings.TrimSpace(request.Email))
+	name := strings.TrimSpace(request.Name)
+	var fieldErrors []*utils.FieldError
+	if address, err := mail.ParseAddress(email); err != nil || address.Address != email || len(email) > 254 {
+		fieldErrors = append(fieldErrors, &utils.FieldError{Field: "email", Code: "invalid", Message: "must be an email address"})
+	}
+	if len(name) > 100 {
+		fieldErrors = append(fieldErrors, &utils.FieldError{Field: "name", Code: "too_long", Message: "must be at most 100 characters"})
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	user := models.User{Email: email, Name: name, Tier: "hobby"}
+	var apiKey string
+	var key models.APIKey
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		var existing int64
+		if err := tx.Model(&models.User{}).Where("email = ?", email).Count(&existing).Error; err != nil {
+			return err
+		}
+		if existing > 0 {
+			return errEmailTaken
+		}
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		var err error
+		apiKey, key, err = issueAPIKey(tx, user.ID, "default", models.DefaultScopes, nil)
+		return err
+	})
+	if errors.Is(err, errEmailTaken) || errors.Is(err, gorm.ErrDuplicatedKey) {
+		http.Error(w, "An account with this email already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error creating user: %v\n", err)
+		http.Error(w, "Error creating user", http.StatusInternalServerError)
+		return
+	}
+	middlewares.AuditLogger.Printf("User created | User: %d | Key: %s | IP: %s", user.ID, key.Prefix, middlewares.ClientIP(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user": map[string]interface{}{
+			"id":         user.ID,
+			"email":      user.Email,
+			"name":       user.Name,
+			"tier":       user.Tier,
+			"created_at": user.CreatedAt,
+		},
+		"api_key": apiKey,
+		"key":     key,
+	})
+}
+
+// issueAPIKey creates a key for userID and returns it with its record.
+func issueAPIKey(tx *gorm.DB, userID uint, name string, scopes []string, expiresAt *time.Time) (string, models.APIKey, error) {
+	apiKey, key, err := models.NewAPIKey(userID, name, scopes)
+	if err != nil {
+		return "", key, err
+	}
+	key.ExpiresAt = expiresAt
+	return apiKey, key, tx.Create(&key).Error
+}
+
+// usableAPIKeys returns the user's keys that are neither revoked nor past
+// their grace period.
+func usableAPIKeys(tx *gorm.DB, userID uint) ([]models.APIKey, error) {
+	var keys []models.APIKey
+	err := tx.Where("user_id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", userID, time.Now()).
+		Order("id").Find(&keys).Error
+	return keys, err
+}
+
+// contextUser returns the authenticated user, writing a 500 response when
+// there is none.
+func contextUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	user, ok := r.Context().Value(middlewares.UserContextKey).(*models.User)
+	if !ok || user == nil {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return nil, false
+	}
+	return user, true
+}
+
+// ListAPIKeysHandler lists the authenticated user's usable keys.
+func ListAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := contextUser(w, r)
+	if !ok {
+		return
+	}
+	keys, err := usableAPIKeys(config.DB, user.ID)
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	for i := range keys {
+		keys[i].Scopes = keys[i].GrantedScopes()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+// CreateAPIKeyHandler issues another key to the authenticated user. The key
+// gets the requested scopes, which must all be granted to the calling key
+// (admin only with the admin token or an admin key), and by default the
+// calling key's scopes without admin.
+func CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := contextUser(w, r)
+	if !ok {
+		return
+	}
+	var request struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	// The body is optional.
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	caller, ok := middlewares.ContextCaller(r)
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+	name := strings.TrimSpace(request.Name)
+	var fieldErrors []*utils.FieldError
+	if len(name) > 100 {
+		fieldErrors = append(fieldErrors, &utils.FieldError{Field: "name", Code: "too_long", Message: "must be at most 100 characters"})
+	}
+	scopes := request.Scopes
+	if len(scopes) == 0 {
+		for _, scope := range caller.Scopes {
+			if scope != models.ScopeAdmin {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	for _, scope := range scopes {
+		switch {
+		case !models.IsValidScope(scope):
+			fieldErrors = append(fieldErrors, &utils.FieldError{Field: "scopes", Code: "invalid", Message: fmt.Sprintf("unknown scope %q", scope)})
+		case !canGrantScope(r, caller, scope):
+			fieldErrors = append(fieldErrors, &utils.FieldError{Field: "scopes", Code: "not_allowed", Message: fmt.Sprintf("cannot grant %q with this API key", scope)})
+		}
+	}
+	if request.ExpiresAt != nil && !request.ExpiresAt.After(time.Now()) {
+		fieldErrors = append(fieldErrors, &utils.FieldError{Field: "expires_at", Code: "in_past", Message: "must be in the future"})
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+	scopes = slices.Compact(slices.Sorted(slices.Values(scopes)))
+
+	var apiKey string
+	var key models.APIKey
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		keys, err := usableAPIKeys(tx, user.ID)
+		if err != nil {
+			return err
+		}
+		if len(keys) >= maxAPIKeys {
+			return errTooManyKeys
+		}
+		apiKey, key, err = issueAPIKey(tx, user.ID, name, scopes, request.ExpiresAt)
+		return err
+	})
+	if errors.Is(err, errTooManyKeys) {
+		http.Error(w, fmt.Sprintf("A user can hold at most %d keys; revoke one first", maxAPIKeys), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	middlewares.AuditLogger.Printf("API key issued | User: %d | Key: %s | Scopes: %s | IP: %s", user.ID, key.Prefix, strings.Join(scopes, ","), middlewares.ClientIP(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"api_key": apiKey, "key": key})
+}
+
+// canGrantScope reports whether caller may hand out scope: admin needs the
+// admin token or an admin key, other scopes must be granted to the caller.
+func canGrantScope(r *http.Request, caller *middlewares.Caller, scope string) bool {
+	if scope == models.ScopeAdmin {
+		return middlewares.CanGrantAdmin(r)
+	}
+	return caller.HasScope(scope)
+}
+
+// findAPIKey loads the usable key in the id route variable owned by user,
+// writing a 404 or 500 response when it cannot.
+func findAPIKey(w http.ResponseWriter, r *http.Request, user *models.User) (*models.APIKey, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return nil, false
+	}
+	var key models.APIKey
+	err = config.DB.Where("id = ? AND user_id = ?", id, user.ID).First(&key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && !key.Active(time.Now())) {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return &key, true
+}
+
+// RotateAPIKeyHandler replaces a key with a new one with the same name,
+// scopes and expiry. The old key keeps working for grace_period (default
+// 24h, at most 7 days) so clients can switch over. As when creating a key,
+// the caller must hold every scope the key has, and the new key counts
+// towards maxAPIKeys.
+func RotateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := contextUser(w, r)
+	if !ok {
+		return
+	}
+	var request struct {
+		GracePeriod string `json:"grace_period"`
+	}
+	// The body is optional.
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	grace := defaultRotationGrace
+	if request.GracePeriod != "" {
+		var err error
+		grace, err = time.ParseDuration(request.GracePeriod)
+		if err != nil || grace < 0 || grace > maxRotationGrace {
+			writeValidationErrors(w, []*utils.FieldError{{Field: "grace_period", Code: "invalid", Message: "must be a duration between 0s and 168h"}})
+			return
+		}
+	}
+
+	old, ok := findAPIKey(w, r, user)
+	if !ok {
+		return
+	}
+	caller, ok := middlewares.ContextCaller(r)
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+	for _, scope := range old.GrantedScopes() {
+		if !canGrantScope(r, caller, scope) {
+			middlewares.AuditLogger.Printf("API key rotation refused | User: %d | Key: %s | Scope: %s | IP: %s", user.ID, old.Prefix, scope, middlewares.ClientIP(r))
+			http.Error(w, fmt.Sprintf("Cannot rotate a key with the %s scope with this API key", scope), http.StatusForbidden)
+			return
+		}
+	}
+	var apiKey string
+	var key models.APIKey
+	expiry := old.ExpiresAt
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		expiresAt := time.Now().Add(grace).UTC()
+		if old.ExpiresAt == nil || expiresAt.Before(*old.ExpiresAt) {
+			old.ExpiresAt = &expiresAt
+		}
+		if err := tx.Model(old).Update("expires_at", old.ExpiresAt).Error; err != nil {
+			return err
+		}
+		// The old key counts until its grace period is over.
+		keys, err := usableAPIKeys(tx, user.ID)
+		if err != nil {
+			return err
+		}
+		if len(keys) >= maxAPIKeys {
+			return errTooManyKeys
+		}
+		apiKey, key, err = issueAPIKey(tx, user.ID, old.Name, old.Scopes, expiry)
+		return err
+	})
+	if errors.Is(err, errTooManyKeys) {
+		http.Error(w, fmt.Sprintf("A user can hold at most %d keys; revoke one first or rotate with a shorter grace_period", maxAPIKeys), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	// The old key's cached lookup has no expiry yet.
+	middlewares.ForgetAPIKey(r.Context(), old.Hash)
+	middlewares.AuditLogger.Printf("API key rotated | User: %d | Old key: %s | New key: %s | Old key expires: %s | IP: %s",
+		user.ID, old.Prefix, key.Prefix, old.ExpiresAt.Format(time.RFC3339), middlewares.ClientIP(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"api_key": apiKey, "key": key, "previous": old})
+}
+
+// RevokeAPIKeyHandler stops a key from working at once. A user's last
+// usable key cannot be revoked, since there would be no way to get another.
+func RevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := contextUser(w, r)
+	if !ok {
+		return
+	}
+	key, ok := findAPIKey(w, r, user)
+	if !ok {
+		return
+	}
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		keys, err := usableAPIKeys(tx, user.ID)
+		if err != nil {
+			return err
+		}
+		if len(keys) <= 1 {
+			return errLastKey
+		}
+		return tx.Model(key).Update("revoked_at", time.Now().UTC()).Error
+	})
+	if errors.Is(err, errLastKey) {
+		http.Error(w, "Cannot revoke your only API key; issue or rotate one first", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	middlewares.ForgetAPIKey(r.Context(), key.Hash)
+	middlewares.AuditLogger.Printf("API key revoked | User: %d | Key: %s | IP: %s", user.ID, key.Prefix, middlewares.ClientIP(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Revoked"})
+}
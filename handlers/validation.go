@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"M2A1-URL-Shortner/models"
+	"M2A1-URL-Shortner/utils"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ShortDomains are hosts short links are served on besides the one each
+// request was sent to. Destinations on them are rejected because they would
+// redirect back into the shortener. main fills it from SHORT_DOMAINS.
+var ShortDomains []string
+
+// shortDomains returns the hosts destinations of r must not point at: the
+// host r was sent to, with and without its port, and ShortDomains.
+func shortDomains(r *http.Request) []string {
+	hosts := []string{r.Host}
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		hosts = append(hosts, host)
+	}
+	return append(hosts, ShortDomains...)
+}
+
+// customCodePattern matches what the GET /{code} route accepts.
+var customCodePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// reservedCodes are the first path segments of the service's own routes. A
+// short code equal to one could never be reached.
+var reservedCodes = []string{"admin", "async", "auth", "cache", "enqueue", "health", "links", "redirect", "shorten", "shorten-bulk", "sync", "users"}
+
+// linkInput holds the fields shared by the single, bulk and edit flows.
+type linkInput struct {
+	LongURL      string
+	CustomCode   string
+	RedirectType string
+	Password     *string
+}
+
+// validateLinkInput checks and normalizes input in place, returning one
+// FieldError per rejected field. r is the request input came in.
+func validateLinkInput(r *http.Request, input *linkInput) []*utils.FieldError {
+	var fieldErrors []*utils.FieldError
+
+	normalized, fieldErr := utils.NormalizeURL("long_url", input.LongURL, shortDomains(r))
+	if fieldErr != nil {
+		fieldErrors = append(fieldErrors, fieldErr)
+	} else {
+		input.LongURL = normalized
+	}
+
+	if input.CustomCode != "" && !customCodePattern.MatchString(input.CustomCode) {
+		fieldErrors = append(fieldErrors, &utils.FieldError{
+			Field:   "custom_code",
+			Code:    "invalid",
+			Message: "must be 1 to 64 letters, digits, '_' or '-'",
+		})
+	} else if slices.Contains(reservedCodes, strings.ToLower(input.CustomCode)) {
+		fieldErrors = append(fieldErrors, &utils.FieldError{
+			Field:   "custom_code",
+			Code:    "reserved",
+			Message: "is the path of one of the service's own routes",
+		})
+	}
+
+	if fieldErr := validatePassword(input.Password); fieldErr != nil {
+		fieldErrors = append(fieldErrors, fieldErr)
+	}
+
+	if input.RedirectType == "" {
+		input.RedirectType = models.RedirectFound
+	}
+	if !models.IsValidRedirectType(input.RedirectType) {
+		fieldErrors = append(fieldErrors, redirectTypeError())
+	}
+	return fieldErrors
+}
+
+func validatePassword(password *string) *utils.FieldError {
+	if password != nil && len(*password) > models.MaxPasswordLength {
+		return &utils.FieldError{
+			Field:   "password",
+			Code:    "too_long",
+			Message: fmt.Sprintf("must be at most %d bytes", models.MaxPasswordLength),
+		}
+	}
+	return nil
+}
+
+// hashLinkPassword returns the hash to store for a requested link password.
+// A missing or empty password leaves the link unprotected.
+func hashLinkPassword(password *string) (*string, error) {
+	if password == nil || *password == "" {
+		return nil, nil
+	}
+	hash, err := models.HashPassword(*password)
+	if err != nil {
+		return nil, err
+	}
+	return &hash, nil
+}
+
+// isWebURL reports whether raw is an absolute http or https URL. Links stored
+// before destinations were validated may be anything.
+func isWebURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	return scheme == "http" || scheme == "https"
+}
+
+func redirectTypeError() *utils.FieldError {
+	return &utils.FieldError{
+		Field:   "redirect_type",
+		Code:    "invalid",
+		Message: "must be one of 301, 302, 307, 308, meta_refresh or javascript",
+	}
+}
+
+// writeValidationErrors responds with 400 and the per-field errors.
+func writeValidationErrors(w http.ResponseWriter, fieldErrors []*utils.FieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":  "Invalid request payload",
+		"fields": fieldErrors,
+	})
+}
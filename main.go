@@ -1,17 +1,28 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"M2A1-URL-Shortner/batcher"
+	"M2A1-URL-Shortner/blocklist"
 	"M2A1-URL-Shortner/cache"
 	"M2A1-URL-Shortner/config"
 	"M2A1-URL-Shortner/handlers"
 	middleware "M2A1-URL-Shortner/middlewares"
+	"M2A1-URL-Shortner/models"
+	"M2A1-URL-Shortner/oidc"
 	"M2A1-URL-Shortner/pubsub"
+	"M2A1-URL-Shortner/shortcode"
+	"M2A1-URL-Shortner/tokens"
 	"M2A1-URL-Shortner/utils"
 
 	sentryhttp "github.com/getsentry/sentry-go/http"
@@ -45,6 +56,33 @@ func main() {
 		log.Fatalf("Failed to initialize the database: %v", err)
 	}
 
+	// Hosts short links are served on besides the one each request names;
+	// destinations pointing at them are rejected to avoid redirect loops.
+	for _, domain := range strings.Split(os.Getenv("SHORT_DOMAINS"), ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			handlers.ShortDomains = append(handlers.ShortDomains, domain)
+		}
+	}
+
+	// Proxies allowed to report the client IP in Forwarded, X-Forwarded-For
+	// or X-Real-IP, as a comma-separated list of CIDRs.
+	if err := middleware.SetTrustedProxies(strings.Split(os.Getenv("TRUSTED_PROXIES"), ",")); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
+	if err := configureShortCodes(); err != nil {
+		log.Fatalf("Failed to configure short code generation: %v", err)
+	}
+	if err := configureScanDetection(); err != nil {
+		log.Fatalf("Failed to configure scan detection: %v", err)
+	}
+	if err := configureAccessTokens(); err != nil {
+		log.Fatalf("Failed to configure access tokens: %v", err)
+	}
+	if err := configureSSO(); err != nil {
+		log.Fatalf("Failed to configure single sign-on: %v", err)
+	}
+
 	// var err error
 	// URLCache, err := cache.NewBigCacheStore()
 	// if err != nil {
@@ -52,16 +90,94 @@ func main() {
 	// }
 	// handlers.URLCache = URLCache
 
-	// Initialize Redis cache.
-	REDIS_URL := os.Getenv("REDIS_URL")
-	REDIS_PASSWORD := os.Getenv("REDIS_PASSWORD")
+	// Initialize Redis cache. With REDIS_ENABLED=false the service runs as a
+	// single node on SQLite alone, keeping the cache, rate limits and pub/sub
+	// in process.
+	var redisStore *cache.RedisStore
+	if os.Getenv("REDIS_ENABLED") != "false" {
+		redisConfig, err := cache.RedisConfigFromEnv()
+		if err != nil {
+			log.Fatalf("Invalid Redis configuration: %v", err)
+		}
+		redisStore, err = cache.NewRedisStoreFromConfig(redisConfig)
+		if err != nil {
+			log.Fatalf("Failed to initialize Redis cache: %v", err)
+		}
+	} else {
+		fmt.Println("REDIS_ENABLED=false: running as a single node without Redis")
+	}
+	handlers.URLCache, err = configureCache(redisStore)
+	if err != nil {
+		log.Fatalf("Failed to configure the link cache: %v", err)
+	}
+	if redisStore != nil {
+		middleware.RateLimits = middleware.NewRedisRateLimitStore(redisStore)
+		middleware.APIKeys = middleware.NewRedisAPIKeyCache(redisStore)
+	}
+	handlers.LockoutStore = middleware.RateLimits
+
+	// The blocklist is shared through Redis; config/blacklist.json is
+	// reloaded when it changes.
+	var blocklistStore blocklist.Store = blocklist.NewMemoryStore()
+	if redisStore != nil {
+		blocklistStore = blocklist.NewRedisStore(redisStore)
+	}
+	middleware.Blocklist = blocklist.New(blocklistStore)
+	blocklistFile := os.Getenv("BLOCKLIST_FILE")
+	if blocklistFile == "" {
+		blocklistFile = "config/blacklist.json"
+	}
+	if err := middleware.Blocklist.Start(context.Background(), blocklistFile, 10*time.Second); err != nil {
+		log.Fatalf("Failed to load the blocklist: %v", err)
+	}
+	middleware.AdminToken = os.Getenv("ADMIN_TOKEN")
+	rateLimitConfig := os.Getenv("RATE_LIMIT_CONFIG")
+	if rateLimitConfig == "" {
+		rateLimitConfig = "config/ratelimits.json"
+	}
+	rateLimitPolicy, err := middleware.LoadRateLimitPolicy(rateLimitConfig)
+	if err != nil {
+		log.Fatalf("Failed to load the rate limit policy: %v", err)
+	}
+	if secret := os.Getenv("UNLOCK_COOKIE_SECRET"); secret != "" {
+		handlers.UnlockSecret = []byte(secret)
+	} else {
+		fmt.Println("UNLOCK_COOKIE_SECRET is not set; unlock cookies will not survive a restart")
+	}
+
+	// Hash link passwords saved in plain text by earlier versions, and drop
+	// their cache entries, which still hold the plaintext.
+	rehashed, err := config.RehashPlaintextPasswords()
+	if err != nil {
+		log.Fatalf("Failed to hash plaintext link passwords: %v", err)
+	}
+	for _, shortCode := range rehashed {
+		handlers.URLCache.Delete(context.Background(), shortCode)
+	}
+	if len(rehashed) > 0 {
+		fmt.Printf("Hashed plaintext passwords of %d links\n", len(rehashed))
+	}
 
-	redisStore, err := cache.NewRedisStore(REDIS_URL, REDIS_PASSWORD, 0)
+	// Likewise for API keys kept in plain text on users and their links.
+	movedKeys, keyLinks, err := config.HashPlaintextAPIKeys()
 	if err != nil {
-		log.Fatalf("Failed to initialize Redis cache: %v", err)
+		log.Fatalf("Failed to hash plaintext API keys: %v", err)
+	}
+	for _, shortCode := range keyLinks {
+		handlers.URLCache.Delete(context.Background(), shortCode)
 	}
-	handlers.URLCache = redisStore
-	middleware.RateLimitRedisStore = redisStore
+	if movedKeys > 0 {
+		fmt.Printf("Hashed %d plaintext API keys\n", movedKeys)
+	}
+
+	// Batch redirect bookkeeping: flush every 500 clicks or 5 seconds.
+	batchConfig := batcher.Config{MaxSize: 500, MaxAge: 5 * time.Second, MaxRetries: 3}
+	clickCounter := batcher.New("click-counter", batchConfig, batcher.ClickCountSink(config.DB))
+	clickCounter.Start()
+	handlers.ClickCounter = clickCounter
+	clickEvents := batcher.New("click-events", batchConfig, batcher.ClickEventSink(config.DB))
+	clickEvents.Start()
+	handlers.ClickEvents = clickEvents
 
 	// Initialize Redis Cache for rateLimiting
 	// IpListRedisStore, err := cache.NewRedisStore("localhost:6379", "", 0)
@@ -92,21 +208,6 @@ func main() {
 	// queue.StartLogUploadWorker()
 	// queue.StartNotifyAdminWorker()
 
-	// For demo, flush every 10s or every 5 events
-	// cb := batcher.NewCountBatcher(5)
-	// tb := batcher.NewTimeBatcher(10 * time.Second)
-	// tb.Start()
-	// defer tb.Stop()
-
-	// ticker := time.NewTicker(1 * time.Second)
-	// for i := 0; i < 12; i++ {
-	// 	<-ticker.C
-	// 	evt := batcher.ViewEvent{ProductID: rand.Intn(3) + 1, Timestamp: time.Now()}
-	// 	fmt.Printf("Enqueue event #%d for product %d\n", i+1, evt.ProductID)
-	// 	cb.Enqueue(evt)
-	// 	tb.Enqueue(evt)
-	// }
-
 	// ps := pubsub.NewPubSub()
 
 	// ps.Subscribe("image_uploaded", func(data interface{}) {
@@ -122,7 +223,10 @@ func main() {
 	// })
 
 	// Create PubSub using RedisStore
-	PS := pubsub.NewPubSub(redisStore)
+	PS := pubsub.NewLocalPubSub()
+	if redisStore != nil {
+		PS = pubsub.NewPubSub(redisStore)
+	}
 	PS.Subscribe("image_uploaded", utils.CheckThumbnail)
 	PS.Subscribe("image_uploaded", utils.LogUpload)
 	PS.Subscribe("image_uploaded", utils.NotifyAdmin)
@@ -161,32 +265,59 @@ func main() {
 	// Initialize the router
 	r := mux.NewRouter()
 
+	r.Use(middleware.ClientIPMiddleware)
 	r.Use(middleware.LoggingMiddleware)
+	r.Use(middleware.BlacklistMiddleware)
 	r.Use(sentryHandler.Handle)
 	r.Use(middleware.SentryAlertMiddleware)
 	r.Use(middleware.ResponseTimeMiddleware)
-	// r.Use(middleware.RateLimitMiddleware)
-	// r.Use(middleware.FreeTierMiddleware)
-	// r.Use(middleware.LeakyBucketMiddleware(5, 0.005))
+	// Resolve the api_key once; RequireScope on the routes below checks it.
+	r.Use(middleware.AuthMiddleware)
+	// Rate limits per route name and tier; see config/ratelimits.json.
+	r.Use(middleware.RateLimitPolicyMiddleware(rateLimitPolicy))
 	var handler http.Handler = http.HandlerFunc(handlers.ShortenHandler)
-	handler = middleware.AuthenticateAPIKey(handler)
-	handler = middleware.BlacklistMiddleware(handler)
+	handler = middleware.RequireScope(models.ScopeLinksCreate)(handler)
 	// handler = middleware.APIRateLimitMiddleware(2)(handler)
 	// r.HandleFunc("/redirect", handlers.RedirectHandler).Methods("GET")
 	// r.Handle("/shorten", middleware.LoggingMiddleware(http.HandlerFunc(handlers.ShortenHandler))).Methods("POST")
 	// r.Handle("/shorten", middleware.AuthenticateAPIKey(http.HandlerFunc(handlers.ShortenHandler))).Methods("POST")
-	r.Handle("/shorten", handler).Methods("POST")
-	r.HandleFunc("/redirect", handlers.EditRedirectExpiryHandler).Methods("PATCH")
-	r.Handle("/shorten-bulk", middleware.IsEnterprise(http.HandlerFunc(handlers.ShortenBulkHandler))).Methods("POST")
-	r.HandleFunc("/redirect", handlers.DeleteShortenHandler).Methods("DELETE")
-	r.Handle("/redirect", middleware.APIRateLimitMiddleware(50)(http.HandlerFunc(handlers.RedirectHandler))).Methods("GET")
-	r.HandleFunc("/redirect", handlers.RedirectHandler).Methods("GET")
-	r.HandleFunc("/users/url", handlers.GetUserUrlsHandler).Methods("GET")
-	r.HandleFunc("/health", handlers.HealthHandler).Methods("GET")
-
-	r.HandleFunc("/sync", handlers.SyncHandler).Methods("GET")
-	r.HandleFunc("/async", handlers.AsyncHandler).Methods("GET")
-	r.HandleFunc("/enqueue", handlers.EnqueueHandler).Methods("GET")
+	r.Handle("/shorten", handler).Methods("POST").Name("shorten")
+	r.Handle("/redirect", middleware.RequireScope(models.ScopeLinksWrite)(http.HandlerFunc(handlers.EditRedirectExpiryHandler))).Methods("PATCH").Name("edit-link")
+	r.Handle("/shorten-bulk", middleware.RequireScope(models.ScopeLinksCreate)(middleware.IsEnterprise(http.HandlerFunc(handlers.ShortenBulkHandler)))).Methods("POST").Name("shorten-bulk")
+	r.Handle("/redirect", middleware.RequireScope(models.ScopeLinksDelete)(http.HandlerFunc(handlers.DeleteShortenHandler))).Methods("DELETE").Name("delete-link")
+	r.Handle("/redirect", middleware.ScanDetectorMiddleware(http.HandlerFunc(handlers.RedirectHandler))).Methods("GET").Name("redirect-legacy")
+	r.Handle("/users/url", middleware.RequireScope(models.ScopeLinksRead)(http.HandlerFunc(handlers.GetUserUrlsHandler))).Methods("GET").Name("user-urls")
+	r.HandleFunc("/users", handlers.CreateUserHandler).Methods("POST").Name("signup")
+	r.HandleFunc("/auth/token", handlers.TokenHandler).Methods("POST").Name("auth-token")
+	r.HandleFunc("/auth/revoke", handlers.RevokeTokenHandler).Methods("POST").Name("auth-revoke")
+	r.HandleFunc("/.well-known/jwks.json", handlers.JWKSHandler).Methods("GET").Name("jwks")
+	r.HandleFunc("/auth/oidc/login", handlers.OIDCLoginHandler).Methods("GET").Name("sso-login")
+	r.HandleFunc("/auth/oidc/callback", handlers.OIDCCallbackHandler).Methods("GET").Name("sso-callback")
+	r.Handle("/auth/oidc/link", middleware.RequireScope(models.ScopeKeysManage)(http.HandlerFunc(handlers.OIDCLinkHandler))).Methods("POST").Name("sso-link")
+	r.Handle("/auth/session", middleware.AuthenticateAPIKey(http.HandlerFunc(handlers.SessionHandler))).Methods("GET").Name("session")
+	r.Handle("/auth/logout", middleware.AuthenticateAPIKey(http.HandlerFunc(handlers.LogoutHandler))).Methods("POST").Name("logout")
+	r.Handle("/users/keys", middleware.RequireScope(models.ScopeKeysManage)(http.HandlerFunc(handlers.ListAPIKeysHandler))).Methods("GET").Name("api-keys")
+	r.Handle("/users/keys", middleware.RequireScope(models.ScopeKeysManage)(http.HandlerFunc(handlers.CreateAPIKeyHandler))).Methods("POST").Name("api-keys-create")
+	r.Handle("/users/keys/{id:[0-9]+}/rotate", middleware.RequireScope(models.ScopeKeysManage)(http.HandlerFunc(handlers.RotateAPIKeyHandler))).Methods("POST").Name("api-key-rotate")
+	r.Handle("/users/keys/{id:[0-9]+}", middleware.RequireScope(models.ScopeKeysManage)(http.HandlerFunc(handlers.RevokeAPIKeyHandler))).Methods("DELETE").Name("api-key-revoke")
+	r.Handle("/links/{code}/stats", middleware.RequireScope(models.ScopeAnalyticsRead)(http.HandlerFunc(handlers.LinkStatsHandler))).Methods("GET").Name("link-stats")
+	r.Handle("/links/{code}/history", middleware.RequireScope(models.ScopeLinksRead)(http.HandlerFunc(handlers.LinkHistoryHandler))).Methods("GET").Name("link-history")
+	r.Handle("/links/{code}/rollback", middleware.RequireScope(models.ScopeLinksWrite)(http.HandlerFunc(handlers.LinkRollbackHandler))).Methods("POST").Name("link-rollback")
+	r.HandleFunc("/health", handlers.HealthHandler).Methods("GET").Name("health")
+	r.Handle("/cache/stats", middleware.RequireAdmin(http.HandlerFunc(handlers.CacheStatsHandler))).Methods("GET").Name("cache-stats")
+	r.Handle("/admin/blocklist", middleware.RequireAdmin(http.HandlerFunc(handlers.ListBlocklistHandler))).Methods("GET").Name("admin-blocklist")
+	r.Handle("/admin/blocklist", middleware.RequireAdmin(http.HandlerFunc(handlers.AddBlocklistEntryHandler))).Methods("POST").Name("admin-blocklist-add")
+	r.Handle("/admin/blocklist", middleware.RequireAdmin(http.HandlerFunc(handlers.RemoveBlocklistEntryHandler))).Methods("DELETE").Name("admin-blocklist-remove")
+	r.Handle("/admin/scanners", middleware.RequireAdmin(http.HandlerFunc(handlers.ScanStatsHandler))).Methods("GET").Name("admin-scanners")
+
+	r.HandleFunc("/sync", handlers.SyncHandler).Methods("GET").Name("sync")
+	r.HandleFunc("/async", handlers.AsyncHandler).Methods("GET").Name("async")
+	r.HandleFunc("/enqueue", handlers.EnqueueHandler).Methods("GET").Name("enqueue")
+
+	// short links, registered last so they never shadow the routes above;
+	// clients that keep hitting unknown codes are blocked as scanners
+	r.Handle("/{code:[A-Za-z0-9_-]+}", middleware.ScanDetectorMiddleware(http.HandlerFunc(handlers.RedirectHandler))).Methods("GET").Name("redirect")
+	r.Handle("/{code:[A-Za-z0-9_-]+}/unlock", middleware.ScanDetectorMiddleware(http.HandlerFunc(handlers.UnlockHandler))).Methods("POST").Name("unlock")
 
 	// static path
 	r.PathPrefix("/").Handler(http.FileServer(http.Dir(staticDir)))
@@ -198,9 +329,242 @@ func main() {
 	if port == "" {
 		port = "8080"
 	}
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	srv := &http.Server{Addr: ":" + port, Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server failed: %v", err)
+		}
+	}()
+
+	// Wait for a shutdown signal, drain in-flight requests, then write the
+	// remaining batched clicks.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	fmt.Println("Shutting down server")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Server shutdown failed: %v", err)
+	}
+	clickCounter.Stop()
+	clickEvents.Stop()
 }
 
 // func finalHandler(w http.ResponseWriter, r *http.Request) {
 // 	w.Write([]byte("Final handler response\n"))
 // }
+
+// configureShortCodes sets up short code generation from the environment:
+// SHORT_CODE_GENERATOR (random or counter), SHORT_CODE_ALPHABET (base62,
+// unambiguous or a literal set of characters), SHORT_CODE_LENGTH (starting
+// length, default 6) and SHORT_CODE_SALT (scrambles counter codes).
+func configureShortCodes() error {
+	var salt uint64
+	if saltStr := os.Getenv("SHORT_CODE_SALT"); saltStr != "" {
+		parsed, err := strconv.ParseUint(saltStr, 10, 64)
+		if err != nil {
+			return fmt.Errorf("SHORT_CODE_SALT: %w", err)
+		}
+		salt = parsed
+	}
+
+	// Counter codes continue after the highest existing id, so a restart does
+	// not hand out codes from the start of the sequence again.
+	var maxID uint64
+	if err := config.DB.Model(&models.URLShortener{}).Select("COALESCE(MAX(id), 0)").Scan(&maxID).Error; err != nil {
+		return err
+	}
+	generator, err := shortcode.New(os.Getenv("SHORT_CODE_GENERATOR"), os.Getenv("SHORT_CODE_ALPHABET"), salt, shortcode.NewSequence(maxID+1))
+	if err != nil {
+		return err
+	}
+	handlers.CodeGenerator = generator
+
+	if lengthStr := os.Getenv("SHORT_CODE_LENGTH"); lengthStr != "" {
+		length, err := strconv.Atoi(lengthStr)
+		if err != nil || length < 4 || length > 32 {
+			return fmt.Errorf("SHORT_CODE_LENGTH must be between 4 and 32, got %q", lengthStr)
+		}
+		handlers.CodeLength = shortcode.NewLength(length, 3, length+6)
+	}
+	return nil
+}
+
+// configureScanDetection sets up the short code scan detector from the
+// environment: SCAN_THRESHOLD (not-found lookups allowed per client IP in
+// SCAN_WINDOW, default 50; 0 turns detection off), SCAN_WINDOW (default 1m),
+// SCAN_BLOCK_FOR (how long scanners are blocked, default 15m) and
+// SCAN_SLOWDOWN (how long their refused requests are held, default 0).
+func configureScanDetection() error {
+	d := middleware.ScanDetection
+	if v := os.Getenv("SCAN_THRESHOLD"); v != "" {
+		threshold, err := strconv.Atoi(v)
+		if err != nil || threshold < 0 {
+			return fmt.Errorf("SCAN_THRESHOLD must be a number of lookups, got %q", v)
+		}
+		d.Threshold = threshold
+	}
+	for name, target := range map[string]*time.Duration{
+		"SCAN_WINDOW":    &d.Window,
+		"SCAN_BLOCK_FOR": &d.BlockFor,
+		"SCAN_SLOWDOWN":  &d.Slowdown,
+	} {
+		if v := os.Getenv(name); v != "" {
+			duration, err := time.ParseDuration(v)
+			if err != nil || duration < 0 || (duration == 0 && name != "SCAN_SLOWDOWN") {
+				return fmt.Errorf("%s must be a positive duration such as 1m, got %q", name, v)
+			}
+			*target = duration
+		}
+	}
+	return nil
+}
+
+// configureAccessTokens sets up the issuer of Bearer access tokens from the
+// environment: JWT_ISSUER (default url-shortener), JWT_ACCESS_TTL (default
+// 15m), JWT_REFRESH_TTL (default 720h) and JWT_KEY_ROTATION (how often the
+// signing key is replaced, default 168h). Signing keys are kept in the
+// database, so every instance signs with the same key.
+func configureAccessTokens() error {
+	issuer := os.Getenv("JWT_ISSUER")
+	if issuer == "" {
+		issuer = "url-shortener"
+	}
+	accessTTL, rotateEvery := 15*time.Minute, 7*24*time.Hour
+	for name, target := range map[string]*time.Duration{
+		"JWT_ACCESS_TTL":   &accessTTL,
+		"JWT_REFRESH_TTL":  &handlers.RefreshTokenTTL,
+		"JWT_KEY_ROTATION": &rotateEvery,
+	} {
+		if v := os.Getenv(name); v != "" {
+			duration, err := time.ParseDuration(v)
+			if err != nil || duration <= 0 {
+				return fmt.Errorf("%s must be a positive duration such as 15m, got %q", name, v)
+			}
+			*target = duration
+		}
+	}
+	middleware.AccessTokens = tokens.New(tokens.NewGormStore(config.DB), issuer, accessTTL, rotateEvery)
+	return middleware.AccessTokens.Start(context.Background(), time.Minute)
+}
+
+// configureSSO sets up single sign-on with the OpenID Connect provider at
+// OIDC_ISSUER, if set. The service must be registered with it as a client:
+// OIDC_CLIENT_ID, OIDC_CLIENT_SECRET (empty for a public client) and
+// OIDC_REDIRECT_URL, the public URL of /auth/oidc/callback. OIDC_SCOPES
+// defaults to "openid email profile", OIDC_USER_TIER (the tier of users
+// created by a first login) to hobby, and SESSION_TTL to 12h.
+func configureSSO() error {
+	if v := os.Getenv("SESSION_TTL"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("SESSION_TTL must be a positive duration such as 12h, got %q", v)
+		}
+		middleware.SessionTTL = ttl
+	}
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil
+	}
+	clientID, redirectURL := os.Getenv("OIDC_CLIENT_ID"), os.Getenv("OIDC_REDIRECT_URL")
+	if clientID == "" || redirectURL == "" {
+		return fmt.Errorf("OIDC_CLIENT_ID and OIDC_REDIRECT_URL are required with OIDC_ISSUER")
+	}
+	if tier := os.Getenv("OIDC_USER_TIER"); tier != "" {
+		if tier != middleware.TierHobby && tier != middleware.TierEnterprise {
+			return fmt.Errorf("OIDC_USER_TIER must be hobby or enterprise, got %q", tier)
+		}
+		handlers.SSOTier = tier
+	}
+	scopes := strings.Fields(os.Getenv("OIDC_SCOPES"))
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	provider, err := oidc.Discover(ctx, issuer, clientID, os.Getenv("OIDC_CLIENT_SECRET"), redirectURL, scopes)
+	if err != nil {
+		return err
+	}
+	handlers.SSO = provider
+	return nil
+}
+
+// configureCache builds the link cache selected by CACHE_BACKEND:
+//   - tiered (default): in-process BigCache in front of Redis
+//   - redis: Redis only
+//   - bigcache: in-process BigCache only
+//   - memory: in-process LRU, the default without Redis
+//
+// The in-process backends are not shared between instances, so only use them
+// with a single instance. redisStore is nil when Redis is disabled.
+func configureCache(redisStore *cache.RedisStore) (cache.URLCache, error) {
+	// Links are cached until they expire, but for no longer than
+	// CACHE_MAX_TTL. Unknown short codes are remembered for
+	// CACHE_NEGATIVE_TTL.
+	for name, target := range map[string]*time.Duration{
+		"CACHE_MAX_TTL":      &cache.MaxTTL,
+		"CACHE_NEGATIVE_TTL": &cache.NegativeTTL,
+	} {
+		if v := os.Getenv(name); v != "" {
+			ttl, err := time.ParseDuration(v)
+			if err != nil || ttl <= 0 {
+				return nil, fmt.Errorf("%s must be a positive duration such as 30s, got %q", name, v)
+			}
+			*target = ttl
+		}
+	}
+
+	sizeMB, l1TTL, maxEntries := 64, time.Minute, 100000
+	if v := os.Getenv("CACHE_L1_SIZE_MB"); v != "" {
+		var err error
+		if sizeMB, err = strconv.Atoi(v); err != nil || sizeMB <= 0 {
+			return nil, fmt.Errorf("CACHE_L1_SIZE_MB must be a number of megabytes, got %q", v)
+		}
+	}
+	if v := os.Getenv("CACHE_L1_TTL"); v != "" {
+		var err error
+		if l1TTL, err = time.ParseDuration(v); err != nil || l1TTL <= 0 {
+			return nil, fmt.Errorf("CACHE_L1_TTL must be a positive duration such as 1m, got %q", v)
+		}
+	}
+	if v := os.Getenv("CACHE_MEMORY_MAX_ENTRIES"); v != "" {
+		var err error
+		if maxEntries, err = strconv.Atoi(v); err != nil || maxEntries <= 0 {
+			return nil, fmt.Errorf("CACHE_MEMORY_MAX_ENTRIES must be a positive number, got %q", v)
+		}
+	}
+
+	backend := os.Getenv("CACHE_BACKEND")
+	if backend == "" {
+		backend = "tiered"
+		if redisStore == nil {
+			backend = "memory"
+		}
+	}
+	if redisStore == nil && (backend == "tiered" || backend == "redis") {
+		return nil, fmt.Errorf("CACHE_BACKEND=%s needs Redis, which is disabled", backend)
+	}
+	switch backend {
+	case "tiered":
+		l1, err := cache.NewBigCacheStoreWithLimits(sizeMB, l1TTL)
+		if err != nil {
+			return nil, err
+		}
+		tiered := cache.NewTieredStore(l1, redisStore)
+		if err := tiered.Listen(); err != nil {
+			return nil, fmt.Errorf("subscribing to cache invalidations: %w", err)
+		}
+		return tiered, nil
+	case "redis":
+		return redisStore, nil
+	case "bigcache":
+		return cache.NewBigCacheStoreWithLimits(sizeMB, 0)
+	case "memory":
+		return cache.NewMemoryStore(maxEntries), nil
+	default:
+		return nil, fmt.Errorf("unknown CACHE_BACKEND %q, want tiered, redis, bigcache or memory", backend)
+	}
+}
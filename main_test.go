@@ -2,21 +2,30 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
+	"M2A1-URL-Shortner/blocklist"
 	"M2A1-URL-Shortner/cache"
 	"M2A1-URL-Shortner/config"
 	"M2A1-URL-Shortner/handlers"
 	middleware "M2A1-URL-Shortner/middlewares"
 	"M2A1-URL-Shortner/models"
+	"M2A1-URL-Shortner/oidc"
+	"M2A1-URL-Shortner/oidc/oidctest"
+	"M2A1-URL-Shortner/tokens"
 	"M2A1-URL-Shortner/utils"
-	"M2A1-URL-Shortner/queue"
 
 	"github.com/gorilla/mux"
 )
@@ -46,17 +55,20 @@ func TestRateLimiter(t *testing.T) {
 	if err := config.InitDB(); err != nil {
 		t.Fatalf("Failed to initialize database: %v", err)
 	}
-	redisStore, err := cache.NewRedisStore("localhost:6379", "", 0)
-	if err != nil {
-		log.Fatalf("Failed to initialize Redis cache: %v", err)
-	}
-	handlers.URLCache = redisStore
-	middleware.RateLimitRedisStore = redisStore
-	// Flush the test DB.
-	if err := redisStore.Client.FlushDB(redisStore.Ctx).Err(); err != nil {
-		t.Fatalf("failed to flush redis: %v", err)
+	// Use Redis when it is running, the in-process store otherwise.
+	defaultRateLimits := middleware.RateLimits
+	defer func() { middleware.RateLimits = defaultRateLimits }()
+	middleware.RateLimits = middleware.NewMemoryRateLimitStore()
+	if redisStore, err := cache.NewRedisStore("localhost:6379", "", 0); err == nil {
+		handlers.URLCache = redisStore
+		// Flush the test DB.
+		if err := redisStore.Client.FlushDB(redisStore.Ctx).Err(); err != nil {
+			t.Fatalf("failed to flush redis: %v", err)
+		}
+		middleware.RateLimits = middleware.NewRedisRateLimitStore(redisStore)
+	} else {
+		t.Logf("Redis unavailable, using the in-process rate limit store: %v", err)
 	}
-	middleware.RateLimitRedisStore = redisStore
 
 	// Create a simple test handler that returns 200 OK.
 	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -119,7 +131,7 @@ func TestRedirectPerformance(t *testing.T) {
 	missCountWithoutCache := 0
 	req := httptest.NewRequest(http.MethodGet, redirectURL, nil)
 	for i := 0; i < 100; i++ {
-		testCache.Delete(shortCode)
+		testCache.Delete(context.Background(), shortCode)
 		// handlers.URLCache.Delete(shortCode)
 		req.Header.Set("api_key", "test12345")
 		resp := httptest.NewRecorder()
@@ -180,7 +192,7 @@ func TestRedirectCaching(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to initialize cache: %v", err)
 	}
-	if err := testCache.Set(shortCode, models.URLShortener{OriginalURL: longURL}); err != nil {
+	if err := testCache.Set(context.Background(), shortCode, models.URLShortener{OriginalURL: longURL}, time.Minute); err != nil {
 		t.Fatalf("failed to set cache: %v", err)
 	}
 
@@ -212,7 +224,7 @@ func TestURLShortenerAndRedirect(t *testing.T) {
 	r.Handle("/shorten", middleware.AuthenticateAPIKey(http.HandlerFunc(handlers.ShortenHandler))).Methods("POST")
 	r.HandleFunc("/redirect", handlers.RedirectHandler).Methods("GET")
 
-	shortenReqPayload := map[string]string{"long_url": "https://example.com"}
+	shortenReqPayload := map[string]string{"long_url": "https://example.org"}
 	reqBody, _ := json.Marshal(shortenReqPayload)
 
 	req := httptest.NewRequest(http.MethodPost, "/shorten", bytes.NewBuffer(reqBody))
@@ -255,8 +267,8 @@ func TestURLShortenerAndRedirect(t *testing.T) {
 	}
 
 	longURL, exists := redirectResp["long_url"]
-	if !exists || longURL != "https://example.com" {
-		t.Fatalf("Expected long URL 'https://example.com', got '%s'", longURL)
+	if !exists || longURL != "https://example.org" {
+		t.Fatalf("Expected long URL 'https://example.org', got '%s'", longURL)
 	}
 }
 
@@ -265,12 +277,17 @@ func TestDuplcateUrl(t *testing.T) {
 	if err := config.InitDB(); err != nil {
 		t.Fatalf("Failed to initialize database: %v", err)
 	}
+	testCache, err := cache.NewBigCacheStore()
+	if err != nil {
+		t.Fatalf("failed to initialize cache: %v", err)
+	}
+	handlers.URLCache = testCache
 
 	// randomUrl := "http://www.example.com/test2"
 	randomUrl := "http://www." + utils.GenerateShortCode(7) + ".com/" + utils.GenerateShortCode(4)
 
 	r := mux.NewRouter()
-	r.HandleFunc("/shorten", handlers.ShortenHandler).Methods("POST")
+	r.Handle("/shorten", middleware.RequireScope(models.ScopeLinksCreate)(http.HandlerFunc(handlers.ShortenHandler))).Methods("POST")
 
 	shortenReqPayload := map[string]string{"long_url": randomUrl}
 	reqBody, _ := json.Marshal(shortenReqPayload)
@@ -338,13 +355,14 @@ func TestDeleteShortCode(t *testing.T) {
 		t.Fatalf("Failed to initialize database: %v", err)
 	}
 	var urlShortener models.URLShortener
-	result := config.DB.Model(&models.URLShortener{}).First(&urlShortener, "api_key IS NOT NULL AND deleted_at IS NULL")
+	// Links whose api_key belongs to no user cannot be deleted.
+	result := config.DB.Model(&models.URLShortener{}).First(&urlShortener, "api_key IN (SELECT api_key FROM users) AND deleted_at IS NULL")
 	if result.Error != nil {
 		t.Fatalf("Error ")
 	}
 
 	r := mux.NewRouter()
-	r.HandleFunc("/redirect", handlers.DeleteShortenHandler).Methods("DELETE")
+	r.Handle("/redirect", middleware.RequireScope(models.ScopeLinksDelete)(http.HandlerFunc(handlers.DeleteShortenHandler))).Methods("DELETE")
 
 	redirectURL := "/redirect?code=" + urlShortener.ShortCode
 	req := httptest.NewRequest(http.MethodDelete, redirectURL, nil)
@@ -362,8 +380,13 @@ func TestInvalidUrl(t *testing.T) {
 	if err := config.InitDB(); err != nil {
 		t.Fatalf("Failed to initialize database: %v", err)
 	}
+	testCache, err := cache.NewBigCacheStore()
+	if err != nil {
+		t.Fatalf("failed to initialize cache: %v", err)
+	}
+	handlers.URLCache = testCache
 	r := mux.NewRouter()
-	r.HandleFunc("/shorten", handlers.ShortenHandler).Methods("POST")
+	r.Handle("/shorten", middleware.RequireScope(models.ScopeLinksCreate)(http.HandlerFunc(handlers.ShortenHandler))).Methods("POST")
 	shortenReqPayload := map[string]string{"long_url": ""}
 	reqBody, _ := json.Marshal(shortenReqPayload)
 	req := httptest.NewRequest(http.MethodPost, "/shorten", bytes.NewBuffer(reqBody))
@@ -382,7 +405,7 @@ func TestPreventUnathorizedDeleteShortCode(t *testing.T) {
 		t.Fatalf("Failed to initialize database: %v", err)
 	}
 	r := mux.NewRouter()
-	r.HandleFunc("/redirect", handlers.DeleteShortenHandler).Methods("DELETE")
+	r.Handle("/redirect", middleware.RequireScope(models.ScopeLinksDelete)(http.HandlerFunc(handlers.DeleteShortenHandler))).Methods("DELETE")
 
 	var urlShortener models.URLShortener
 	result := config.DB.Model(&models.URLShortener{}).First(&urlShortener, "api_key IS NOT NULL")
@@ -396,8 +419,8 @@ func TestPreventUnathorizedDeleteShortCode(t *testing.T) {
 
 	r.ServeHTTP(resp, req)
 
-	if resp.Code != http.StatusNotFound {
-		t.Fatalf("Expected status code 404, got %d", resp.Code)
+	if resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status code 401, got %d", resp.Code)
 	}
 
 }
@@ -431,6 +454,11 @@ func TestCustomCodeExists(t *testing.T) {
 	if err := config.InitDB(); err != nil {
 		t.Fatalf("Failed to initialize database: %v", err)
 	}
+	testCache, err := cache.NewBigCacheStore()
+	if err != nil {
+		t.Fatalf("failed to initialize cache: %v", err)
+	}
+	handlers.URLCache = testCache
 	randomUrl := "http://www." + utils.GenerateShortCode(7) + ".com/" + utils.GenerateShortCode(4)
 	var urlShortner models.URLShortener
 	result := config.DB.Model(&models.URLShortener{}).First(&urlShortner, "deleted_at IS NULL")
@@ -439,7 +467,7 @@ func TestCustomCodeExists(t *testing.T) {
 	}
 	fmt.Printf("short code %s", urlShortner.ShortCode)
 	r := mux.NewRouter()
-	r.HandleFunc("/shorten", handlers.ShortenHandler).Methods("POST")
+	r.Handle("/shorten", middleware.RequireScope(models.ScopeLinksCreate)(http.HandlerFunc(handlers.ShortenHandler))).Methods("POST")
 
 	shortenReqPayload := map[string]string{"long_url": randomUrl, "custom_code": urlShortner.ShortCode}
 	reqBody, _ := json.Marshal(shortenReqPayload)
@@ -463,11 +491,11 @@ func TestBulkShorten(t *testing.T) {
 	}
 
 	r := mux.NewRouter()
-	r.HandleFunc("/shorten-bulk", handlers.ShortenBulkHandler).Methods("POST")
+	r.Handle("/shorten-bulk", middleware.RequireScope(models.ScopeLinksCreate)(middleware.IsEnterprise(http.HandlerFunc(handlers.ShortenBulkHandler)))).Methods("POST")
 	jsonPayload := `{
     "urls": [
         {
-            "long_url": "https://example.com",
+            "long_url": "https://example.org",
             "expired_at": "2025-02-10T13:06:30.521Z",
             "custom_code": "example1"
         },
@@ -513,11 +541,11 @@ func TestPreventUnauthorisedBulkShorten(t *testing.T) {
 	}
 
 	r := mux.NewRouter()
-	r.HandleFunc("/shorten-bulk", handlers.ShortenBulkHandler).Methods("POST")
+	r.Handle("/shorten-bulk", middleware.RequireScope(models.ScopeLinksCreate)(middleware.IsEnterprise(http.HandlerFunc(handlers.ShortenBulkHandler)))).Methods("POST")
 	jsonPayload := `{
     "urls": [
         {
-            "long_url": "https://example.com",
+            "long_url": "https://example.org",
             "expired_at": "2025-02-10T13:06:30.521Z",
             "custom_code": "example1"
         },
@@ -567,14 +595,14 @@ func TestRedirectExpiry(t *testing.T) {
 	yesterdayISO := yesterday.Format(time.RFC3339)
 
 	var urlShortner models.URLShortener
-	config.DB.Model(&models.URLShortener{}).First(&urlShortner, "expired_at is null and api_key is not null and deleted_at is null")
+	config.DB.Model(&models.URLShortener{}).First(&urlShortner, "expired_at is null and api_key in (select api_key from users) and deleted_at is null")
 	fmt.Printf("date : %s\n", urlShortner.ApiKey)
 	fmt.Printf("date : %s\n", urlShortner.ShortCode)
 	fmt.Printf("date : %s\n", urlShortner.OriginalURL)
 	fmt.Printf("date : %s\n", yesterdayISO)
 
 	r := mux.NewRouter()
-	r.HandleFunc("/redirect", handlers.EditRedirectExpiryHandler).Methods("PATCH")
+	r.Handle("/redirect", middleware.RequireScope(models.ScopeLinksWrite)(http.HandlerFunc(handlers.EditRedirectExpiryHandler))).Methods("PATCH")
 	redirectURL := "/redirect?code=" + urlShortner.ShortCode
 	ReqPayload := map[string]string{"expired_at": yesterdayISO}
 	reqBody, _ := json.Marshal(ReqPayload)
@@ -623,7 +651,7 @@ func TestGetUserUrls(t *testing.T) {
 		t.Fatalf("Failed to initialize database: %v", err)
 	}
 	r := mux.NewRouter()
-	r.HandleFunc("/users/url", handlers.GetUserUrlsHandler).Methods("GET")
+	r.Handle("/users/url", middleware.RequireScope(models.ScopeLinksRead)(http.HandlerFunc(handlers.GetUserUrlsHandler))).Methods("GET")
 	req := httptest.NewRequest(http.MethodGet, "/users/url", nil)
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("api_key", "234786100")
@@ -638,22 +666,1469 @@ func TestGetUserUrls(t *testing.T) {
 
 }
 
-func TestEnqueueHandler(t *testing.T) {
-	// Empty queue
-	for len(queue.TaskQueue) > 0 {
-		<-queue.TaskQueue
+func TestShortLinkBrowserRedirect(t *testing.T) {
+	if err := config.InitDB(); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	testCache, err := cache.NewBigCacheStore()
+	if err != nil {
+		t.Fatalf("failed to initialize cache: %v", err)
+	}
+	handlers.URLCache = testCache
+
+	var user models.User
+	if result := config.DB.Model(&models.User{}).First(&user, "api_key = ?", "234786100"); result.Error != nil {
+		t.Fatal("DB error")
+	}
+	urlShortener := models.URLShortener{
+		OriginalURL: "https://example.org/browser",
+		ShortCode:   utils.GenerateShortCode(8),
+		ApiKey:      user.ApiKey,
+		UserID:      user.ID,
+	}
+	if result := config.DB.Create(&urlShortener); result.Error != nil {
+		t.Fatalf("failed to create short code: %v", result.Error)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/{code:[A-Za-z0-9_-]+}", handlers.RedirectHandler).Methods("GET")
+
+	req := httptest.NewRequest(http.MethodGet, "/"+urlShortener.ShortCode, nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	if resp.Code != http.StatusFound {
+		t.Fatalf("Expected status code 302, got %d", resp.Code)
+	}
+	if location := resp.Header().Get("Location"); location != urlShortener.OriginalURL {
+		t.Fatalf("Expected Location %s, got %s", urlShortener.OriginalURL, location)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/"+urlShortener.ShortCode, nil)
+	req.Header.Set("Accept", "application/json")
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d", resp.Code)
+	}
+	var redirectResp map[string]string
+	if err := json.Unmarshal(resp.Body.Bytes(), &redirectResp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if redirectResp["long_url"] != urlShortener.OriginalURL {
+		t.Fatalf("Expected long URL %s, got %s", urlShortener.OriginalURL, redirectResp["long_url"])
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/"+utils.GenerateShortCode(9), nil)
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	if resp.Code != http.StatusNotFound {
+		t.Fatalf("Expected status code 404, got %d", resp.Code)
+	}
+	if contentType := resp.Header().Get("Content-Type"); contentType != "text/html; charset=utf-8" {
+		t.Fatalf("Expected an HTML page, got %s", contentType)
+	}
+}
+
+func TestRedirectTypes(t *testing.T) {
+	if err := config.InitDB(); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	testCache, err := cache.NewBigCacheStore()
+	if err != nil {
+		t.Fatalf("failed to initialize cache: %v", err)
+	}
+	handlers.URLCache = testCache
+
+	r := mux.NewRouter()
+	r.Handle("/shorten", middleware.AuthenticateAPIKey(http.HandlerFunc(handlers.ShortenHandler))).Methods("POST")
+	r.Handle("/redirect", middleware.RequireScope(models.ScopeLinksWrite)(http.HandlerFunc(handlers.EditRedirectExpiryHandler))).Methods("PATCH")
+	r.HandleFunc("/{code:[A-Za-z0-9_-]+}", handlers.RedirectHandler).Methods("GET")
+
+	tests := []struct {
+		redirectType string
+		status       int
+	}{
+		{models.RedirectMovedPermanently, http.StatusMovedPermanently},
+		{models.RedirectFound, http.StatusFound},
+		{models.RedirectTemporary, http.StatusTemporaryRedirect},
+		{models.RedirectPermanent, http.StatusPermanentRedirect},
+		{models.RedirectMetaRefresh, http.StatusOK},
+		{models.RedirectJavaScript, http.StatusOK},
+	}
+	for _, tt := range tests {
+		reqBody, _ := json.Marshal(map[string]string{"long_url": "https://example.org/" + tt.redirectType, "redirect_type": tt.redirectType})
+		req := httptest.NewRequest(http.MethodPost, "/shorten", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("api_key", "234786100")
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", resp.Code)
+		}
+		var shortenResp map[string]string
+		if err := json.Unmarshal(resp.Body.Bytes(), &shortenResp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+
+		// First request is served from the DB, second from the cache.
+		for _, cacheStatus := range []string{"MISS", "HIT"} {
+			req = httptest.NewRequest(http.MethodGet, "/"+shortenResp["short_code"], nil)
+			resp = httptest.NewRecorder()
+			r.ServeHTTP(resp, req)
+			if resp.Code != tt.status {
+				t.Fatalf("%s (%s): expected status code %d, got %d", tt.redirectType, cacheStatus, tt.status, resp.Code)
+			}
+			if resp.Header().Get("X-Cache") != cacheStatus {
+				t.Fatalf("%s: expected X-Cache %s, got %s", tt.redirectType, cacheStatus, resp.Header().Get("X-Cache"))
+			}
+		}
+	}
+
+	reqBody, _ := json.Marshal(map[string]string{"long_url": "https://example.org", "redirect_type": "303"})
+	req := httptest.NewRequest(http.MethodPost, "/shorten", bytes.NewBuffer(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("api_key", "234786100")
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status code 400, got %d", resp.Code)
+	}
+
+	// Links stored before destinations were validated never reach a page
+	// redirect with a scheme other than http(s), and cannot be switched to one.
+	caller, err := middleware.ResolveAPIKey(context.Background(), "234786100")
+	if err != nil {
+		t.Fatalf("Failed to resolve the test key: %v", err)
+	}
+	for _, redirectType := range []string{models.RedirectJavaScript, models.RedirectFound} {
+		legacy := models.URLShortener{OriginalURL: "javascript:alert(document.domain)", ShortCode: utils.GenerateShortCode(8), UserID: caller.User.ID, RedirectType: redirectType}
+		if err := config.DB.Create(&legacy).Error; err != nil {
+			t.Fatalf("failed to create short code: %v", err)
+		}
+		if redirectType == models.RedirectJavaScript {
+			req = httptest.NewRequest(http.MethodGet, "/"+legacy.ShortCode, nil)
+			resp = httptest.NewRecorder()
+			r.ServeHTTP(resp, req)
+			if resp.Code != http.StatusNotFound || strings.Contains(resp.Body.String(), "alert") {
+				t.Fatalf("Expected a javascript: link to get 404 without the URL, got %d: %s", resp.Code, resp.Body.String())
+			}
+			continue
+		}
+		reqBody, _ = json.Marshal(map[string]string{"redirect_type": models.RedirectMetaRefresh})
+		req = httptest.NewRequest(http.MethodPatch, "/redirect?code="+legacy.ShortCode, bytes.NewBuffer(reqBody))
+		req.Header.Set("api_key", "234786100")
+		resp = httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		if resp.Code != http.StatusBadRequest {
+			t.Fatalf("Expected switching a javascript: link to meta_refresh to get 400, got %d: %s", resp.Code, resp.Body.String())
+		}
+	}
+}
+
+func TestLinkStats(t *testing.T) {
+	if err := config.InitDB(); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	testCache, err := cache.NewBigCacheStore()
+	if err != nil {
+		t.Fatalf("failed to initialize cache: %v", err)
+	}
+	handlers.URLCache = testCache
+
+	var user models.User
+	if result := config.DB.Model(&models.User{}).First(&user, "api_key = ?", "234786100"); result.Error != nil {
+		t.Fatal("DB error")
+	}
+	urlShortener := models.URLShortener{
+		OriginalURL: "https://example.org/stats",
+		ShortCode:   utils.GenerateShortCode(8),
+		ApiKey:      user.ApiKey,
+		UserID:      user.ID,
+	}
+	if result := config.DB.Create(&urlShortener); result.Error != nil {
+		t.Fatalf("failed to create short code: %v", result.Error)
+	}
+
+	r := mux.NewRouter()
+	r.Handle("/links/{code}/stats", middleware.AuthenticateAPIKey(http.HandlerFunc(handlers.LinkStatsHandler))).Methods("GET")
+	r.HandleFunc("/{code:[A-Za-z0-9_-]+}", handlers.RedirectHandler).Methods("GET")
+
+	userAgents := []string{
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+	}
+	for _, userAgent := range userAgents {
+		req := httptest.NewRequest(http.MethodGet, "/"+urlShortener.ShortCode, nil)
+		req.Header.Set("User-Agent", userAgent)
+		req.Header.Set("Referer", "https://news.example.org/")
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		if resp.Code != http.StatusFound {
+			t.Fatalf("Expected status code 302, got %d", resp.Code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/links/"+urlShortener.ShortCode+"/stats?interval=hour", nil)
+	req.Header.Set("api_key", user.ApiKey)
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d", resp.Code)
+	}
+	var stats struct {
+		TotalClicks int `json:"total_clicks"`
+		TimeSeries  []struct {
+			Clicks int `json:"clicks"`
+		} `json:"time_series"`
+		TopReferrers []struct {
+			Value  string `json:"value"`
+			Clicks int    `json:"clicks"`
+		} `json:"top_referrers"`
+		Devices []struct {
+			Value  string `json:"value"`
+			Clicks int    `json:"clicks"`
+		} `json:"devices"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if stats.TotalClicks != 3 {
+		t.Fatalf("Expected 3 clicks, got %d", stats.TotalClicks)
+	}
+	seriesClicks := 0
+	for _, bucket := range stats.TimeSeries {
+		seriesClicks += bucket.Clicks
+	}
+	if seriesClicks != 3 {
+		t.Fatalf("Expected 3 clicks in the time series, got %d", seriesClicks)
+	}
+	if len(stats.TopReferrers) != 1 || stats.TopReferrers[0].Clicks != 3 {
+		t.Fatalf("Unexpected referrers: %+v", stats.TopReferrers)
+	}
+	if len(stats.Devices) != 2 || stats.Devices[0].Value != "desktop" || stats.Devices[0].Clicks != 2 {
+		t.Fatalf("Unexpected devices: %+v", stats.Devices)
+	}
+
+	// Stats are only visible to the owner of the link.
+	req = httptest.NewRequest(http.MethodGet, "/links/"+urlShortener.ShortCode+"/stats", nil)
+	req.Header.Set("api_key", "test12345")
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	if resp.Code != http.StatusNotFound {
+		t.Fatalf("Expected status code 404, got %d", resp.Code)
+	}
+
+	// Links created under a legacy key, without a user, belong to that key.
+	legacy := models.URLShortener{OriginalURL: "https://example.org/legacy-stats", ShortCode: utils.GenerateShortCode(8), ApiKey: "234786100"}
+	if result := config.DB.Create(&legacy); result.Error != nil {
+		t.Fatalf("failed to create short code: %v", result.Error)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/links/"+legacy.ShortCode+"/stats", nil)
+	req.Header.Set("api_key", "234786100")
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected the legacy key's link to have stats, got %d: %s", resp.Code, resp.Body.String())
+	}
+}
+
+// queuedCodes hands out a fixed list of codes, to force collisions.
+type queuedCodes struct{ codes []string }
+
+func (q *queuedCodes) Generate(length int) (string, error) {
+	code := q.codes[0]
+	q.codes = q.codes[1:]
+	return code, nil
+}
+
+func TestShortenRetriesOnCollision(t *testing.T) {
+	if err := config.InitDB(); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	testCache, err := cache.NewBigCacheStore()
+	if err != nil {
+		t.Fatalf("failed to initialize cache: %v", err)
+	}
+	handlers.URLCache = testCache
+	var existing models.URLShortener
+	if result := config.DB.Model(&models.URLShortener{}).First(&existing); result.Error != nil {
+		t.Fatal("DB error")
+	}
+	freeCode := utils.GenerateShortCode(10)
+	defaultGenerator := handlers.CodeGenerator
+	handlers.CodeGenerator = &queuedCodes{codes: []string{existing.ShortCode, freeCode}}
+	defer func() { handlers.CodeGenerator = defaultGenerator }()
+
+	r := mux.NewRouter()
+	r.Handle("/shorten", middleware.AuthenticateAPIKey(http.HandlerFunc(handlers.ShortenHandler))).Methods("POST")
+
+	reqBody, _ := json.Marshal(map[string]string{"long_url": "https://example.org/collision"})
+	req := httptest.NewRequest(http.MethodPost, "/shorten", bytes.NewBuffer(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("api_key", "234786100")
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d: %s", resp.Code, resp.Body.String())
+	}
+	var shortenResp map[string]string
+	if err := json.Unmarshal(resp.Body.Bytes(), &shortenResp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if shortenResp["short_code"] != freeCode {
+		t.Fatalf("Expected the retried code %s, got %s", freeCode, shortenResp["short_code"])
+	}
+}
+
+func TestShortenValidatesURL(t *testing.T) {
+	if err := config.InitDB(); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	testCache, err := cache.NewBigCacheStore()
+	if err != nil {
+		t.Fatalf("failed to initialize cache: %v", err)
+	}
+	handlers.URLCache = testCache
+	r := mux.NewRouter()
+	r.Handle("/shorten", middleware.AuthenticateAPIKey(http.HandlerFunc(handlers.ShortenHandler))).Methods("POST")
+
+	reqBody, _ := json.Marshal(map[string]string{"long_url": "javascript:alert(1)", "redirect_type": "303"})
+	req := httptest.NewRequest(http.MethodPost, "/shorten", bytes.NewBuffer(reqBody))
+	req.Header.Set("api_key", "234786100")
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status code 400, got %d", resp.Code)
+	}
+	var errorResp struct {
+		Fields []utils.FieldError `json:"fields"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &errorResp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(errorResp.Fields) != 2 || errorResp.Fields[0].Field != "long_url" || errorResp.Fields[1].Field != "redirect_type" {
+		t.Fatalf("Expected long_url and redirect_type errors, got %+v", errorResp.Fields)
+	}
+
+	// The host the request was sent to is the shortener's own, whether or
+	// not it is listed in SHORT_DOMAINS.
+	for _, host := range []string{"sho.rt", "sho.rt:8080"} {
+		reqBody, _ = json.Marshal(map[string]string{"long_url": "https://SHO.RT/abc"})
+		req = httptest.NewRequest(http.MethodPost, "/shorten", bytes.NewBuffer(reqBody))
+		req.Host = host
+		req.Header.Set("api_key", "234786100")
+		resp = httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		if resp.Code != http.StatusBadRequest || !strings.Contains(resp.Body.String(), "self_referencing") {
+			t.Fatalf("Expected a link to %s to be refused, got %d: %s", host, resp.Code, resp.Body.String())
+		}
+	}
+
+	reqBody, _ = json.Marshal(map[string]string{"long_url": "HTTPS://Example.org:443/%7Edocs"})
+	req = httptest.NewRequest(http.MethodPost, "/shorten", bytes.NewBuffer(reqBody))
+	req.Header.Set("api_key", "234786100")
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d", resp.Code)
+	}
+	var shortenResp map[string]string
+	if err := json.Unmarshal(resp.Body.Bytes(), &shortenResp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	var urlShortener models.URLShortener
+	if result := config.DB.First(&urlShortener, "short_code = ?", shortenResp["short_code"]); result.Error != nil {
+		t.Fatalf("failed to load short code: %v", result.Error)
 	}
+	if urlShortener.OriginalURL != "https://example.org/~docs" {
+		t.Fatalf("Expected the normalized URL to be stored, got %s", urlShortener.OriginalURL)
+	}
+}
 
-	req := httptest.NewRequest("GET", "/enqueue", nil)
-	w := httptest.NewRecorder()
+func TestReservedCustomCodes(t *testing.T) {
+	if err := config.InitDB(); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	testCache, err := cache.NewBigCacheStore()
+	if err != nil {
+		t.Fatalf("failed to initialize cache: %v", err)
+	}
+	handlers.URLCache = testCache
+	r := mux.NewRouter()
+	r.Handle("/shorten", middleware.RequireScope(models.ScopeLinksCreate)(http.HandlerFunc(handlers.ShortenHandler))).Methods("POST")
 
-	handlers.EnqueueHandler(w, req)
+	// Every route registered in main would shadow a short code of its
+	// first path segment.
+	source, err := os.ReadFile("main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments := map[string]bool{}
+	for _, match := range regexp.MustCompile(`r\.Handle(?:Func)?\("/([A-Za-z0-9_-]+)`).FindAllStringSubmatch(string(source), -1) {
+		segments[match[1]] = true
+	}
+	if len(segments) < 10 {
+		t.Fatalf("Expected to find the routes of main.go, got %v", segments)
+	}
+	for segment := range segments {
+		reqBody, _ := json.Marshal(map[string]string{"long_url": "https://example.org/reserved", "custom_code": segment})
+		req := httptest.NewRequest(http.MethodPost, "/shorten", bytes.NewBuffer(reqBody))
+		req.Header.Set("api_key", "234786100")
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		var errorResp struct {
+			Fields []utils.FieldError `json:"fields"`
+		}
+		json.Unmarshal(resp.Body.Bytes(), &errorResp)
+		if resp.Code != http.StatusBadRequest || len(errorResp.Fields) != 1 || errorResp.Fields[0].Code != "reserved" {
+			t.Errorf("Expected custom code %q to be reserved, got %d: %s", segment, resp.Code, resp.Body.String())
+		}
+	}
+}
 
-	if w.Result().StatusCode != http.StatusAccepted {
-		t.Errorf("expected status %d, got %d", http.StatusAccepted, w.Result().StatusCode)
+// Rate limit rules are looked up by route name, so two routes sharing a
+// name would share a rule and its buckets.
+func TestRouteNamesAreUnique(t *testing.T) {
+	source, err := os.ReadFile("main.go")
+	if err != nil {
+		t.Fatal(err)
 	}
+	seen := map[string]bool{}
+	for _, match := range regexp.MustCompile(`\.Name\("([^"]+)"\)`).FindAllStringSubmatch(string(source), -1) {
+		if seen[match[1]] {
+			t.Errorf("Route name %q is used more than once", match[1])
+		}
+		seen[match[1]] = true
+	}
+	if len(seen) < 10 {
+		t.Fatalf("Expected to find the route names of main.go, got %v", seen)
+	}
+}
 
-	if len(queue.TaskQueue) != 1 {
-		t.Errorf("expected 1 task in queue, got %d", len(queue.TaskQueue))
+func TestHashedLinkPassword(t *testing.T) {
+	if err := config.InitDB(); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	testCache, err := cache.NewBigCacheStore()
+	if err != nil {
+		t.Fatalf("failed to initialize cache: %v", err)
+	}
+	handlers.URLCache = testCache
+
+	r := mux.NewRouter()
+	r.Handle("/shorten", middleware.AuthenticateAPIKey(http.HandlerFunc(handlers.ShortenHandler))).Methods("POST")
+	r.Handle("/users/url", middleware.RequireScope(models.ScopeLinksRead)(http.HandlerFunc(handlers.GetUserUrlsHandler))).Methods("GET")
+	r.HandleFunc("/{code:[A-Za-z0-9_-]+}", handlers.RedirectHandler).Methods("GET")
+
+	reqBody, _ := json.Marshal(map[string]string{"long_url": "https://example.org/secret", "password": "s3cret"})
+	req := httptest.NewRequest(http.MethodPost, "/shorten", bytes.NewBuffer(reqBody))
+	req.Header.Set("api_key", "234786100")
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d", resp.Code)
+	}
+	var shortenResp map[string]string
+	if err := json.Unmarshal(resp.Body.Bytes(), &shortenResp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	shortCode := shortenResp["short_code"]
+
+	var urlShortener models.URLShortener
+	if result := config.DB.First(&urlShortener, "short_code = ?", shortCode); result.Error != nil {
+		t.Fatalf("failed to load short code: %v", result.Error)
+	}
+	if urlShortener.Password == nil || !models.IsPasswordHash(*urlShortener.Password) {
+		t.Fatalf("Expected a bcrypt hash to be stored, got %v", urlShortener.Password)
+	}
+
+	// The second and third requests are served from the cache.
+	for _, tt := range []struct {
+		password string
+		status   int
+	}{{"wrong", http.StatusUnauthorized}, {"s3cret", http.StatusOK}, {"", http.StatusUnauthorized}} {
+		req = httptest.NewRequest(http.MethodGet, "/"+shortCode+"?password="+tt.password, nil)
+		req.Header.Set("Accept", "application/json")
+		resp = httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		if resp.Code != tt.status {
+			t.Fatalf("password %q: expected status code %d, got %d", tt.password, tt.status, resp.Code)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/users/url?limit=1000", nil)
+	req.Header.Set("api_key", "234786100")
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	if strings.Contains(resp.Body.String(), *urlShortener.Password) || strings.Contains(resp.Body.String(), `"password"`) {
+		t.Fatal("Expected the URL listing not to expose passwords")
+	}
+}
+
+func TestRehashPlaintextPasswords(t *testing.T) {
+	if err := config.InitDB(); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	var user models.User
+	if result := config.DB.Model(&models.User{}).First(&user, "api_key = ?", "234786100"); result.Error != nil {
+		t.Fatal("DB error")
+	}
+	plaintext := "legacy-password"
+	urlShortener := models.URLShortener{
+		OriginalURL: "https://example.org/legacy",
+		ShortCode:   utils.GenerateShortCode(8),
+		ApiKey:      user.ApiKey,
+		UserID:      user.ID,
+		Password:    &plaintext,
+	}
+	if result := config.DB.Create(&urlShortener); result.Error != nil {
+		t.Fatalf("failed to create short code: %v", result.Error)
+	}
+	// bcrypt cannot hash this one; it must not stop the others.
+	tooLong := strings.Repeat("x", models.MaxPasswordLength+1)
+	longLink := urlShortener
+	longLink.ID, longLink.ShortCode, longLink.Password = 0, utils.GenerateShortCode(8), &tooLong
+	if result := config.DB.Create(&longLink); result.Error != nil {
+		t.Fatalf("failed to create short code: %v", result.Error)
+	}
+
+	rehashed, err := config.RehashPlaintextPasswords()
+	if err != nil {
+		t.Fatalf("failed to rehash passwords: %v", err)
+	}
+	if !slices.Contains(rehashed, urlShortener.ShortCode) || slices.Contains(rehashed, longLink.ShortCode) {
+		t.Fatalf("Expected only %s to be rehashed, got %v", urlShortener.ShortCode, rehashed)
+	}
+	var stored models.URLShortener
+	config.DB.First(&stored, urlShortener.ID)
+	if stored.Password == nil || !models.IsPasswordHash(*stored.Password) || !stored.CheckPassword(plaintext) {
+		t.Fatalf("Expected a bcrypt hash of the old password, got %v", stored.Password)
+	}
+	var storedLong models.URLShortener
+	config.DB.First(&storedLong, longLink.ID)
+	if storedLong.Password == nil || !storedLong.CheckPassword(tooLong) {
+		t.Fatalf("Expected the long password to keep working, got %v", storedLong.Password)
+	}
+}
+
+func TestPasswordUnlockCookie(t *testing.T) {
+	if err := config.InitDB(); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	testCache, err := cache.NewBigCacheStore()
+	if err != nil {
+		t.Fatalf("failed to initialize cache: %v", err)
+	}
+	handlers.URLCache = testCache
+
+	var user models.User
+	if result := config.DB.Model(&models.User{}).First(&user, "api_key = ?", "234786100"); result.Error != nil {
+		t.Fatal("DB error")
+	}
+	hash, err := models.HashPassword("open sesame")
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	urlShortener := models.URLShortener{
+		OriginalURL: "https://example.org/unlocked",
+		ShortCode:   utils.GenerateShortCode(8),
+		ApiKey:      user.ApiKey,
+		UserID:      user.ID,
+		Password:    &hash,
+	}
+	if result := config.DB.Create(&urlShortener); result.Error != nil {
+		t.Fatalf("failed to create short code: %v", result.Error)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/{code:[A-Za-z0-9_-]+}", handlers.RedirectHandler).Methods("GET")
+	r.HandleFunc("/{code:[A-Za-z0-9_-]+}/unlock", handlers.UnlockHandler).Methods("POST")
+	path := "/" + urlShortener.ShortCode
+
+	// Browsers get the form, even when they pass the password in the URL.
+	req := httptest.NewRequest(http.MethodGet, path+"?password=open+sesame", nil)
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	if resp.Code != http.StatusUnauthorized || !strings.Contains(resp.Body.String(), `action="`+path+`/unlock"`) {
+		t.Fatalf("Expected the password form, got %d: %s", resp.Code, resp.Body.String())
+	}
+
+	unlock := func(password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path+"/unlock", strings.NewReader("password="+password))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		return resp
+	}
+	if resp = unlock("wrong"); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status code 401 for a wrong password, got %d", resp.Code)
+	}
+	resp = unlock("open+sesame")
+	if resp.Code != http.StatusSeeOther || resp.Header().Get("Location") != path {
+		t.Fatalf("Expected a 303 back to %s, got %d %s", path, resp.Code, resp.Header().Get("Location"))
+	}
+	cookies := resp.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Path != path || !cookies[0].HttpOnly {
+		t.Fatalf("Expected one HttpOnly unlock cookie scoped to %s, got %+v", path, cookies)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, path, nil)
+	req.AddCookie(cookies[0])
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	if resp.Code != http.StatusFound || resp.Header().Get("Location") != urlShortener.OriginalURL {
+		t.Fatalf("Expected the unlocked link to redirect, got %d", resp.Code)
+	}
+
+	tampered := *cookies[0]
+	tampered.Value = strings.Replace(tampered.Value, ".", "0.", 1)
+	req = httptest.NewRequest(http.MethodGet, path, nil)
+	req.AddCookie(&tampered)
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	if resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a tampered cookie to be rejected, got %d", resp.Code)
+	}
+}
+
+func TestLinkHistoryAndRollback(t *testing.T) {
+	if err := config.InitDB(); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	testCache, err := cache.NewBigCacheStore()
+	if err != nil {
+		t.Fatalf("failed to initialize cache: %v", err)
+	}
+	handlers.URLCache = testCache
+
+	r := mux.NewRouter()
+	r.Handle("/shorten", middleware.AuthenticateAPIKey(http.HandlerFunc(handlers.ShortenHandler))).Methods("POST")
+	r.Handle("/redirect", middleware.RequireScope(models.ScopeLinksWrite)(http.HandlerFunc(handlers.EditRedirectExpiryHandler))).Methods("PATCH")
+	r.Handle("/links/{code}/history", middleware.AuthenticateAPIKey(http.HandlerFunc(handlers.LinkHistoryHandler))).Methods("GET")
+	r.Handle("/links/{code}/rollback", middleware.AuthenticateAPIKey(http.HandlerFunc(handlers.LinkRollbackHandler))).Methods("POST")
+	r.HandleFunc("/{code:[A-Za-z0-9_-]+}", handlers.RedirectHandler).Methods("GET")
+
+	send := func(method, target string, body interface{}) *httptest.ResponseRecorder {
+		reqBody, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, target, bytes.NewBuffer(reqBody))
+		req.Header.Set("api_key", "234786100")
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		return resp
+	}
+	location := func(shortCode string) string {
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/"+shortCode, nil))
+		return resp.Header().Get("Location")
+	}
+
+	resp := send(http.MethodPost, "/shorten", map[string]string{"long_url": "https://example.org/v1"})
+	var shortenResp map[string]string
+	if err := json.Unmarshal(resp.Body.Bytes(), &shortenResp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	shortCode := shortenResp["short_code"]
+	if got := location(shortCode); got != "https://example.org/v1" {
+		t.Fatalf("Expected a redirect to v1, got %s", got)
+	}
+
+	resp = send(http.MethodPatch, "/redirect?code="+shortCode, map[string]string{"long_url": "https://example.org/v2", "redirect_type": "307"})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d", resp.Code)
+	}
+	if got := location(shortCode); got != "https://example.org/v2" {
+		t.Fatalf("Expected the cached link to redirect to v2, got %s", got)
+	}
+	caller, err := middleware.ResolveAPIKey(context.Background(), "234786100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var edit models.LinkRevision
+	config.DB.Where("short_code = ?", shortCode).Order("revision DESC").First(&edit)
+	if edit.UserID != caller.User.ID {
+		t.Fatalf("Expected the edit to be recorded as made by user %d, got %d", caller.User.ID, edit.UserID)
+	}
+	// httptest requests are sent to example.com.
+	resp = send(http.MethodPatch, "/redirect?code="+shortCode, map[string]string{"long_url": "https://example.com/" + shortCode})
+	if resp.Code != http.StatusBadRequest || !strings.Contains(resp.Body.String(), "self_referencing") {
+		t.Fatalf("Expected an edit pointing at the shortener to get 400, got %d: %s", resp.Code, resp.Body.String())
+	}
+
+	resp = send(http.MethodPost, "/links/"+shortCode+"/rollback", map[string]uint{"revision": 1})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d", resp.Code)
+	}
+	if got := location(shortCode); got != "https://example.org/v1" {
+		t.Fatalf("Expected the rolled back link to redirect to v1, got %s", got)
+	}
+
+	resp = send(http.MethodGet, "/links/"+shortCode+"/history", nil)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d", resp.Code)
+	}
+	var history struct {
+		Revisions []struct {
+			Revision   uint                                      `json:"revision"`
+			Action     string                                    `json:"action"`
+			RollbackOf uint                                      `json:"rollback_of"`
+			Changes    map[string]struct{ Old, New interface{} } `json:"changes"`
+		} `json:"revisions"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &history); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(history.Revisions) != 3 {
+		t.Fatalf("Expected 3 revisions, got %+v", history.Revisions)
+	}
+	update := history.Revisions[1]
+	if update.Action != models.RevisionUpdate || update.Changes["long_url"].New != "https://example.org/v2" || update.Changes["redirect_type"].Old != "302" {
+		t.Fatalf("Unexpected update revision %+v", update)
+	}
+	rollback := history.Revisions[2]
+	if rollback.Action != models.RevisionRollback || rollback.RollbackOf != 1 || rollback.Changes["long_url"].New != "https://example.org/v1" {
+		t.Fatalf("Unexpected rollback revision %+v", rollback)
+	}
+
+	// Links created under a legacy key, without a user, belong to that key.
+	legacy := models.URLShortener{OriginalURL: "https://example.org/legacy-history", ShortCode: utils.GenerateShortCode(8), ApiKey: "234786100"}
+	if result := config.DB.Create(&legacy); result.Error != nil {
+		t.Fatalf("failed to create short code: %v", result.Error)
+	}
+	if resp := send(http.MethodGet, "/links/"+legacy.ShortCode+"/history", nil); resp.Code != http.StatusOK {
+		t.Fatalf("Expected the legacy key's link to have a history, got %d: %s", resp.Code, resp.Body.String())
+	}
+}
+
+func TestDeletedLinkLeavesCache(t *testing.T) {
+	if err := config.InitDB(); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	testCache, err := cache.NewBigCacheStore()
+	if err != nil {
+		t.Fatalf("failed to initialize cache: %v", err)
+	}
+	handlers.URLCache = testCache
+
+	r := mux.NewRouter()
+	r.Handle("/shorten", middleware.AuthenticateAPIKey(http.HandlerFunc(handlers.ShortenHandler))).Methods("POST")
+	r.Handle("/redirect", middleware.RequireScope(models.ScopeLinksDelete)(http.HandlerFunc(handlers.DeleteShortenHandler))).Methods("DELETE")
+	r.HandleFunc("/{code:[A-Za-z0-9_-]+}", handlers.RedirectHandler).Methods("GET")
+
+	reqBody, _ := json.Marshal(map[string]string{"long_url": "https://example.org/deleted"})
+	req := httptest.NewRequest(http.MethodPost, "/shorten", bytes.NewBuffer(reqBody))
+	req.Header.Set("api_key", "234786100")
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	var shortenResp map[string]string
+	if err := json.Unmarshal(resp.Body.Bytes(), &shortenResp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	shortCode := shortenResp["short_code"]
+
+	redirect := func() *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/"+shortCode, nil))
+		return resp
+	}
+	if resp := redirect(); resp.Code != http.StatusFound {
+		t.Fatalf("Expected status code 302, got %d", resp.Code)
+	}
+	if _, err := testCache.Get(context.Background(), shortCode); err != nil {
+		t.Fatalf("Expected the redirect to cache the link: %v", err)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/redirect?code="+shortCode, nil)
+	req.Header.Set("api_key", "234786100")
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d", resp.Code)
+	}
+	if resp := redirect(); resp.Code != http.StatusNotFound {
+		t.Fatalf("Expected status code 404 after delete, got %d", resp.Code)
+	}
+
+	// Entries cached before the delete reached this instance are ignored too.
+	var deleted models.URLShortener
+	config.DB.Where("short_code = ?", shortCode).First(&deleted)
+	testCache.Set(context.Background(), shortCode, deleted, time.Minute)
+	if resp := redirect(); resp.Code != http.StatusNotFound || resp.Header().Get("X-Cache") != "" {
+		t.Fatalf("Expected a deleted cache entry to give 404, got %d", resp.Code)
+	}
+	if _, err := testCache.Get(context.Background(), shortCode); err == nil {
+		t.Fatalf("Expected the deleted entry to be evicted")
+	}
+
+	// Entries last until the link expires, capped at cache.MaxTTL.
+	now := time.Now()
+	soon := now.Add(time.Minute)
+	if ttl := cache.TTLFor(models.URLShortener{ExpiredAt: &soon}, now); ttl != time.Minute {
+		t.Fatalf("Expected a TTL of 1m, got %s", ttl)
+	}
+	if ttl := cache.TTLFor(models.URLShortener{}, now); ttl != cache.MaxTTL {
+		t.Fatalf("Expected a TTL of %s, got %s", cache.MaxTTL, ttl)
+	}
+}
+
+func TestMissingCodeIsCachedUntilCreated(t *testing.T) {
+	if err := config.InitDB(); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	testCache, err := cache.NewBigCacheStore()
+	if err != nil {
+		t.Fatalf("failed to initialize cache: %v", err)
+	}
+	handlers.URLCache = testCache
+
+	r := mux.NewRouter()
+	r.Handle("/shorten", middleware.AuthenticateAPIKey(http.HandlerFunc(handlers.ShortenHandler))).Methods("POST")
+	r.HandleFunc("/{code:[A-Za-z0-9_-]+}", handlers.RedirectHandler).Methods("GET")
+
+	shortCode := "neg-" + utils.GenerateShortCode(8)
+	redirect := func() *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/"+shortCode, nil))
+		return resp
+	}
+	if resp := redirect(); resp.Code != http.StatusNotFound || resp.Header().Get("X-Cache") != "" {
+		t.Fatalf("Expected an uncached 404, got %d %q", resp.Code, resp.Header().Get("X-Cache"))
+	}
+	if resp := redirect(); resp.Code != http.StatusNotFound || resp.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected a cached 404, got %d %q", resp.Code, resp.Header().Get("X-Cache"))
+	}
+
+	reqBody, _ := json.Marshal(map[string]string{"long_url": "https://example.org/negative", "custom_code": shortCode})
+	req := httptest.NewRequest(http.MethodPost, "/shorten", bytes.NewBuffer(reqBody))
+	req.Header.Set("api_key", "234786100")
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d: %s", resp.Code, resp.Body.String())
+	}
+	if resp := redirect(); resp.Code != http.StatusFound {
+		t.Fatalf("Expected the new code to redirect, got %d", resp.Code)
+	}
+}
+
+func TestSignupAndAPIKeyLifecycle(t *testing.T) {
+	if err := config.InitDB(); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	testCache, err := cache.NewBigCacheStore()
+	if err != nil {
+		t.Fatalf("failed to initialize cache: %v", err)
+	}
+	handlers.URLCache = testCache
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users", handlers.CreateUserHandler).Methods("POST")
+	r.Handle("/users/keys", middleware.AuthenticateAPIKey(http.HandlerFunc(handlers.ListAPIKeysHandler))).Methods("GET")
+	r.Handle("/users/keys/{id:[0-9]+}/rotate", middleware.AuthenticateAPIKey(http.HandlerFunc(handlers.RotateAPIKeyHandler))).Methods("POST")
+	r.Handle("/users/keys/{id:[0-9]+}", middleware.AuthenticateAPIKey(http.HandlerFunc(handlers.RevokeAPIKeyHandler))).Methods("DELETE")
+	r.Handle("/redirect", middleware.RequireScope(models.ScopeLinksDelete)(http.HandlerFunc(handlers.DeleteShortenHandler))).Methods("DELETE")
+	r.Handle("/shorten", middleware.AuthenticateAPIKey(http.HandlerFunc(handlers.ShortenHandler))).Methods("POST")
+
+	do := func(method, path, apiKey string, body interface{}) *httptest.ResponseRecorder {
+		var reqBody bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&reqBody).Encode(body)
+		}
+		req := httptest.NewRequest(method, path, &reqBody)
+		if apiKey != "" {
+			req.Header.Set("api_key", apiKey)
+		}
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		return resp
+	}
+	type issued struct {
+		APIKey string        `json:"api_key"`
+		Key    models.APIKey `json:"key"`
+	}
+
+	email := "signup-" + utils.GenerateShortCode(8) + "@example.com"
+	resp := do("POST", "/users", "", map[string]string{"email": strings.ToUpper(email), "name": "Test"})
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Expected status code 201, got %d: %s", resp.Code, resp.Body.String())
+	}
+	var first issued
+	json.NewDecoder(resp.Body).Decode(&first)
+	if !strings.HasPrefix(first.APIKey, first.Key.Prefix) || len(first.Key.Prefix) >= len(first.APIKey) {
+		t.Fatalf("Expected the key to start with its prefix, got %+v", first)
+	}
+	var stored models.APIKey
+	config.DB.First(&stored, first.Key.ID)
+	if stored.Hash == "" || strings.Contains(stored.Hash, first.APIKey) {
+		t.Fatalf("Expected only a hash of the key to be stored, got %q", stored.Hash)
+	}
+	if resp := do("POST", "/users", "", map[string]string{"email": email}); resp.Code != http.StatusConflict {
+		t.Fatalf("Expected a second signup with the email to conflict, got %d", resp.Code)
+	}
+	if resp := do("POST", "/users", "", map[string]string{"email": "not an email"}); resp.Code != http.StatusBadRequest {
+		t.Fatalf("Expected an invalid email to be rejected, got %d", resp.Code)
+	}
+
+	shortCode := "key-" + utils.GenerateShortCode(8)
+	if resp := do("POST", "/shorten", first.APIKey, map[string]string{"long_url": "https://example.org/keys", "custom_code": shortCode}); resp.Code != http.StatusOK {
+		t.Fatalf("Expected the new key to shorten, got %d: %s", resp.Code, resp.Body.String())
+	}
+
+	// Both keys work during the grace period; a link made with the old key
+	// can be deleted with the new one.
+	resp = do("POST", fmt.Sprintf("/users/keys/%d/rotate", first.Key.ID), first.APIKey, map[string]string{"grace_period": "1h"})
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Expected status code 201, got %d: %s", resp.Code, resp.Body.String())
+	}
+	var second issued
+	json.NewDecoder(resp.Body).Decode(&second)
+	for _, key := range []string{first.APIKey, second.APIKey} {
+		if resp := do("GET", "/users/keys", key, nil); resp.Code != http.StatusOK || strings.Count(resp.Body.String(), `"prefix"`) != 2 {
+			t.Fatalf("Expected both keys to be listed, got %d: %s", resp.Code, resp.Body.String())
+		}
+	}
+	if resp := do("DELETE", "/redirect?code="+shortCode, second.APIKey, nil); resp.Code != http.StatusOK {
+		t.Fatalf("Expected the rotated key's owner to delete the link, got %d", resp.Code)
+	}
+
+	// Revoking ends the old key at once, but the last key cannot go.
+	if resp := do("DELETE", fmt.Sprintf("/users/keys/%d", first.Key.ID), second.APIKey, nil); resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d: %s", resp.Code, resp.Body.String())
+	}
+	if resp := do("GET", "/users/keys", first.APIKey, nil); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the revoked key to be rejected, got %d", resp.Code)
+	}
+	if resp := do("DELETE", fmt.Sprintf("/users/keys/%d", second.Key.ID), second.APIKey, nil); resp.Code != http.StatusConflict {
+		t.Fatalf("Expected revoking the last key to conflict, got %d", resp.Code)
+	}
+}
+
+func TestScopedAPIKeys(t *testing.T) {
+	if err := config.InitDB(); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	testCache, err := cache.NewBigCacheStore()
+	if err != nil {
+		t.Fatalf("failed to initialize cache: %v", err)
+	}
+	handlers.URLCache = testCache
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users", handlers.CreateUserHandler).Methods("POST")
+	r.Handle("/users/keys", middleware.RequireScope(models.ScopeKeysManage)(http.HandlerFunc(handlers.ListAPIKeysHandler))).Methods("GET")
+	r.Handle("/users/keys", middleware.RequireScope(models.ScopeKeysManage)(http.HandlerFunc(handlers.CreateAPIKeyHandler))).Methods("POST")
+	r.Handle("/users/keys/{id:[0-9]+}/rotate", middleware.RequireScope(models.ScopeKeysManage)(http.HandlerFunc(handlers.RotateAPIKeyHandler))).Methods("POST")
+	r.Handle("/users/url", middleware.RequireScope(models.ScopeLinksRead)(http.HandlerFunc(handlers.GetUserUrlsHandler))).Methods("GET")
+	r.Handle("/shorten", middleware.RequireScope(models.ScopeLinksCreate)(http.HandlerFunc(handlers.ShortenHandler))).Methods("POST")
+
+	do := func(method, path, apiKey string, body interface{}) *httptest.ResponseRecorder {
+		var reqBody bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&reqBody).Encode(body)
+		}
+		req := httptest.NewRequest(method, path, &reqBody)
+		if apiKey != "" {
+			req.Header.Set("api_key", apiKey)
+		}
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		return resp
+	}
+	type issued struct {
+		APIKey string        `json:"api_key"`
+		Key    models.APIKey `json:"key"`
+	}
+
+	resp := do("POST", "/users", "", map[string]string{"email": "scopes-" + utils.GenerateShortCode(8) + "@example.com"})
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Expected status code 201, got %d: %s", resp.Code, resp.Body.String())
+	}
+	var owner issued
+	json.NewDecoder(resp.Body).Decode(&owner)
+
+	if resp := do("POST", "/users/keys", owner.APIKey, map[string]interface{}{"scopes": []string{models.ScopeAdmin}}); resp.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a user key to be refused the admin scope, got %d", resp.Code)
+	}
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	resp = do("POST", "/users/keys", owner.APIKey, map[string]interface{}{"name": "dashboard", "scopes": []string{models.ScopeLinksRead}, "expires_at": expiresAt})
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Expected status code 201, got %d: %s", resp.Code, resp.Body.String())
+	}
+	var readOnly issued
+	json.NewDecoder(resp.Body).Decode(&readOnly)
+	if readOnly.Key.Name != "dashboard" || readOnly.Key.ExpiresAt == nil || !readOnly.Key.ExpiresAt.Equal(expiresAt) {
+		t.Fatalf("Expected the name and expiry to be kept, got %+v", readOnly.Key)
+	}
+
+	if resp := do("GET", "/users/url", readOnly.APIKey, nil); resp.Code != http.StatusOK {
+		t.Fatalf("Expected the read-only key to list links, got %d: %s", resp.Code, resp.Body.String())
+	}
+	if resp := do("POST", "/shorten", readOnly.APIKey, map[string]string{"long_url": "https://example.org/scopes"}); resp.Code != http.StatusForbidden {
+		t.Fatalf("Expected the read-only key to be refused shortening, got %d", resp.Code)
+	}
+	if resp := do("GET", "/users/keys", readOnly.APIKey, nil); resp.Code != http.StatusForbidden {
+		t.Fatalf("Expected the read-only key to be refused key management, got %d", resp.Code)
+	}
+	if resp := do("GET", "/users/keys", owner.APIKey, nil); resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), `"last_used_at"`) {
+		t.Fatalf("Expected the keys to be listed with their last use, got %d: %s", resp.Code, resp.Body.String())
+	}
+
+	// A narrow key cannot get a copy of a broader one by rotating it.
+	resp = do("POST", "/users/keys", owner.APIKey, map[string]interface{}{"scopes": []string{models.ScopeKeysManage}})
+	var keysOnly issued
+	json.NewDecoder(resp.Body).Decode(&keysOnly)
+	if resp := do("POST", fmt.Sprintf("/users/keys/%d/rotate", owner.Key.ID), keysOnly.APIKey, nil); resp.Code != http.StatusForbidden {
+		t.Fatalf("Expected rotating a broader key to get 403, got %d: %s", resp.Code, resp.Body.String())
+	}
+	if resp := do("POST", fmt.Sprintf("/users/keys/%d/rotate", readOnly.Key.ID), keysOnly.APIKey, nil); resp.Code != http.StatusForbidden {
+		t.Fatalf("Expected rotating a key with another scope to get 403, got %d", resp.Code)
+	}
+	if resp := do("POST", fmt.Sprintf("/users/keys/%d/rotate", readOnly.Key.ID), owner.APIKey, nil); resp.Code != http.StatusCreated {
+		t.Fatalf("Expected the owner key to rotate a narrower one, got %d: %s", resp.Code, resp.Body.String())
+	}
+
+	// Rotated keys in their grace period count towards the limit.
+	for {
+		resp := do("POST", "/users/keys", owner.APIKey, nil)
+		if resp.Code == http.StatusConflict {
+			break
+		}
+		if resp.Code != http.StatusCreated {
+			t.Fatalf("Expected status code 201, got %d: %s", resp.Code, resp.Body.String())
+		}
+	}
+	if resp := do("POST", fmt.Sprintf("/users/keys/%d/rotate", keysOnly.Key.ID), keysOnly.APIKey, nil); resp.Code != http.StatusConflict {
+		t.Fatalf("Expected a rotation past the key limit to get 409, got %d", resp.Code)
+	}
+	if resp := do("POST", fmt.Sprintf("/users/keys/%d/rotate", keysOnly.Key.ID), keysOnly.APIKey, map[string]string{"grace_period": "0s"}); resp.Code != http.StatusCreated {
+		t.Fatalf("Expected a rotation without grace period to get 201, got %d: %s", resp.Code, resp.Body.String())
+	}
+}
+
+func TestAPIKeyLookupCache(t *testing.T) {
+	if err := config.InitDB(); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defaultKeys := middleware.APIKeys
+	defer func() { middleware.APIKeys = defaultKeys }()
+	middleware.APIKeys = middleware.NewMemoryAPIKeyCache(100)
+
+	r := mux.NewRouter()
+	r.Use(middleware.AuthMiddleware)
+	r.HandleFunc("/users", handlers.CreateUserHandler).Methods("POST")
+	r.Handle("/users/keys", middleware.RequireScope(models.ScopeKeysManage)(http.HandlerFunc(handlers.CreateAPIKeyHandler))).Methods("POST")
+	r.Handle("/users/keys/{id:[0-9]+}", middleware.RequireScope(models.ScopeKeysManage)(http.HandlerFunc(handlers.RevokeAPIKeyHandler))).Methods("DELETE")
+	do := func(method, path, apiKey string, body interface{}) *httptest.ResponseRecorder {
+		var reqBody bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&reqBody).Encode(body)
+		}
+		req := httptest.NewRequest(method, path, &reqBody)
+		if apiKey != "" {
+			req.Header.Set("api_key", apiKey)
+		}
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		return resp
+	}
+	type issued struct {
+		APIKey string        `json:"api_key"`
+		Key    models.APIKey `json:"key"`
+	}
+
+	resp := do("POST", "/users", "", map[string]string{"email": "cache-" + utils.GenerateShortCode(8) + "@example.com"})
+	var first issued
+	json.NewDecoder(resp.Body).Decode(&first)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if _, err := middleware.ResolveAPIKey(ctx, first.APIKey); err != nil {
+			t.Fatalf("Expected the key to resolve, got %v", err)
+		}
+	}
+
+	// Lookups are served from the cache until the key changes.
+	var stored models.APIKey
+	config.DB.First(&stored, first.Key.ID)
+	config.DB.Model(&models.User{}).Where("id = ?", stored.UserID).Update("tier", "enterprise")
+	caller, err := middleware.ResolveAPIKey(ctx, first.APIKey)
+	if err != nil || caller.Tier != middleware.TierHobby || caller.User.ID != stored.UserID {
+		t.Fatalf("Expected the cached hobby caller, got %+v, %v", caller, err)
+	}
+
+	resp = do("POST", "/users/keys", first.APIKey, nil)
+	var second issued
+	json.NewDecoder(resp.Body).Decode(&second)
+	// A lookup that read the key before it was revoked, and caches it after,
+	// must not bring it back.
+	stale, err := config.FindAPIKey(first.APIKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := do("DELETE", fmt.Sprintf("/users/keys/%d", first.Key.ID), second.APIKey, nil); resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d: %s", resp.Code, resp.Body.String())
+	}
+	if err := middleware.APIKeys.Add(ctx, models.HashAPIKey(first.APIKey), stale, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := middleware.ResolveAPIKey(ctx, first.APIKey); !errors.Is(err, config.ErrInvalidAPIKey) {
+		t.Fatalf("Expected the revoked key to be refused at once, got %v", err)
+	}
+	if resp := do("POST", "/users/keys", first.APIKey, nil); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the revoked key to get 401, got %d", resp.Code)
+	}
+	if caller, err := middleware.ResolveAPIKey(ctx, second.APIKey); err != nil || caller.Tier != middleware.TierEnterprise {
+		t.Fatalf("Expected the new key to see the new tier, got %+v, %v", caller, err)
+	}
+}
+
+func TestBearerTokens(t *testing.T) {
+	if err := config.InitDB(); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defaultTokens := middleware.AccessTokens
+	defer func() { middleware.AccessTokens = defaultTokens }()
+	middleware.AccessTokens = tokens.New(tokens.NewMemoryStore(), "test", time.Minute, time.Hour)
+	if err := middleware.AccessTokens.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	r.Use(middleware.AuthMiddleware)
+	r.HandleFunc("/users", handlers.CreateUserHandler).Methods("POST")
+	r.HandleFunc("/auth/token", handlers.TokenHandler).Methods("POST")
+	r.HandleFunc("/auth/revoke", handlers.RevokeTokenHandler).Methods("POST")
+	r.HandleFunc("/.well-known/jwks.json", handlers.JWKSHandler).Methods("GET")
+	r.Handle("/users/url", middleware.RequireScope(models.ScopeLinksRead)(http.HandlerFunc(handlers.GetUserUrlsHandler))).Methods("GET")
+	r.Handle("/users/keys", middleware.RequireScope(models.ScopeKeysManage)(http.HandlerFunc(handlers.ListAPIKeysHandler))).Methods("GET")
+	r.Handle("/users/keys", middleware.RequireScope(models.ScopeKeysManage)(http.HandlerFunc(handlers.CreateAPIKeyHandler))).Methods("POST")
+	r.Handle("/users/keys/{id:[0-9]+}", middleware.RequireScope(models.ScopeKeysManage)(http.HandlerFunc(handlers.RevokeAPIKeyHandler))).Methods("DELETE")
+	do := func(method, path string, headers map[string]string, body interface{}) *httptest.ResponseRecorder {
+		var reqBody bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&reqBody).Encode(body)
+		}
+		req := httptest.NewRequest(method, path, &reqBody)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		return resp
+	}
+	type tokenResponse struct {
+		AccessToken  string `json:"access_token"`
+		Scope        string `json:"scope"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	bearer := func(token string) map[string]string { return map[string]string{"Authorization": "Bearer " + token} }
+
+	resp := do("POST", "/users", nil, map[string]string{"email": "tokens-" + utils.GenerateShortCode(8) + "@example.com"})
+	var owner struct {
+		APIKey string        `json:"api_key"`
+		Key    models.APIKey `json:"key"`
+	}
+	json.NewDecoder(resp.Body).Decode(&owner)
+	apiKey := map[string]string{"api_key": owner.APIKey}
+
+	resp = do("POST", "/auth/token", apiKey, map[string]string{"grant_type": "api_key"})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d: %s", resp.Code, resp.Body.String())
+	}
+	var full tokenResponse
+	json.NewDecoder(resp.Body).Decode(&full)
+	if resp := do("GET", "/users/url", bearer(full.AccessToken), nil); resp.Code != http.StatusOK {
+		t.Fatalf("Expected the access token to list links, got %d: %s", resp.Code, resp.Body.String())
+	}
+	if resp := do("GET", "/users/url", bearer(full.AccessToken+"x"), nil); resp.Code != http.StatusUnauthorized || resp.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("Expected a tampered token to get 401, got %d", resp.Code)
+	}
+	if resp := do("POST", "/auth/token", bearer(full.AccessToken), map[string]string{"grant_type": "api_key"}); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected an access token to be refused more tokens, got %d", resp.Code)
+	}
+
+	// A token narrowed to links:read cannot manage keys, nor widen itself.
+	if resp := do("POST", "/auth/token", apiKey, map[string]string{"grant_type": "api_key", "scope": models.ScopeAdmin}); resp.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a scope the key lacks to be refused, got %d", resp.Code)
+	}
+	resp = do("POST", "/auth/token", apiKey, map[string]string{"grant_type": "api_key", "scope": models.ScopeLinksRead})
+	var narrow tokenResponse
+	json.NewDecoder(resp.Body).Decode(&narrow)
+	if resp := do("GET", "/users/keys", bearer(narrow.AccessToken), nil); resp.Code != http.StatusForbidden {
+		t.Fatalf("Expected the links:read token to be refused key management, got %d", resp.Code)
+	}
+
+	// Refreshing rotates the refresh token; replaying the old one revokes the
+	// family, including the token it was exchanged for.
+	resp = do("POST", "/auth/token", nil, map[string]string{"grant_type": "refresh_token", "refresh_token": narrow.RefreshToken})
+	var refreshed tokenResponse
+	json.NewDecoder(resp.Body).Decode(&refreshed)
+	if resp.Code != http.StatusOK || refreshed.Scope != models.ScopeLinksRead || refreshed.RefreshToken == narrow.RefreshToken {
+		t.Fatalf("Expected new tokens with the same scope, got %d: %+v", resp.Code, refreshed)
+	}
+	if resp := do("POST", "/auth/token", nil, map[string]string{"grant_type": "refresh_token", "refresh_token": narrow.RefreshToken}); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a reused refresh token to get 401, got %d", resp.Code)
+	}
+	if resp := do("POST", "/auth/token", nil, map[string]string{"grant_type": "refresh_token", "refresh_token": refreshed.RefreshToken}); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the family to be revoked after a reuse, got %d", resp.Code)
+	}
+
+	// Revoking the API key ends its refresh tokens.
+	if resp := do("POST", "/users/keys", bearer(full.AccessToken), nil); resp.Code != http.StatusCreated {
+		t.Fatalf("Expected the access token to issue a key, got %d: %s", resp.Code, resp.Body.String())
+	}
+	if resp := do("DELETE", fmt.Sprintf("/users/keys/%d", owner.Key.ID), bearer(full.AccessToken), nil); resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d: %s", resp.Code, resp.Body.String())
+	}
+	if resp := do("POST", "/auth/token", nil, map[string]string{"grant_type": "refresh_token", "refresh_token": full.RefreshToken}); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the revoked key's refresh token to get 401, got %d", resp.Code)
+	}
+
+	resp = do("GET", "/.well-known/jwks.json", nil, nil)
+	if kid := middleware.AccessTokens.JWKS()[0].Kid; resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), kid) {
+		t.Fatalf("Expected the signing key to be published, got %d: %s", resp.Code, resp.Body.String())
+	}
+}
+
+func TestBlockedAPIKeyTokens(t *testing.T) {
+	if err := config.InitDB(); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defaultTokens, defaultBlocklist := middleware.AccessTokens, middleware.Blocklist
+	defer func() { middleware.AccessTokens, middleware.Blocklist = defaultTokens, defaultBlocklist }()
+	middleware.AccessTokens = tokens.New(tokens.NewMemoryStore(), "test", time.Minute, time.Hour)
+	if err := middleware.AccessTokens.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	middleware.Blocklist = blocklist.New(blocklist.NewMemoryStore())
+
+	r := mux.NewRouter()
+	r.Use(middleware.AuthMiddleware)
+	r.Use(middleware.BlacklistMiddleware)
+	r.HandleFunc("/users", handlers.CreateUserHandler).Methods("POST")
+	r.HandleFunc("/auth/token", handlers.TokenHandler).Methods("POST")
+	r.HandleFunc("/admin/blocklist", handlers.AddBlocklistEntryHandler).Methods("POST")
+	r.Handle("/users/url", middleware.RequireScope(models.ScopeLinksRead)(http.HandlerFunc(handlers.GetUserUrlsHandler))).Methods("GET")
+	do := func(method, path string, headers map[string]string, body interface{}) *httptest.ResponseRecorder {
+		var reqBody bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&reqBody).Encode(body)
+		}
+		req := httptest.NewRequest(method, path, &reqBody)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		return resp
+	}
+	type tokenResponse struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	bearer := func(token string) map[string]string { return map[string]string{"Authorization": "Bearer " + token} }
+	newKey := func() (string, models.APIKey, tokenResponse) {
+		resp := do("POST", "/users", nil, map[string]string{"email": "blocked-" + utils.GenerateShortCode(8) + "@example.com"})
+		var owner struct {
+			APIKey string        `json:"api_key"`
+			Key    models.APIKey `json:"key"`
+		}
+		json.NewDecoder(resp.Body).Decode(&owner)
+		resp = do("POST", "/auth/token", map[string]string{"api_key": owner.APIKey}, map[string]string{"grant_type": "api_key"})
+		var issued tokenResponse
+		json.NewDecoder(resp.Body).Decode(&issued)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d: %s", resp.Code, resp.Body.String())
+		}
+		return owner.APIKey, owner.Key, issued
+	}
+
+	// A key blocked by its hash, as admins see it, or by its ID is refused
+	// with its access tokens, and its refresh tokens are revoked.
+	byHash, byHashKey, byHashTokens := newKey()
+	byID, byIDKey, byIDTokens := newKey()
+	for _, entry := range []map[string]string{
+		{"type": "api_key", "value": models.HashAPIKey(byHash)},
+		{"type": "api_key_id", "value": fmt.Sprint(byIDKey.ID)},
+	} {
+		if resp := do("POST", "/admin/blocklist", nil, entry); resp.Code != http.StatusCreated {
+			t.Fatalf("Expected status code 201, got %d: %s", resp.Code, resp.Body.String())
+		}
+	}
+	for name, c := range map[string]struct {
+		key    string
+		tokens tokenResponse
+	}{"hash": {byHash, byHashTokens}, "id": {byID, byIDTokens}} {
+		if resp := do("GET", "/users/url", map[string]string{"api_key": c.key}, nil); resp.Code != http.StatusForbidden {
+			t.Fatalf("Expected the key blocked by %s to get 403, got %d", name, resp.Code)
+		}
+		if resp := do("GET", "/users/url", bearer(c.tokens.AccessToken), nil); resp.Code != http.StatusForbidden {
+			t.Fatalf("Expected the access token of the key blocked by %s to get 403, got %d", name, resp.Code)
+		}
+		if resp := do("POST", "/auth/token", nil, map[string]string{"grant_type": "refresh_token", "refresh_token": c.tokens.RefreshToken}); resp.Code == http.StatusOK {
+			t.Fatalf("Expected the refresh token of the key blocked by %s to be refused, got %d", name, resp.Code)
+		}
+	}
+	var live int64
+	config.DB.Model(&models.RefreshToken{}).Where("api_key_id IN ? AND revoked_at IS NULL", []uint{byHashKey.ID, byIDKey.ID}).Count(&live)
+	if live != 0 {
+		t.Fatalf("Expected the blocked keys' refresh tokens to be revoked, %d are live", live)
+	}
+}
+
+func TestSingleSignOn(t *testing.T) {
+	if err := config.InitDB(); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	testCache, err := cache.NewBigCacheStore()
+	if err != nil {
+		t.Fatalf("failed to initialize cache: %v", err)
+	}
+	handlers.URLCache = testCache
+
+	r := mux.NewRouter()
+	r.Use(middleware.AuthMiddleware)
+	r.HandleFunc("/users", handlers.CreateUserHandler).Methods("POST")
+	r.HandleFunc("/auth/oidc/login", handlers.OIDCLoginHandler).Methods("GET")
+	r.HandleFunc("/auth/oidc/callback", handlers.OIDCCallbackHandler).Methods("GET")
+	r.Handle("/auth/oidc/link", middleware.RequireScope(models.ScopeKeysManage)(http.HandlerFunc(handlers.OIDCLinkHandler))).Methods("POST")
+	r.Handle("/auth/session", middleware.AuthenticateAPIKey(http.HandlerFunc(handlers.SessionHandler))).Methods("GET")
+	r.Handle("/auth/logout", middleware.AuthenticateAPIKey(http.HandlerFunc(handlers.LogoutHandler))).Methods("POST")
+	r.Handle("/users/url", middleware.RequireScope(models.ScopeLinksRead)(http.HandlerFunc(handlers.GetUserUrlsHandler))).Methods("GET")
+	r.Handle("/shorten", middleware.RequireScope(models.ScopeLinksCreate)(http.HandlerFunc(handlers.ShortenHandler))).Methods("POST")
+	app := httptest.NewServer(r)
+	defer app.Close()
+
+	idp := oidctest.NewServer("shortener", app.URL+"/auth/oidc/callback")
+	defer idp.Close()
+	handlers.SSO, err = oidc.Discover(context.Background(), idp.URL, "shortener", "", idp.RedirectURL, []string{"email"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { handlers.SSO = nil }()
+
+	jar, _ := cookiejar.New(nil)
+	browser := &http.Client{Jar: jar}
+	do := func(method, path string, headers map[string]string, body interface{}) (*http.Response, string) {
+		var reqBody bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&reqBody).Encode(body)
+		}
+		req, _ := http.NewRequest(method, app.URL+path, &reqBody)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := browser.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out bytes.Buffer
+		out.ReadFrom(resp.Body)
+		return resp, out.String()
+	}
+	var session struct {
+		User      struct{ ID uint } `json:"user"`
+		CSRFToken string            `json:"csrf_token"`
+	}
+	login := func(user oidc.Identity) (*http.Response, string) {
+		idp.SetUser(user)
+		resp, body := do("GET", "/auth/oidc/login", nil, nil)
+		if resp.StatusCode == http.StatusOK {
+			json.Unmarshal([]byte(body), &session)
+		}
+		return resp, body
+	}
+
+	// The first login creates the user; the next ones find them again.
+	email := "sso-" + strings.ToLower(utils.GenerateShortCode(8)) + "@example.com"
+	staff := oidc.Identity{Subject: "staff-" + utils.GenerateShortCode(8), Email: email, EmailVerified: true, Name: "Staff"}
+	if resp, body := login(staff); resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/auth/session" {
+		t.Fatalf("Expected to land on /auth/session, got %d at %s: %s", resp.StatusCode, resp.Request.URL, body)
+	}
+	var user models.User
+	if err := config.DB.Where("oidc_subject = ?", staff.Subject).First(&user).Error; err != nil || user.Email != email || user.ID != session.User.ID {
+		t.Fatalf("Expected the user to be provisioned, got %+v, %v", user, err)
+	}
+	firstID := session.User.ID
+	if resp, _ := do("GET", "/auth/oidc/login?return_to=/users/url", nil, nil); resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/users/url" {
+		t.Fatalf("Expected to land on /users/url, got %d at %s", resp.StatusCode, resp.Request.URL)
+	}
+	login(staff)
+	if session.User.ID != firstID {
+		t.Fatalf("Expected the same user on the next login, got %d and %d", firstID, session.User.ID)
+	}
+
+	// The session cookie alone cannot change anything.
+	link := map[string]string{"long_url": "https://example.org/sso"}
+	if resp, _ := do("POST", "/shorten", nil, link); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected a request without the CSRF token to get 403, got %d", resp.StatusCode)
+	}
+	if resp, _ := do("POST", "/shorten", map[string]string{middleware.CSRFHeader: "wrong"}, link); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected a wrong CSRF token to get 403, got %d", resp.StatusCode)
+	}
+	if resp, body := do("POST", "/shorten", map[string]string{middleware.CSRFHeader: session.CSRFToken}, link); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	// A callback that this browser did not start is refused.
+	if resp, _ := do("GET", "/auth/oidc/callback?state=forged&code=stolen", nil, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected a forged callback to get 400, got %d", resp.StatusCode)
+	}
+
+	// An existing account is never linked by email, even a verified one; its
+	// owner links it while logged in.
+	signupEmail := "sso-" + strings.ToLower(utils.GenerateShortCode(8)) + "@example.com"
+	var signup struct {
+		User   struct{ ID uint } `json:"user"`
+		APIKey string            `json:"api_key"`
+	}
+	_, body := do("POST", "/users", nil, map[string]string{"email": signupEmail})
+	json.Unmarshal([]byte(body), &signup)
+	claimed := oidc.Identity{Subject: "claimed-" + utils.GenerateShortCode(8), Email: signupEmail, EmailVerified: true}
+	if resp, _ := login(claimed); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected an existing email to get 409, got %d", resp.StatusCode)
+	}
+	if resp, _ := do("POST", "/auth/oidc/link", nil, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected a link without the CSRF token to get 403, got %d", resp.StatusCode)
+	}
+	// A narrowly scoped key cannot link an identity, which would get a
+	// session with every signup scope.
+	readOnly, readOnlyKey, _ := models.NewAPIKey(signup.User.ID, "dashboard", []string{models.ScopeLinksRead})
+	config.DB.Create(&readOnlyKey)
+	if resp, _ := do("POST", "/auth/oidc/link", map[string]string{"api_key": readOnly}, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected a links:read key to get 403, got %d", resp.StatusCode)
+	}
+	var linkURL struct{ URL string }
+	resp, body := do("POST", "/auth/oidc/link", map[string]string{"api_key": signup.APIKey}, nil)
+	if json.Unmarshal([]byte(body), &linkURL); resp.StatusCode != http.StatusOK || linkURL.URL == "" {
+		t.Fatalf("Expected a link URL, got %d: %s", resp.StatusCode, body)
+	}
+	resp, err = browser.Get(linkURL.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(resp.Body).Decode(&session)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || session.User.ID != signup.User.ID {
+		t.Fatalf("Expected to be linked to user %d, got %d as %d", signup.User.ID, resp.StatusCode, session.User.ID)
+	}
+	if resp, body := login(claimed); resp.StatusCode != http.StatusOK || session.User.ID != signup.User.ID {
+		t.Fatalf("Expected to log in as the linked user %d, got %d: %s", signup.User.ID, resp.StatusCode, body)
+	}
+
+	// Another identity cannot take over a linked account.
+	resp, body = do("POST", "/auth/oidc/link", map[string]string{"api_key": signup.APIKey}, nil)
+	json.Unmarshal([]byte(body), &linkURL)
+	idp.SetUser(oidc.Identity{Subject: "other-" + utils.GenerateShortCode(8), Email: signupEmail, EmailVerified: true})
+	if resp, _ := browser.Get(linkURL.URL); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected linking a second identity to get 409, got %d", resp.StatusCode)
+	}
+
+	if resp, _ := do("POST", "/auth/logout", map[string]string{middleware.CSRFHeader: session.CSRFToken}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d", resp.StatusCode)
+	}
+	if resp, _ := do("GET", "/auth/session", nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected to be logged out, got %d", resp.StatusCode)
 	}
 }
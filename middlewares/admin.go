@@ -0,0 +1,42 @@
+package middlewares
+
+import (
+	"M2A1-URL-Shortner/models"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// AdminToken guards the admin endpoints. They are disabled while it is
+// empty.
+var AdminToken string
+
+// RequireAdmin lets through requests carrying "Authorization: Bearer
+// <AdminToken>", or an api_key or access token with the admin scope.
+func RequireAdmin(next http.Handler) http.Handler {
+	withScope := RequireScope(models.ScopeAdmin)(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Bearer values that are not JWTs are taken for admin tokens.
+		token, _ := bearerToken(r)
+		if !isAdmin(r) && (r.Header.Get("api_key") != "" || strings.Count(token, ".") == 2) {
+			withScope.ServeHTTP(w, r)
+			return
+		}
+		if AdminToken == "" {
+			http.Error(w, "Admin endpoints are disabled", http.StatusForbidden)
+			return
+		}
+		if !isAdmin(r) {
+			AuditLogger.Printf("Rejected admin request | IP: %s | URL: %s", ClientIP(r), r.URL.Path)
+			http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isAdmin reports whether r carries the admin token.
+func isAdmin(r *http.Request) bool {
+	token, ok := bearerToken(r)
+	return ok && AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(AdminToken)) == 1
+}
@@ -0,0 +1,170 @@
+package middlewares
+
+import (
+	"M2A1-URL-Shortner/cache"
+	"M2A1-URL-Shortner/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// How long API key lookups are cached. Revoking or rotating a key drops its
+// entry and holds it off for apiKeyHoldTTL, longer than any lookup takes,
+// so a lookup that read the key before the change cannot cache it again.
+// Other changes, such as a new tier, show after at most apiKeyCacheTTL.
+const (
+	apiKeyCacheTTL   = 5 * time.Minute
+	unknownAPIKeyTTL = time.Minute
+	apiKeyHoldTTL    = 30 * time.Second
+)
+
+// APIKeyCache remembers API key lookups by the key's hash, so authenticating
+// a request does not query the database every time. An entry without a
+// UserID records that the key is unknown.
+type APIKeyCache interface {
+	// Get returns the entry for hash, and false when there is none.
+	Get(ctx context.Context, hash string) (models.APIKey, bool, error)
+	// Add stores key for hash unless hash has an entry or is held.
+	Add(ctx context.Context, hash string, key models.APIKey, ttl time.Duration) error
+	Delete(ctx context.Context, hash string) error
+	// Hold drops the entry for hash and keeps Add from storing another
+	// for ttl.
+	Hold(ctx context.Context, hash string, ttl time.Duration) error
+}
+
+// APIKeys is the cache Authenticate uses. main replaces it with a
+// RedisAPIKeyCache unless Redis is disabled.
+var APIKeys APIKeyCache = NewMemoryAPIKeyCache(10000)
+
+// ForgetAPIKey drops the cached lookup of the key with hash and holds it off
+// for apiKeyHoldTTL, so a revoked or rotated key is checked against the
+// database on its next uses.
+func ForgetAPIKey(ctx context.Context, hash string) {
+	if err := APIKeys.Hold(ctx, hash, apiKeyHoldTTL); err != nil {
+		fmt.Printf("Error dropping cached API key: %v\n", err)
+	}
+}
+
+// RedisAPIKeyCache is an APIKeyCache in Redis, shared between instances. A
+// held hash is stored as heldAPIKey.
+type RedisAPIKeyCache struct {
+	store *cache.RedisStore
+}
+
+// NewRedisAPIKeyCache caches API key lookups in store.
+func NewRedisAPIKeyCache(store *cache.RedisStore) *RedisAPIKeyCache {
+	return &RedisAPIKeyCache{store: store}
+}
+
+const heldAPIKey = "held"
+
+// cachedAPIKey is how RedisAPIKeyCache stores a key; the fields APIKey
+// leaves out of its JSON are kept next to it.
+type cachedAPIKey struct {
+	Key    models.APIKey `json:"key"`
+	UserID uint          `json:"user_id"`
+	User   models.User   `json:"user"`
+}
+
+func (c *RedisAPIKeyCache) Get(ctx context.Context, hash string) (models.APIKey, bool, error) {
+	data, err := c.store.Client.Get(ctx, c.store.Key("apikey:"+hash)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return models.APIKey{}, false, nil
+	}
+	if err != nil {
+		return models.APIKey{}, false, err
+	}
+	if string(data) == heldAPIKey {
+		return models.APIKey{}, false, nil
+	}
+	var entry cachedAPIKey
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return models.APIKey{}, false, err
+	}
+	key := entry.Key
+	key.UserID, key.User, key.Hash = entry.UserID, entry.User, hash
+	return key, true, nil
+}
+
+func (c *RedisAPIKeyCache) Add(ctx context.Context, hash string, key models.APIKey, ttl time.Duration) error {
+	data, err := json.Marshal(cachedAPIKey{Key: key, UserID: key.UserID, User: key.User})
+	if err != nil {
+		return err
+	}
+	return c.store.Client.SetNX(ctx, c.store.Key("apikey:"+hash), data, ttl).Err()
+}
+
+func (c *RedisAPIKeyCache) Delete(ctx context.Context, hash string) error {
+	return c.store.Client.Del(ctx, c.store.Key("apikey:"+hash)).Err()
+}
+
+func (c *RedisAPIKeyCache) Hold(ctx context.Context, hash string, ttl time.Duration) error {
+	return c.store.Client.Set(ctx, c.store.Key("apikey:"+hash), heldAPIKey, ttl).Err()
+}
+
+// MemoryAPIKeyCache is an APIKeyCache in process memory, for running a
+// single instance without Redis. It starts over when it holds maxEntries.
+type MemoryAPIKeyCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]memoryAPIKey
+}
+
+type memoryAPIKey struct {
+	key     models.APIKey
+	held    bool
+	expires time.Time
+}
+
+// NewMemoryAPIKeyCache returns an empty MemoryAPIKeyCache.
+func NewMemoryAPIKeyCache(maxEntries int) *MemoryAPIKeyCache {
+	return &MemoryAPIKeyCache{maxEntries: maxEntries, entries: make(map[string]memoryAPIKey)}
+}
+
+func (c *MemoryAPIKeyCache) Get(ctx context.Context, hash string) (models.APIKey, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[hash]
+	if !ok || entry.held || !time.Now().Before(entry.expires) {
+		return models.APIKey{}, false, nil
+	}
+	return entry.key, true, nil
+}
+
+func (c *MemoryAPIKeyCache) Add(ctx context.Context, hash string, key models.APIKey, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[hash]; ok && time.Now().Before(entry.expires) {
+		return nil
+	}
+	c.put(hash, memoryAPIKey{key: key, expires: time.Now().Add(ttl)})
+	return nil
+}
+
+func (c *MemoryAPIKeyCache) Delete(ctx context.Context, hash string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, hash)
+	return nil
+}
+
+func (c *MemoryAPIKeyCache) Hold(ctx context.Context, hash string, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.put(hash, memoryAPIKey{held: true, expires: time.Now().Add(ttl)})
+	return nil
+}
+
+// put stores entry, starting over when the cache is full. c.mu must be
+// held.
+func (c *MemoryAPIKeyCache) put(hash string, entry memoryAPIKey) {
+	if len(c.entries) >= c.maxEntries {
+		c.entries = make(map[string]memoryAPIKey)
+	}
+	c.entries[hash] = entry
+}
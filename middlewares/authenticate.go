@@ -3,9 +3,13 @@ package middlewares
 import (
 	"M2A1-URL-Shortner/config"
 	"M2A1-URL-Shortner/models"
+	"M2A1-URL-Shortner/tokens"
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
 )
 
@@ -14,34 +18,280 @@ type contextKey string
 const UserContextKey contextKey = "user"
 const APIContextKey contextKey = "api_key"
 
-func AuthenticateAPIKey(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		// Retrieve the API key from the request headers
-		apiKey := r.Header.Get("api_key")
-		fmt.Println("AuthenticateAPIKey called with api_key:", apiKey)
-		if apiKey == "" {
-			http.Error(w, "Please pass api_key", http.StatusUnauthorized)
-			return
-		}
+// CallerContextKey holds the *Caller a request is authenticated as.
+const CallerContextKey contextKey = "caller"
+
+// authErrorContextKey holds why AuthMiddleware refused a request's
+// credentials, so RequireScope does not look them up again.
+const authErrorContextKey contextKey = "auth_error"
+
+// errNoCredentials is returned by authenticate for requests without an
+// api_key, a bearer token or a session cookie.
+var errNoCredentials = errors.New("no credentials")
+
+// AccessTokens verifies "Authorization: Bearer" access tokens. main sets it;
+// bearer tokens are refused while it is nil.
+var AccessTokens *tokens.Issuer
+
+// Caller is who a request is authenticated as: by an API key, in Key, by an
+// access token, in TokenID, or by a session cookie, in Session. APIKeyID is
+// the API key behind an API key or access token, and 0 for sessions.
+type Caller struct {
+	User     *models.User
+	Key      *models.APIKey
+	APIKeyID uint
+	TokenID  string
+	Session  *models.Session
+	Scopes   []string
+	Tier     string
+}
+
+// credential names what the caller authenticated with, for the audit log.
+func (c *Caller) credential() string {
+	if c.Key != nil {
+		return c.Key.Prefix
+	}
+	if c.Session != nil {
+		return fmt.Sprintf("session %d", c.Session.ID)
+	}
+	return "token " + c.TokenID
+}
+
+// HasScope reports whether the caller was granted scope.
+func (c *Caller) HasScope(scope string) bool {
+	return slices.Contains(c.Scopes, scope)
+}
+
+// ContextCaller returns the caller r is authenticated as.
+func ContextCaller(r *http.Request) (*Caller, bool) {
+	caller, ok := r.Context().Value(CallerContextKey).(*Caller)
+	return caller, ok && caller != nil
+}
 
-		var user models.User
-		result := config.DB.Model(&models.User{}).First(&user, "api_key = ?", apiKey)
-		if result.Error != nil {
-			http.Error(w, "DB Error", http.StatusInternalServerError)
-			return
+// ResolveAPIKey returns the caller apiKey authenticates, and records the
+// key's use. Lookups are cached in APIKeys by the key's hash; unknown keys
+// are cached too, for a shorter time.
+func ResolveAPIKey(ctx context.Context, apiKey string) (*Caller, error) {
+	if apiKey == "" {
+		return nil, config.ErrInvalidAPIKey
+	}
+	hash := models.HashAPIKey(apiKey)
+	key, found, err := APIKeys.Get(ctx, hash)
+	if err != nil {
+		fmt.Printf("Error reading cached API key %s: %v\n", models.APIKeyPrefix(apiKey), err)
+	}
+	if !found {
+		key, err = config.FindAPIKey(apiKey)
+		if errors.Is(err, config.ErrInvalidAPIKey) {
+			cacheAPIKey(ctx, hash, models.APIKey{}, unknownAPIKeyTTL)
+			return nil, err
 		}
-		if result.RowsAffected == 0 {
-			http.Error(w, "Please provide a valid api key", http.StatusUnauthorized)
-			return
+		if err != nil {
+			return nil, err
 		}
+		// Plaintext keys are hashed at the next start, which would leave
+		// their entry behind.
+		if key.ID != 0 {
+			cacheAPIKey(ctx, hash, key, apiKeyCacheTTL)
+		}
+	}
+	now := time.Now()
+	if key.UserID == 0 || !key.Active(now) {
+		return nil, config.ErrInvalidAPIKey
+	}
+	if entry, blocked := BlockedAPIKey(hash, key.ID); blocked {
+		AuditLogger.Printf("Blocked API key | User: %d | Key: %s | Entry: %s | Reason: %s", key.UserID, key.Prefix, entry.Redacted(), entry.Reason)
+		return nil, ErrBlockedAPIKey
+	}
+	// Refresh the entry along with the last use, which also picks up
+	// changes to the user about once a minute.
+	if config.RecordAPIKeyUse(&key, now) {
+		if err := APIKeys.Delete(ctx, hash); err != nil {
+			fmt.Printf("Error dropping cached API key %s: %v\n", key.Prefix, err)
+		}
+	}
+
+	tier := key.User.Tier
+	if tier == "" {
+		tier = TierHobby
+	}
+	return &Caller{User: &key.User, Key: &key, APIKeyID: key.ID, Scopes: key.GrantedScopes(), Tier: tier}, nil
+}
+
+// ResolveAccessToken returns the caller an access token authenticates. The
+// user is rebuilt from the token's claims, without a database lookup.
+func ResolveAccessToken(ctx context.Context, token string) (*Caller, error) {
+	if AccessTokens == nil {
+		return nil, tokens.ErrInvalidToken
+	}
+	claims, err := AccessTokens.Verify(ctx, token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	userID, err := claims.UserID()
+	if err != nil {
+		return nil, err
+	}
+	if entry, blocked := BlockedAPIKey("", claims.APIKeyID); blocked {
+		AuditLogger.Printf("Blocked access token | User: %d | Token: %s | Entry: %s | Reason: %s", userID, claims.ID, entry.Redacted(), entry.Reason)
+		return nil, ErrBlockedAPIKey
+	}
+	user := &models.User{ID: userID, Email: claims.Email, Name: claims.Name, Tier: claims.Tier}
+	return &Caller{User: user, APIKeyID: claims.APIKeyID, TokenID: claims.ID, Scopes: claims.Scopes(), Tier: claims.Tier}, nil
+}
+
+func cacheAPIKey(ctx context.Context, hash string, key models.APIKey, ttl time.Duration) {
+	if err := APIKeys.Add(ctx, hash, key, ttl); err != nil {
+		fmt.Printf("Error caching API key %s: %v\n", key.Prefix, err)
+	}
+}
 
-		ctx := context.WithValue(r.Context(), UserContextKey, &user)
+// withCaller returns r carrying caller, as CallerContextKey and as the
+// UserContextKey and APIContextKey the handlers read. apiKey is empty for
+// callers with an access token or a session.
+func withCaller(r *http.Request, caller *Caller, apiKey string) *http.Request {
+	ctx := context.WithValue(r.Context(), CallerContextKey, caller)
+	ctx = context.WithValue(ctx, UserContextKey, caller.User)
+	if apiKey != "" {
 		ctx = context.WithValue(ctx, APIContextKey, apiKey)
-		r = r.WithContext(ctx)
+	}
+	return r.WithContext(ctx)
+}
 
-		next.ServeHTTP(w, r)
-		AuditLogger.Printf("AuthenticateAPIKey Time Taken: %s", time.Since(start))
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token, ok && token != ""
+}
+
+// hasCredentials reports whether r carries an api_key, a bearer token other
+// than the admin token, or a session cookie.
+func hasCredentials(r *http.Request) bool {
+	if r.Header.Get("api_key") != "" || hasBearerToken(r) {
+		return true
+	}
+	_, ok := sessionToken(r)
+	return ok
+}
+
+func hasBearerToken(r *http.Request) bool {
+	_, ok := bearerToken(r)
+	return ok && !isAdmin(r)
+}
+
+// authenticate returns r with its Caller, resolving the api_key header, the
+// bearer token or the session cookie, in that order, unless AuthMiddleware
+// already has.
+func authenticate(r *http.Request) (*http.Request, error) {
+	if _, ok := ContextCaller(r); ok {
+		return r, nil
+	}
+	if err, ok := r.Context().Value(authErrorContextKey).(error); ok {
+		return r, err
+	}
+	if !hasCredentials(r) {
+		return r, errNoCredentials
+	}
+	if apiKey := r.Header.Get("api_key"); apiKey != "" {
+		caller, err := ResolveAPIKey(r.Context(), apiKey)
+		if err != nil {
+			return r, err
+		}
+		return withCaller(r, caller, apiKey), nil
+	}
+	if hasBearerToken(r) {
+		token, _ := bearerToken(r)
+		caller, err := ResolveAccessToken(r.Context(), token)
+		if err != nil {
+			return r, err
+		}
+		return withCaller(r, caller, ""), nil
+	}
+	token, _ := sessionToken(r)
+	caller, err := ResolveSession(r.Context(), token)
+	if err != nil {
+		return r, err
+	}
+	return withCaller(r, caller, ""), nil
+}
 
+// AuthMiddleware resolves the credentials of every request that has some
+// into its Caller, so rate limits and RequireScope share one lookup. Requests
+// with bad credentials carry on without a Caller and are refused by the
+// routes that need one.
+func AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hasCredentials(r) {
+			authenticated, err := authenticate(r)
+			if err != nil {
+				authenticated = r.WithContext(context.WithValue(r.Context(), authErrorContextKey, err))
+			}
+			r = authenticated
+		}
+		next.ServeHTTP(w, r)
 	})
 }
+
+// RequireScope lets through authenticated requests whose caller has scope;
+// an empty scope only requires authentication. Every route that acts for a
+// user is wrapped in it.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r, err := authenticate(r)
+			if errors.Is(err, errNoCredentials) {
+				http.Error(w, "Please pass api_key", http.StatusUnauthorized)
+				return
+			}
+			if errors.Is(err, config.ErrInvalidAPIKey) {
+				http.Error(w, "Please provide a valid api key", http.StatusUnauthorized)
+				return
+			}
+			if errors.Is(err, tokens.ErrInvalidToken) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, "Please provide a valid access token", http.StatusUnauthorized)
+				return
+			}
+			if errors.Is(err, ErrBlockedAPIKey) {
+				http.Error(w, "Forbidden: API key is blacklisted", http.StatusForbidden)
+				return
+			}
+			if errors.Is(err, config.ErrInvalidSession) {
+				http.Error(w, "Your session has expired; please log in again", http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				http.Error(w, "DB Error", http.StatusInternalServerError)
+				return
+			}
+			caller, _ := ContextCaller(r)
+			if !ValidCSRF(r, caller) {
+				AuditLogger.Printf("Missing CSRF token | User: %d | Key: %s | URL: %s", caller.User.ID, caller.credential(), r.URL.Path)
+				http.Error(w, "Please send the session's CSRF token in "+CSRFHeader, http.StatusForbidden)
+				return
+			}
+			if scope != "" && !caller.HasScope(scope) {
+				AuditLogger.Printf("Missing scope | User: %d | Key: %s | Scope: %s | URL: %s", caller.User.ID, caller.credential(), scope, r.URL.Path)
+				http.Error(w, "These credentials do not have the "+scope+" scope", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// AuthenticateAPIKey lets through requests with a valid api_key, access
+// token or session, whatever its scopes.
+func AuthenticateAPIKey(next http.Handler) http.Handler {
+	return RequireScope("")(next)
+}
+
+// CanGrantAdmin reports whether r may hand out the admin scope: it carries
+// the admin token or was authenticated with the admin scope.
+func CanGrantAdmin(r *http.Request) bool {
+	if isAdmin(r) {
+		return true
+	}
+	caller, ok := ContextCaller(r)
+	return ok && caller.HasScope(models.ScopeAdmin)
+}
@@ -1,77 +1,53 @@
 package middlewares
 
 import (
-	"encoding/json"
-	"fmt"
-	"log"
+	"M2A1-URL-Shortner/blocklist"
+	"errors"
 	"net/http"
-	"os"
-	"sync"
-	"time"
 )
 
-var (
-	blacklistedKeys map[string]bool
-	blacklistLock   sync.RWMutex
-)
-
-func LoadBlacklist(filePath string) error {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
+// Blocklist holds the blocked API keys, IP addresses and ranges. main sets
+// it up; requests pass while it is nil.
+var Blocklist *blocklist.Blocklist
 
-	var data struct {
-		Blacklisted []string `json:"blacklisted_api_keys"`
-	}
+// ErrBlockedAPIKey is returned by ResolveAPIKey and ResolveAccessToken for
+// keys on the Blocklist, and tokens issued for them.
+var ErrBlockedAPIKey = errors.New("API key is blacklisted")
 
-	if err := json.NewDecoder(file).Decode(&data); err != nil {
-		return err
+// BlockedAPIKey returns the Blocklist entry of the API key with hash or
+// record id, if any.
+func BlockedAPIKey(hash string, id uint) (blocklist.Entry, bool) {
+	if Blocklist == nil {
+		return blocklist.Entry{}, false
 	}
-
-	// Create a map for fast lookups.
-	temp := make(map[string]bool)
-	for _, key := range data.Blacklisted {
-		temp[key] = true
-	}
-
-	// Use a write lock to update the global blacklist.
-	blacklistLock.Lock()
-	blacklistedKeys = temp
-	blacklistLock.Unlock()
-
-	return nil
+	return Blocklist.CheckAPIKey(hash, id)
 }
 
+// BlacklistMiddleware refuses requests whose api_key header or client IP is
+// on the Blocklist. Keys blocked by ID, and access tokens of blocked keys,
+// are refused once they are resolved. Requests with the admin token pass, so
+// an admin whose address got blocked can still remove the entry.
 func BlacklistMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		fmt.Println("Blacklisted middleware called")
-		apiKey := r.Header.Get("api_key")
-		if apiKey == "" {
-			http.Error(w, "Missing API key", http.StatusUnauthorized)
+		if Blocklist == nil || isAdmin(r) {
+			next.ServeHTTP(w, r)
 			return
 		}
-
-		// Load the API key blacklist from the config file.
-		if err := LoadBlacklist("config/blacklist.json"); err != nil {
-			log.Printf("Error loading blacklist: %v", err)
+		ip := ClientIP(r)
+		entry, blocked := Blocklist.Check(r.Header.Get("api_key"), ip)
+		if !blocked {
+			next.ServeHTTP(w, r)
+			return
 		}
 
-		// Use a read lock to safely access the blacklist.
-		blacklistLock.RLock()
-		isBlacklisted := blacklistedKeys[apiKey]
-		blacklistLock.RUnlock()
-
-		if isBlacklisted {
+		AuditLogger.Printf("Blocked request | IP: %s | URL: %s | Entry: %s | Reason: %s", ip, redactedURL(r), entry.Redacted(), entry.Reason)
+		if entry.Source == blocklist.SourceScanner {
+			ScanDetection.slowDown(r)
+		}
+		if entry.Type == blocklist.TypeAPIKey {
 			http.Error(w, "Forbidden: API key is blacklisted", http.StatusForbidden)
 			return
 		}
-
-		// Proceed with the next handler if the API key is not blacklisted.
-		next.ServeHTTP(w, r)
-
-		AuditLogger.Printf("BlacklistMiddleware Time Taken: %s", time.Since(start))
+		http.Error(w, "Forbidden: IP address is blocked", http.StatusForbidden)
 	})
 }
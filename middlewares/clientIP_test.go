@@ -0,0 +1,45 @@
+package middlewares
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	defer SetTrustedProxies(nil)
+	if err := SetTrustedProxies([]string{"10.0.0.0/8", "2001:db8::1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"untrusted peer ignores headers", "203.0.113.9:4000", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "203.0.113.9"},
+		{"trusted peer without headers", "10.0.0.2:4000", nil, "10.0.0.2"},
+		{"spoofed hops left of the client are skipped", "10.0.0.2:4000", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.7, 10.1.1.1"}, "198.51.100.7"},
+		{"all hops trusted", "10.0.0.2:4000", map[string]string{"X-Forwarded-For": "10.9.9.9"}, "10.9.9.9"},
+		{"X-Real-IP", "10.0.0.2:4000", map[string]string{"X-Real-IP": "198.51.100.7"}, "198.51.100.7"},
+		{"Forwarded is preferred", "[2001:db8::1]:443", map[string]string{
+			"Forwarded":       `for=192.0.2.60;proto=https, for="[2001:db8:cafe::17]:4711"`,
+			"X-Forwarded-For": "198.51.100.7",
+		}, "2001:db8:cafe::17"},
+		{"unknown hop stops the walk", "10.0.0.2:4000", map[string]string{"Forwarded": "for=198.51.100.7, for=unknown, for=10.3.3.3"}, "10.3.3.3"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remote
+		for name, value := range tt.headers {
+			req.Header.Set(name, value)
+		}
+		if got := ClientIP(req); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	if err := SetTrustedProxies([]string{"not-a-cidr"}); err == nil {
+		t.Fatal("expected an invalid trusted proxy to be rejected")
+	}
+}
@@ -1,33 +1,18 @@
 package middlewares
 
 import (
-	"M2A1-URL-Shortner/config"
-	"M2A1-URL-Shortner/models"
 	"fmt"
 	"net/http"
 	"time"
 )
 
+// IsEnterprise lets through authenticated callers on the enterprise tier.
 func IsEnterprise(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	return RequireScope("")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		fmt.Printf("IsEnterprise Called:")
-		apiKey := r.Header.Get("api_key")
-		if apiKey == "" {
-			http.Error(w, "Please pass api_key", http.StatusUnauthorized)
-			return
-		}
-		var user models.User
-		result := config.DB.Model(&models.User{}).First(&user, "api_key = ?", apiKey)
-		if result.RowsAffected == 0 {
-			http.Error(w, "Please provide a valid api key", http.StatusUnauthorized)
-			return
-		}
-		if result.Error != nil {
-			http.Error(w, "DB Error", http.StatusInternalServerError)
-			return
-		}
-		if user.Tier != "enterprise" {
+		caller, _ := ContextCaller(r)
+		if caller.Tier != TierEnterprise {
 			http.Error(w, "Access denied: bulk creation is only available for enterprise users", http.StatusForbidden)
 			return
 		}
@@ -40,5 +25,5 @@ func IsEnterprise(next http.Handler) http.Handler {
 
 		AuditLogger.Printf("IsEnterprise Time Taken: %s", time.Since(start))
 
-	})
+	}))
 }
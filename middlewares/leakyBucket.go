@@ -2,17 +2,18 @@ package middlewares
 
 import (
 	"net/http"
-	"strconv"
 	"time"
 )
 
-// LeakyBucketScript is a Lua script for leaky bucket rate limiting.
+// LeakyBucketScript is a Lua script for leaky bucket rate limiting. Each
+// request adds one unit to a bucket that holds ARGV[1] units and drains
+// completely over ARGV[2] milliseconds.
 const LeakyBucketScript = `
 local key = KEYS[1]
 local capacity = tonumber(ARGV[1])
-local leakRate = tonumber(ARGV[2])  -- units per millisecond
+local window = tonumber(ARGV[2])
 local now = tonumber(ARGV[3])
-local requestCost = tonumber(ARGV[4])
+local leakRate = capacity / window  -- units per millisecond
 
 local bucket = redis.call("HMGET", key, "level", "last_update")
 local level = tonumber(bucket[1])
@@ -22,47 +23,33 @@ if level == nil then
   lastUpdate = now
 end
 
-local delta = now - lastUpdate
-local leaked = delta * leakRate
-level = math.max(0, level - leaked)
-
-if level + requestCost > capacity then
-  return -1
+local delta = math.max(0, now - lastUpdate)
+level = math.max(0, level - delta * leakRate)
+local allowed = 0
+local retry = 0
+if level + 1 <= capacity then
+  level = level + 1
+  allowed = 1
 else
-  level = level + requestCost
-  redis.call("HMSET", key, "level", level, "last_update", now)
-  redis.call("EXPIRE", key, 3600)
-  return level
+  retry = math.ceil((level + 1 - capacity) / leakRate)
 end
+redis.call("HSET", key, "level", level, "last_update", now)
+redis.call("PEXPIRE", key, window)
+return {allowed, math.floor(capacity - level), math.ceil(level / leakRate), retry}
 `
 
 // LeakyBucketMiddleware returns a middleware using the leaky bucket algorithm.
 // capacity: maximum allowed "level" in the bucket, leakRate: leak per millisecond.
 func LeakyBucketMiddleware(capacity int, leakRate float64) func(http.Handler) http.Handler {
+	window := time.Duration(float64(capacity) / leakRate * float64(time.Millisecond))
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ip := getIPAddress(r)
+			ip := ClientIP(r)
 			key := "rate:leaky:" + ip + ":" + r.URL.Path
-			ctx := RateLimitRedisStore.Ctx
-			now := time.Now().UnixNano() / 1e6
-			// Assume each request adds a cost of 1 unit.
-			res, err := RateLimitRedisStore.Client.Eval(ctx, LeakyBucketScript, []string{key},
-				capacity, leakRate, now, 1).Result()
-			if err != nil {
-				next.ServeHTTP(w, r)
-				return
-			}
-			level, ok := res.(float64)
-			if !ok || level < 0 {
-				w.WriteHeader(http.StatusTooManyRequests)
-				w.Write([]byte("Rate limit exceeded. Try again later."))
+			if !checkRateLimit(w, r, key, AlgorithmLeakyBucket, RateLimit{Requests: capacity, Window: window}) {
+				http.Error(w, "Rate limit exceeded. Try again later.", http.StatusTooManyRequests)
 				return
 			}
-			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(capacity))
-			// In leaky bucket, the remaining capacity is (capacity - level).
-			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(capacity-int(level)))
-			// For simplicity, we set a fixed reset value.
-			w.Header().Set("X-RateLimit-Reset", "1")
 			next.ServeHTTP(w, r)
 		})
 	}
@@ -2,11 +2,9 @@ package middlewares
 
 import (
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 
 	"gopkg.in/natefinch/lumberjack.v2"
@@ -80,9 +78,9 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 		start := time.Now()
 		timestamp := time.Now().Format(time.RFC3339)
 		method := r.Method
-		url := r.URL.String()
+		url := redactedURL(r)
 		userAgent := r.UserAgent()
-		ip := getIPAddress(r)
+		ip := ClientIP(r)
 
 		// Log as an audit log entry
 		AuditLogger.Printf("Time: %s | Method: %s | URL: %s | User-Agent: %s | IP: %s", timestamp, method, url, userAgent, ip)
@@ -94,20 +92,15 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 
 }
 
-func getIPAddress(r *http.Request) string {
-	// Check X-Forwarded-For header for proxies
-	xff := r.Header.Get("X-Forwaded-For")
-	if xff != "" {
-		parts := strings.Split(xff, ",")
-		if len(parts) > 0 {
-			return strings.TrimSpace(parts[0])
-		}
+// redactedURL returns the request URL with secrets passed as query
+// parameters, such as the deprecated ?password= on redirects, masked.
+func redactedURL(r *http.Request) string {
+	query := r.URL.Query()
+	if !query.Has("password") {
+		return r.URL.String()
 	}
-
-	// Fallback to RemoteAddr (trim port)
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr
-	}
-	return ip
+	query.Set("password", "REDACTED")
+	redacted := *r.URL
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
 }
@@ -0,0 +1,199 @@
+package middlewares
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// memorySweepEvery is how many operations MemoryRateLimitStore performs
+// between sweeps of expired keys.
+const memorySweepEvery = 1000
+
+// MemoryRateLimitStore is a RateLimitStore in process memory, for running a
+// single instance without Redis. It implements the same algorithms as the
+// Redis scripts.
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	entries map[string]*memoryRateEntry
+	ops     int
+}
+
+type memoryRateEntry struct {
+	count   int64
+	expires time.Time // zero means never
+	// Sliding window request times, in milliseconds.
+	times []int64
+	// Token and leaky bucket state; lastUpdate is in milliseconds.
+	bucket     bool
+	level      float64
+	lastUpdate int64
+}
+
+// NewMemoryRateLimitStore returns an empty MemoryRateLimitStore.
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{entries: make(map[string]*memoryRateEntry)}
+}
+
+// entry returns key's live entry, creating it when create is set. Callers
+// hold s.mu.
+func (s *MemoryRateLimitStore) entry(key string, now time.Time, create bool) *memoryRateEntry {
+	s.ops++
+	if s.ops%memorySweepEvery == 0 {
+		for k, e := range s.entries {
+			if e.expired(now) {
+				delete(s.entries, k)
+			}
+		}
+	}
+	e, ok := s.entries[key]
+	if ok && e.expired(now) {
+		delete(s.entries, key)
+		ok = false
+	}
+	if !ok {
+		if !create {
+			return nil
+		}
+		e = &memoryRateEntry{}
+		s.entries[key] = e
+	}
+	return e
+}
+
+func (e *memoryRateEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+func (s *MemoryRateLimitStore) Incr(ctx context.Context, key string, window time.Duration) (int64, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	e := s.entry(key, now, true)
+	e.count++
+	if e.count == 1 {
+		e.expires = now.Add(window)
+	}
+	return e.count, e.expires.Sub(now), nil
+}
+
+func (s *MemoryRateLimitStore) Count(ctx context.Context, key string) (int64, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	e := s.entry(key, now, false)
+	if e == nil {
+		return 0, 0, nil
+	}
+	if e.expires.IsZero() {
+		return e.count, -1, nil
+	}
+	return e.count, e.expires.Sub(now), nil
+}
+
+func (s *MemoryRateLimitStore) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if e := s.entry(key, now, false); e != nil {
+		e.expires = now.Add(ttl)
+	}
+	return nil
+}
+
+func (s *MemoryRateLimitStore) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+// Allow implements the same algorithms as the Redis scripts.
+func (s *MemoryRateLimitStore) Allow(ctx context.Context, key string, algorithm string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	nowMs, windowMs := now.UnixMilli(), limit.Window.Milliseconds()
+	capacity := float64(limit.Requests)
+	result := RateLimitResult{Limit: limit.Requests}
+	e := s.entry(key, now, true)
+
+	switch algorithm {
+	case AlgorithmFixedWindow:
+		e.count++
+		if e.count == 1 || e.expires.IsZero() {
+			e.expires = now.Add(limit.Window)
+		}
+		result.Reset = e.expires.Sub(now)
+		if e.count <= int64(limit.Requests) {
+			result.Allowed, result.Remaining = true, limit.Requests-int(e.count)
+		} else {
+			result.RetryAfter = result.Reset
+		}
+		return result, nil
+
+	case AlgorithmSlidingWindow:
+		windowStart := nowMs - windowMs
+		kept := e.times[:0]
+		for _, t := range e.times {
+			if t > windowStart {
+				kept = append(kept, t)
+			}
+		}
+		e.times = kept
+		if len(e.times) < limit.Requests {
+			e.times = append(e.times, nowMs)
+			e.expires = now.Add(limit.Window)
+			result.Allowed, result.Remaining = true, limit.Requests-len(e.times)
+		}
+		result.Reset = limit.Window
+		if len(e.times) > 0 {
+			result.Reset = time.Duration(e.times[0]+windowMs-nowMs) * time.Millisecond
+		}
+		if !result.Allowed {
+			result.RetryAfter = result.Reset
+		}
+		return result, nil
+
+	case AlgorithmTokenBucket, AlgorithmLeakyBucket:
+		rate := capacity / float64(windowMs) // per millisecond
+		if !e.bucket {
+			e.bucket, e.level, e.lastUpdate = true, 0, nowMs
+			if algorithm == AlgorithmTokenBucket {
+				e.level = capacity
+			}
+		}
+		elapsed := math.Max(0, float64(nowMs-e.lastUpdate)) * rate
+		e.lastUpdate = nowMs
+		e.expires = now.Add(limit.Window)
+		if algorithm == AlgorithmTokenBucket {
+			e.level = math.Min(capacity, e.level+elapsed)
+			if e.level >= 1 {
+				e.level--
+				result.Allowed = true
+			} else {
+				result.RetryAfter = msDuration((1 - e.level) / rate)
+			}
+			result.Remaining = int(math.Floor(e.level))
+			result.Reset = msDuration((capacity - e.level) / rate)
+			return result, nil
+		}
+		e.level = math.Max(0, e.level-elapsed)
+		if e.level+1 <= capacity {
+			e.level++
+			result.Allowed = true
+		} else {
+			result.RetryAfter = msDuration((e.level + 1 - capacity) / rate)
+		}
+		result.Remaining = int(math.Floor(capacity - e.level))
+		result.Reset = msDuration(e.level / rate)
+		return result, nil
+	}
+	return result, fmt.Errorf("unknown rate limit algorithm %q", algorithm)
+}
+
+// msDuration rounds a number of milliseconds up, like the Redis scripts.
+func msDuration(ms float64) time.Duration {
+	return time.Duration(math.Ceil(ms)) * time.Millisecond
+}
@@ -0,0 +1,72 @@
+package middlewares
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryRateLimitStore()
+
+	for i := int64(1); i <= 3; i++ {
+		count, ttl, _ := s.Incr(ctx, "fixed", time.Minute)
+		if count != i || ttl <= 0 || ttl > time.Minute {
+			t.Fatalf("Incr %d = %d, %s", i, count, ttl)
+		}
+	}
+	s.Expire(ctx, "fixed", time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	if count, _, _ := s.Count(ctx, "fixed"); count != 0 {
+		t.Fatalf("expected the window to reset, count %d", count)
+	}
+
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	allow := func(algorithm string, requests int, ms int) RateLimitResult {
+		result, err := s.Allow(ctx, algorithm, algorithm, RateLimit{Requests: requests, Window: 2 * time.Second}, at(ms))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	for i, want := range []bool{true, true, false} {
+		if result := allow(AlgorithmFixedWindow, 2, i); result.Allowed != want || result.Remaining != max(1-i, 0) {
+			t.Fatalf("fixed window request %d: %+v", i, result)
+		}
+	}
+
+	allow(AlgorithmSlidingWindow, 2, 0)
+	allow(AlgorithmSlidingWindow, 2, 1500)
+	if result := allow(AlgorithmSlidingWindow, 2, 1800); result.Allowed || result.RetryAfter != 200*time.Millisecond {
+		t.Fatalf("expected the third request to wait for the first to leave the window: %+v", result)
+	}
+	if result := allow(AlgorithmSlidingWindow, 2, 2000); !result.Allowed || result.Remaining != 0 {
+		t.Fatalf("expected the request at 0ms to have left the window: %+v", result)
+	}
+
+	// Two tokens, refilled at one per second.
+	for i, want := range []bool{true, true, false} {
+		if result := allow(AlgorithmTokenBucket, 2, 0); result.Allowed != want {
+			t.Fatalf("token request %d: %+v", i, result)
+		}
+	}
+	if result := allow(AlgorithmTokenBucket, 2, 1000); !result.Allowed || result.Remaining != 0 || result.Reset != 2*time.Second {
+		t.Fatalf("expected one refilled token to be taken: %+v", result)
+	}
+
+	// Holds two units, leaking one per second.
+	for i, want := range []bool{true, true, false} {
+		if result := allow(AlgorithmLeakyBucket, 2, 0); result.Allowed != want {
+			t.Fatalf("leaky request %d: %+v", i, result)
+		}
+	}
+	if result := allow(AlgorithmLeakyBucket, 2, 500); result.Allowed || result.RetryAfter != 500*time.Millisecond {
+		t.Fatalf("expected to wait for half a unit to leak: %+v", result)
+	}
+	if result := allow(AlgorithmLeakyBucket, 2, 1000); !result.Allowed || result.Remaining != 0 {
+		t.Fatalf("expected one unit to have leaked: %+v", result)
+	}
+}
@@ -0,0 +1,171 @@
+package middlewares
+
+import (
+	"M2A1-URL-Shortner/models"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Tiers a rate limit can be set for. Requests without a valid API key are
+// anonymous.
+const (
+	TierAnonymous  = "anonymous"
+	TierHobby      = "hobby"
+	TierEnterprise = "enterprise"
+)
+
+// RateLimitRule limits the requests to one route.
+type RateLimitRule struct {
+	// Route is the name of a mux route, or "*" for routes without a rule.
+	Route     string
+	Algorithm string
+	// Limits holds the limit for each tier. Tiers without their own entry
+	// use "default"; without one either, they are not limited.
+	Limits map[string]RateLimit
+}
+
+// RateLimitPolicy is the set of rules RateLimitPolicyMiddleware enforces.
+type RateLimitPolicy struct {
+	rules map[string]RateLimitRule
+}
+
+// LoadRateLimitPolicy reads a policy from a JSON file of the form
+//
+//	{"rules": [{"route": "shorten", "algorithm": "token_bucket",
+//	            "limits": {"hobby": {"requests": 60, "window": "1m"}}}]}
+func LoadRateLimitPolicy(filePath string) (*RateLimitPolicy, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var data struct {
+		Rules []struct {
+			Route     string `json:"route"`
+			Algorithm string `json:"algorithm"`
+			Limits    map[string]struct {
+				Requests int    `json:"requests"`
+				Window   string `json:"window"`
+			} `json:"limits"`
+		} `json:"rules"`
+	}
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&data); err != nil {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+
+	var rules []RateLimitRule
+	for _, r := range data.Rules {
+		rule := RateLimitRule{Route: r.Route, Algorithm: r.Algorithm, Limits: map[string]RateLimit{}}
+		for tier, limit := range r.Limits {
+			window, err := time.ParseDuration(limit.Window)
+			if err != nil {
+				return nil, fmt.Errorf("%s: route %q, tier %q: window must be a duration such as 1m, got %q", filePath, r.Route, tier, limit.Window)
+			}
+			rule.Limits[tier] = RateLimit{Requests: limit.Requests, Window: window}
+		}
+		rules = append(rules, rule)
+	}
+	policy, err := NewRateLimitPolicy(rules)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+	return policy, nil
+}
+
+// NewRateLimitPolicy checks rules and builds a policy from them.
+func NewRateLimitPolicy(rules []RateLimitRule) (*RateLimitPolicy, error) {
+	policy := &RateLimitPolicy{rules: make(map[string]RateLimitRule, len(rules))}
+	for _, rule := range rules {
+		if rule.Route == "" {
+			return nil, errors.New("every rate limit rule needs a route")
+		}
+		if _, ok := policy.rules[rule.Route]; ok {
+			return nil, fmt.Errorf("route %q has more than one rate limit rule", rule.Route)
+		}
+		if _, ok := rateLimitScripts[rule.Algorithm]; !ok {
+			return nil, fmt.Errorf("route %q: unknown algorithm %q, want fixed_window, sliding_window, token_bucket or leaky_bucket", rule.Route, rule.Algorithm)
+		}
+		for tier, limit := range rule.Limits {
+			switch tier {
+			case TierAnonymous, TierHobby, TierEnterprise, "default":
+			default:
+				return nil, fmt.Errorf("route %q: unknown tier %q", rule.Route, tier)
+			}
+			if limit.Requests <= 0 || limit.Window < time.Millisecond {
+				return nil, fmt.Errorf("route %q, tier %q: requests and window must be positive", rule.Route, tier)
+			}
+		}
+		policy.rules[rule.Route] = rule
+	}
+	return policy, nil
+}
+
+// limitFor returns the rule and limit for a request to route by tier.
+func (p *RateLimitPolicy) limitFor(route, tier string) (RateLimitRule, RateLimit, bool) {
+	rule, ok := p.rules[route]
+	if !ok {
+		if rule, ok = p.rules["*"]; !ok {
+			return rule, RateLimit{}, false
+		}
+	}
+	limit, ok := rule.Limits[tier]
+	if !ok {
+		limit, ok = rule.Limits["default"]
+	}
+	return rule, limit, ok
+}
+
+// RateLimitPolicyMiddleware limits requests by the rule for the matched
+// route, so it must be added with Router.Use. Requests with a valid API key,
+// or an access token issued for one, are counted per key against their
+// tier's limit, and sessions per user; all others per client IP as
+// anonymous, so made-up keys cannot be used to get fresh limits.
+func RateLimitPolicyMiddleware(policy *RateLimitPolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := "*"
+			if current := mux.CurrentRoute(r); current != nil && current.GetName() != "" {
+				route = current.GetName()
+			}
+			subject, tier := rateLimitSubject(r)
+			rule, limit, ok := policy.limitFor(route, tier)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			key := "rl:" + rule.Algorithm + ":" + rule.Route + ":" + subject
+			if !checkRateLimit(w, r, key, rule.Algorithm, limit) {
+				http.Error(w, "Rate limit exceeded. Try again later.", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimitSubject returns who a request is counted against and their tier.
+func rateLimitSubject(r *http.Request) (string, string) {
+	// AuthMiddleware has resolved the credentials, if there are valid ones.
+	user, _ := r.Context().Value(UserContextKey).(*models.User)
+	if user == nil {
+		return "ip:" + ClientIP(r), TierAnonymous
+	}
+	tier := user.Tier
+	if tier == "" {
+		tier = TierHobby
+	}
+	if caller, ok := ContextCaller(r); ok && caller.APIKeyID != 0 {
+		return "key:" + strconv.FormatUint(uint64(caller.APIKeyID), 10), tier
+	}
+	return "user:" + strconv.FormatUint(uint64(user.ID), 10), tier
+}
@@ -0,0 +1,82 @@
+package middlewares
+
+import (
+	"M2A1-URL-Shortner/models"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRateLimitPolicyMiddleware(t *testing.T) {
+	if _, err := LoadRateLimitPolicy("../config/ratelimits.json"); err != nil {
+		t.Fatalf("shipped policy: %v", err)
+	}
+
+	defaultRateLimits := RateLimits
+	defer func() { RateLimits = defaultRateLimits }()
+	RateLimits = NewMemoryRateLimitStore()
+
+	policy, err := NewRateLimitPolicy([]RateLimitRule{
+		{Route: "shorten", Algorithm: AlgorithmSlidingWindow, Limits: map[string]RateLimit{
+			TierAnonymous:  {Requests: 1, Window: time.Minute},
+			TierEnterprise: {Requests: 3, Window: time.Minute},
+		}},
+		{Route: "*", Algorithm: AlgorithmFixedWindow, Limits: map[string]RateLimit{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := mux.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if key := req.Header.Get("X-Test-Key"); key != "" {
+				id, _ := strconv.ParseUint(key, 10, 64)
+				user := &models.User{ID: 7, Tier: TierEnterprise}
+				req = withCaller(req, &Caller{User: user, APIKeyID: uint(id), Tier: TierEnterprise}, "")
+			}
+			next.ServeHTTP(w, req)
+		})
+	})
+	r.Use(RateLimitPolicyMiddleware(policy))
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	r.Handle("/shorten", ok).Name("shorten")
+	r.Handle("/health", ok)
+
+	send := func(path string, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, nil)
+		if key != "" {
+			req.Header.Set("X-Test-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := send("/shorten", ""); rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("first anonymous request: %d %v", rec.Code, rec.Header())
+	}
+	rec := send("/shorten", "")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "60" {
+		t.Fatalf("expected the anonymous limit of 1 to apply: %d %v", rec.Code, rec.Header())
+	}
+	for i := 0; i < 3; i++ {
+		if rec := send("/shorten", "1"); rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Limit") != "3" {
+			t.Fatalf("enterprise request %d: %d %v", i, rec.Code, rec.Header())
+		}
+	}
+	if rec := send("/shorten", "1"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the enterprise limit of 3 to apply, got %d", rec.Code)
+	}
+	// Another key of the same user has a budget of its own.
+	if rec := send("/shorten", "2"); rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Remaining") != "2" {
+		t.Fatalf("second key: %d %v", rec.Code, rec.Header())
+	}
+	// The catch-all rule sets no limits, so other routes are not limited.
+	if rec := send("/health", ""); rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Limit") != "" {
+		t.Fatalf("unlimited route: %d %v", rec.Code, rec.Header())
+	}
+}
@@ -0,0 +1,135 @@
+package middlewares
+
+import (
+	"M2A1-URL-Shortner/cache"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RateLimitStore keeps the counters behind the rate limiters and the unlock
+// lockout. RedisRateLimitStore shares them between instances;
+// MemoryRateLimitStore keeps them in this process.
+type RateLimitStore interface {
+	// Incr adds one to key and returns the new count and the time left
+	// before it resets. A new key starts a window of length window.
+	Incr(ctx context.Context, key string, window time.Duration) (int64, time.Duration, error)
+	// Count returns key's count and the time left before it resets,
+	// without changing it.
+	Count(ctx context.Context, key string) (int64, time.Duration, error)
+	// Expire makes key reset after ttl from now.
+	Expire(ctx context.Context, key string, ttl time.Duration) error
+	// Reset removes key.
+	Reset(ctx context.Context, key string) error
+	// Allow counts a request against key under algorithm, which lets
+	// through limit.Requests per limit.Window, and reports whether it may
+	// proceed. Each call is atomic.
+	Allow(ctx context.Context, key string, algorithm string, limit RateLimit, now time.Time) (RateLimitResult, error)
+}
+
+// RateLimits is the store the rate-limit middlewares use. main replaces it
+// with a RedisRateLimitStore unless Redis is disabled.
+var RateLimits RateLimitStore = NewMemoryRateLimitStore()
+
+// Every algorithm runs as one Lua script over a single key, passed in KEYS,
+// so checks are atomic and run on whichever node owns the key's hash slot
+// when Redis is a cluster. Run loads the scripts with EVALSHA and falls back
+// to EVAL when a node does not have them yet.
+var rateLimitScripts = map[string]*redis.Script{
+	AlgorithmFixedWindow:   redis.NewScript(FixedWindowScript),
+	AlgorithmSlidingWindow: redis.NewScript(SlidingWindowScript),
+	AlgorithmTokenBucket:   redis.NewScript(TokenBucketScript),
+	AlgorithmLeakyBucket:   redis.NewScript(LeakyBucketScript),
+}
+
+// RedisRateLimitStore is a RateLimitStore in Redis. Keys get the store's key
+// prefix.
+type RedisRateLimitStore struct {
+	store *cache.RedisStore
+}
+
+// NewRedisRateLimitStore keeps rate-limit counters in store.
+func NewRedisRateLimitStore(store *cache.RedisStore) *RedisRateLimitStore {
+	return &RedisRateLimitStore{store: store}
+}
+
+// incrScript adds one to KEYS[1] and starts a window of ARGV[1] ms when the
+// key is new or has lost its TTL. It returns {count, ms left}.
+var incrScript = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+local ttl = redis.call("PTTL", KEYS[1])
+if count == 1 or ttl < 0 then
+  redis.call("PEXPIRE", KEYS[1], ARGV[1])
+  ttl = tonumber(ARGV[1])
+end
+return {count, ttl}
+`)
+
+// Incr runs incrScript, so a counter is never left without a TTL and the
+// time left is the key's own.
+func (s *RedisRateLimitStore) Incr(ctx context.Context, key string, window time.Duration) (int64, time.Duration, error) {
+	values, err := incrScript.Run(ctx, s.store.Client, []string{s.store.Key(key)}, window.Milliseconds()).Int64Slice()
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(values) != 2 {
+		return 0, 0, fmt.Errorf("incr script returned %d values", len(values))
+	}
+	return values[0], time.Duration(values[1]) * time.Millisecond, nil
+}
+
+func (s *RedisRateLimitStore) Count(ctx context.Context, key string) (int64, time.Duration, error) {
+	client, key := s.store.Client, s.store.Key(key)
+	count, err := client.Get(ctx, key).Int64()
+	if err == redis.Nil {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	ttl, err := client.TTL(ctx, key).Result()
+	if err != nil {
+		return count, 0, err
+	}
+	return count, ttl, nil
+}
+
+func (s *RedisRateLimitStore) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	return s.store.Client.Expire(ctx, s.store.Key(key), ttl).Err()
+}
+
+func (s *RedisRateLimitStore) Reset(ctx context.Context, key string) error {
+	return s.store.Client.Del(ctx, s.store.Key(key)).Err()
+}
+
+// Allow runs the script for algorithm. The scripts all return {allowed,
+// remaining, reset in ms, retry after in ms}.
+func (s *RedisRateLimitStore) Allow(ctx context.Context, key string, algorithm string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	script, ok := rateLimitScripts[algorithm]
+	if !ok {
+		return RateLimitResult{}, fmt.Errorf("unknown rate limit algorithm %q", algorithm)
+	}
+	args := []interface{}{limit.Requests, limit.Window.Milliseconds(), now.UnixMilli()}
+	if algorithm == AlgorithmSlidingWindow {
+		// Requests made in the same millisecond need distinct members.
+		args = append(args, strconv.FormatInt(now.UnixNano(), 10)+":"+strconv.FormatUint(rand.Uint64(), 36))
+	}
+	values, err := script.Run(ctx, s.store.Client, []string{s.store.Key(key)}, args...).Int64Slice()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	if len(values) != 4 {
+		return RateLimitResult{}, fmt.Errorf("rate limit script returned %d values", len(values))
+	}
+	return RateLimitResult{
+		Allowed:    values[0] == 1,
+		Limit:      limit.Requests,
+		Remaining:  int(values[1]),
+		Reset:      time.Duration(values[2]) * time.Millisecond,
+		RetryAfter: time.Duration(values[3]) * time.Millisecond,
+	}, nil
+}
@@ -1,49 +1,90 @@
 package middlewares
 
 import (
-	"M2A1-URL-Shortner/cache"
+	"fmt"
+	"math"
 	"net/http"
 	"strconv"
 	"time"
 )
 
-var RateLimitRedisStore *cache.RedisStore
+// Rate-limit algorithms, as named in the rate-limit policy.
+const (
+	AlgorithmFixedWindow   = "fixed_window"
+	AlgorithmSlidingWindow = "sliding_window"
+	AlgorithmTokenBucket   = "token_bucket"
+	AlgorithmLeakyBucket   = "leaky_bucket"
+)
 
-func RateLimitMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip := getIPAddress(r)
-		key := "rate:" + ip
+// RateLimit lets through Requests per Window. The bucket algorithms hold
+// Requests at once and refill or drain them over Window.
+type RateLimit struct {
+	Requests int
+	Window   time.Duration
+}
 
-		ctx := RateLimitRedisStore.Ctx
+// RateLimitResult is the outcome of one rate-limit check.
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is the time until the full limit is available again.
+	Reset time.Duration
+	// RetryAfter is the time until a denied request could succeed.
+	RetryAfter time.Duration
+}
 
-		count, err := RateLimitRedisStore.Client.Incr(ctx, key).Result()
-		w.Header().Set("X-RateLimit-Limit", "100")
-		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(100-count)))
-		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(time.Minute.Seconds())))
-		if err != nil {
-			// In case of error, let the request pass.
-			next.ServeHTTP(w, r)
-			return
-		}
-		// If this is the first request, set an expiry of 1 minute.
-		if count == 1 {
-			RateLimitRedisStore.Client.Expire(ctx, key, time.Minute)
-		}
+// FixedWindowScript counts requests in a window that starts with the first
+// one.
+const FixedWindowScript = `
+local key = KEYS[1]
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+
+local count = redis.call("INCR", key)
+local ttl = redis.call("PTTL", key)
+if count == 1 or ttl < 0 then
+  redis.call("PEXPIRE", key, window)
+  ttl = window
+end
+if count > limit then
+  return {0, 0, ttl, ttl}
+end
+return {1, limit - count, ttl, 0}
+`
+
+// checkRateLimit counts the request against key and sets the RateLimit-*
+// headers, plus Retry-After when it is denied. Errors from the store let the
+// request through.
+func checkRateLimit(w http.ResponseWriter, r *http.Request, key, algorithm string, limit RateLimit) bool {
+	result, err := RateLimits.Allow(r.Context(), key, algorithm, limit, time.Now())
+	if err != nil {
+		fmt.Printf("Rate limit check for %s failed: %v\n", key, err)
+		return true
+	}
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(max(result.Remaining, 0)))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Requests, ceilSeconds(limit.Window)))
+	if !result.Allowed {
+		h.Set("Retry-After", strconv.Itoa(max(ceilSeconds(result.RetryAfter), 1)))
+	}
+	return result.Allowed
+}
 
-		// Retrieve the TTL for this key.
-		ttl, err := RateLimitRedisStore.Client.TTL(ctx, key).Result()
-		if err == nil && ttl > 0 {
-			// Convert the TTL (a time.Duration) to seconds.
-			w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(ttl.Seconds())))
-		} else {
-			// Fallback if TTL is not available.
-			w.Header().Set("X-RateLimit-Reset", "60")
-		}
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
 
-		// If the number of requests exceeds 100, throttle the request.
-		if count > 100 {
-			w.WriteHeader(http.StatusTooManyRequests)
-			w.Write([]byte("Rate limit exceeded. Try again later."))
+func RateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := ClientIP(r)
+		key := "rate:" + ip
+
+		// The window starts with the first request and lasts 1 minute.
+		if !checkRateLimit(w, r, key, AlgorithmFixedWindow, RateLimit{Requests: 100, Window: time.Minute}) {
+			http.Error(w, "Rate limit exceeded. Try again later.", http.StatusTooManyRequests)
 			return
 		}
 
@@ -53,40 +94,12 @@ func RateLimitMiddleware(next http.Handler) http.Handler {
 func APIRateLimitMiddleware(maxRequest int64) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ip := getIPAddress(r)
+			ip := ClientIP(r)
 			endpoint := r.URL.Path
 			key := "rate:" + ip + ":" + endpoint
 
-			ctx := RateLimitRedisStore.Ctx
-
-			count, err := RateLimitRedisStore.Client.Incr(ctx, key).Result()
-			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(int(maxRequest)))
-			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(maxRequest-count)))
-			// w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(time.Minute.Seconds())))
-			if err != nil {
-				// In case of error, let the request pass.
-				next.ServeHTTP(w, r)
-				return
-			}
-			// If this is the first request, set an expiry of 1 minute.
-			if count == 1 {
-				RateLimitRedisStore.Client.Expire(ctx, key, time.Minute)
-			}
-
-			// Retrieve the TTL for this key.
-			ttl, err := RateLimitRedisStore.Client.TTL(ctx, key).Result()
-			if err == nil && ttl > 0 {
-				// Convert the TTL (a time.Duration) to seconds.
-				w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(ttl.Seconds())))
-			} else {
-				// Fallback if TTL is not available.
-				w.Header().Set("X-RateLimit-Reset", "60")
-			}
-
-			// If the number of requests exceeds maxrequest, throttle the request.
-			if count >= int64(maxRequest) {
-				w.WriteHeader(http.StatusTooManyRequests)
-				w.Write([]byte("Rate limit exceeded. Try again later."))
+			if !checkRateLimit(w, r, key, AlgorithmFixedWindow, RateLimit{Requests: int(maxRequest), Window: time.Minute}) {
+				http.Error(w, "Rate limit exceeded. Try again later.", http.StatusTooManyRequests)
 				return
 			}
 
@@ -100,38 +113,10 @@ func FreeTierMiddleware(next http.Handler) http.Handler {
 		apiKey := r.Header.Get("api_key")
 		if apiKey == "" || apiKey == "free" {
 
-			ip := getIPAddress(r)
+			ip := ClientIP(r)
 			key := "rate:free: " + ip
-			ctx := RateLimitRedisStore.Ctx
-
-			count, err := RateLimitRedisStore.Client.Incr(ctx, key).Result()
-			w.Header().Set("X-RateLimit-Limit", "5")
-			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(5-count)))
-			// w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(time.Minute.Seconds())))
-			if err != nil {
-				// In case of error, let the request pass.
-				next.ServeHTTP(w, r)
-				return
-			}
-			// If this is the first request, set an expiry of 1 minute.
-			if count == 1 {
-				RateLimitRedisStore.Client.Expire(ctx, key, time.Minute)
-			}
-
-			// Retrieve the TTL for this key.
-			ttl, err := RateLimitRedisStore.Client.TTL(ctx, key).Result()
-			if err == nil && ttl > 0 {
-				// Convert the TTL (a time.Duration) to seconds.
-				w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(ttl.Seconds())))
-			} else {
-				// Fallback if TTL is not available.
-				w.Header().Set("X-RateLimit-Reset", "60")
-			}
-
-			// If the number of requests exceeds 100, throttle the request.
-			if count >= 5 {
-				w.WriteHeader(http.StatusTooManyRequests)
-				w.Write([]byte("Rate limit exceeded for free tier. Please upgrade your plan or try again later."))
+			if !checkRateLimit(w, r, key, AlgorithmFixedWindow, RateLimit{Requests: 5, Window: time.Minute}) {
+				http.Error(w, "Rate limit exceeded for free tier. Please upgrade your plan or try again later.", http.StatusTooManyRequests)
 				return
 			}
 		}
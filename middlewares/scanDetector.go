@@ -0,0 +1,158 @@
+package middlewares
+
+import (
+	"M2A1-URL-Shortner/blocklist"
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// ScanDetector spots clients walking the short code keyspace: a client IP
+// with more than Threshold not-found lookups in a sliding Window is put on
+// the Blocklist for BlockFor. While it is blocked, its requests are held for
+// Slowdown before being refused, to slow the scan down further.
+type ScanDetector struct {
+	Threshold int
+	Window    time.Duration
+	BlockFor  time.Duration
+	Slowdown  time.Duration
+
+	notFound atomic.Uint64
+	blocked  atomic.Uint64
+	slowed   atomic.Uint64
+}
+
+// ScanStats are cumulative counters for a ScanDetector.
+type ScanStats struct {
+	NotFound uint64 `json:"not_found"`
+	Blocked  uint64 `json:"blocked"`
+	Slowed   uint64 `json:"slowed"`
+}
+
+// ScanDetection watches the short link routes. main configures it; a
+// Threshold of 0 turns detection off.
+var ScanDetection = &ScanDetector{Threshold: 50, Window: time.Minute, BlockFor: 15 * time.Minute}
+
+// tarpit bounds how many requests are held by Slowdown at once, so a scanner
+// cannot tie up the server with them. Requests beyond it are refused at once.
+var tarpit = make(chan struct{}, 100)
+
+// Stats returns the current counters.
+func (d *ScanDetector) Stats() ScanStats {
+	return ScanStats{NotFound: d.notFound.Load(), Blocked: d.blocked.Load(), Slowed: d.slowed.Load()}
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(statusCode int) {
+	if s.status == 0 {
+		s.status = statusCode
+	}
+	s.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// ScanDetectorMiddleware counts the 404 responses of the wrapped short link
+// routes against ScanDetection.
+func ScanDetectorMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := ScanDetection
+		if d == nil || d.Threshold <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == http.StatusNotFound {
+			d.notFound.Add(1)
+			d.observe(r)
+		}
+	})
+}
+
+// observe counts a not-found lookup for the client and blocks it once it is
+// over the threshold. The counts live in RateLimits, so they are shared
+// between instances with Redis.
+func (d *ScanDetector) observe(r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+	ip := ClientIP(r)
+	key := "scan:" + ip
+	result, err := RateLimits.Allow(ctx, key, AlgorithmSlidingWindow, RateLimit{Requests: d.Threshold, Window: d.Window}, time.Now())
+	if err != nil {
+		fmt.Printf("Scan detection for %s failed: %v\n", ip, err)
+		return
+	}
+	if result.Allowed {
+		return
+	}
+	d.block(r, ip)
+	// Start from zero once the block is over.
+	if err := RateLimits.Reset(ctx, key); err != nil {
+		fmt.Printf("Error resetting scan count for %s: %v\n", ip, err)
+	}
+}
+
+// block puts ip on the Blocklist for BlockFor and reports it to Sentry.
+func (d *ScanDetector) block(r *http.Request, ip string) {
+	d.blocked.Add(1)
+	expiresAt := time.Now().Add(d.BlockFor).UTC()
+	reason := fmt.Sprintf("short code enumeration: more than %d not-found lookups in %s", d.Threshold, d.Window)
+	AuditLogger.Printf("Blocking scanner | IP: %s | URL: %s | Until: %s | Reason: %s", ip, redactedURL(r), expiresAt.Format(time.RFC3339), reason)
+	if Blocklist != nil {
+		entry := blocklist.Entry{Type: blocklist.TypeIP, Value: ip, Reason: reason, ExpiresAt: &expiresAt, Source: blocklist.SourceScanner}
+		if _, err := Blocklist.Add(context.WithoutCancel(r.Context()), entry); err != nil {
+			fmt.Printf("Error blocking scanner %s: %v\n", ip, err)
+		}
+	}
+
+	hub := sentry.GetHubFromContext(r.Context())
+	if hub == nil {
+		hub = sentry.CurrentHub()
+	}
+	hub.WithScope(func(scope *sentry.Scope) {
+		scope.SetLevel(sentry.LevelWarning)
+		scope.SetTag("client_ip", ip)
+		scope.SetContext("scan_detection", sentry.Context{
+			"threshold":     d.Threshold,
+			"window":        d.Window.String(),
+			"blocked_until": expiresAt.Format(time.RFC3339),
+			"last_path":     r.URL.Path,
+		})
+		hub.CaptureMessage("Blocked a short code enumeration scanner")
+	})
+}
+
+// slowDown holds a request from a blocked scanner for Slowdown, or until the
+// client gives up.
+func (d *ScanDetector) slowDown(r *http.Request) {
+	if d == nil || d.Slowdown <= 0 {
+		return
+	}
+	select {
+	case tarpit <- struct{}{}:
+		defer func() { <-tarpit }()
+	default:
+		return
+	}
+	d.slowed.Add(1)
+	timer := time.NewTimer(d.Slowdown)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+}
@@ -0,0 +1,59 @@
+package middlewares
+
+import (
+	"M2A1-URL-Shortner/blocklist"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestScanDetectorMiddleware(t *testing.T) {
+	defaultRateLimits, defaultDetection, defaultBlocklist := RateLimits, ScanDetection, Blocklist
+	defer func() { RateLimits, ScanDetection, Blocklist = defaultRateLimits, defaultDetection, defaultBlocklist }()
+	RateLimits = NewMemoryRateLimitStore()
+	ScanDetection = &ScanDetector{Threshold: 3, Window: time.Minute, BlockFor: time.Minute, Slowdown: 20 * time.Millisecond}
+	Blocklist = blocklist.New(blocklist.NewMemoryStore())
+
+	handler := BlacklistMiddleware(ScanDetectorMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/known" {
+			http.NotFound(w, r)
+		}
+	})))
+	get := func(path, ip string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = ip + ":4000"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		if code := get("/missing", "203.0.113.9"); code != http.StatusNotFound {
+			t.Fatalf("lookup %d: got %d, want 404", i, code)
+		}
+		get("/known", "203.0.113.9")
+	}
+	if _, blocked := Blocklist.Check("", "203.0.113.9"); blocked {
+		t.Fatal("blocked at the threshold")
+	}
+	get("/missing", "203.0.113.9")
+	entry, blocked := Blocklist.Check("", "203.0.113.9")
+	if !blocked || entry.Source != blocklist.SourceScanner || entry.ExpiresAt == nil {
+		t.Fatalf("expected a temporary scanner entry, got %+v, %v", entry, blocked)
+	}
+
+	start := time.Now()
+	if code := get("/known", "203.0.113.9"); code != http.StatusForbidden {
+		t.Fatalf("got %d for a blocked scanner, want 403", code)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatal("expected the blocked scanner to be slowed down")
+	}
+	if code := get("/missing", "198.51.100.7"); code != http.StatusNotFound {
+		t.Fatalf("got %d for another client, want 404", code)
+	}
+	if stats := ScanDetection.Stats(); stats != (ScanStats{NotFound: 5, Blocked: 1, Slowed: 1}) {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,98 @@
+package middlewares
+
+import (
+	"M2A1-URL-Shortner/config"
+	"M2A1-URL-Shortner/models"
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"time"
+)
+
+// SessionCookieName is the cookie holding a browser's session.
+const SessionCookieName = "session"
+
+// CSRFHeader must carry the session's CSRF token on requests authenticated
+// by the session cookie that change anything.
+const CSRFHeader = "X-CSRF-Token"
+
+// SessionTTL is how long a login lasts. main sets it from SESSION_TTL.
+var SessionTTL = 12 * time.Hour
+
+// StartSession logs r's browser in as user: it stores a new session and
+// sets its cookie.
+func StartSession(w http.ResponseWriter, r *http.Request, user models.User) (models.Session, error) {
+	token, session, err := models.NewSession(user.ID, SessionTTL)
+	if err != nil {
+		return session, err
+	}
+	// Expired sessions of the user are dropped as they log in again.
+	config.DB.Where("user_id = ? AND expires_at < ?", user.ID, time.Now().UTC()).Delete(&models.Session{})
+	if err := config.DB.Create(&session).Error; err != nil {
+		return session, err
+	}
+	session.User = user
+	setSessionCookie(w, r, token, session.ExpiresAt)
+	return session, nil
+}
+
+// EndSession logs the caller's browser out.
+func EndSession(w http.ResponseWriter, r *http.Request, session *models.Session) error {
+	setSessionCookie(w, r, "", time.Unix(0, 0))
+	return config.DB.Delete(&models.Session{}, session.ID).Error
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string, expires time.Time) {
+	maxAge := int(time.Until(expires).Seconds())
+	if token == "" {
+		maxAge = -1
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// sessionToken returns the value of r's session cookie.
+func sessionToken(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(SessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+// ResolveSession returns the caller a session cookie authenticates. Sessions
+// have the scopes of a signup key.
+func ResolveSession(ctx context.Context, token string) (*Caller, error) {
+	session, err := config.FindSession(token)
+	if err != nil {
+		return nil, err
+	}
+	tier := session.User.Tier
+	if tier == "" {
+		tier = TierHobby
+	}
+	return &Caller{User: &session.User, Session: &session, Scopes: models.DefaultScopes, Tier: tier}, nil
+}
+
+// ValidCSRF reports whether r may go ahead on behalf of caller: requests
+// authenticated by a session cookie, which the browser adds by itself, must
+// also carry the session's CSRF token unless they only read.
+func ValidCSRF(r *http.Request, caller *Caller) bool {
+	if caller.Session == nil {
+		return true
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	token := r.Header.Get(CSRFHeader)
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(caller.Session.CSRFToken)) == 1
+}
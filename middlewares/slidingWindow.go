@@ -2,52 +2,49 @@ package middlewares
 
 import (
 	"net/http"
-	"strconv"
 	"time"
-
-	"github.com/redis/go-redis/v9"
 )
 
+// SlidingWindowScript keeps the times of the requests in the last window in
+// a sorted set. Denied requests are not recorded, so a client that keeps
+// retrying is let through again as soon as its oldest request leaves the
+// window.
+const SlidingWindowScript = `
+local key = KEYS[1]
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local member = ARGV[4]
+
+redis.call("ZREMRANGEBYSCORE", key, "-inf", now - window)
+local count = redis.call("ZCARD", key)
+local allowed = 0
+if count < limit then
+  redis.call("ZADD", key, now, member)
+  redis.call("PEXPIRE", key, window)
+  count = count + 1
+  allowed = 1
+end
+
+local reset = window
+local oldest = redis.call("ZRANGE", key, 0, 0, "WITHSCORES")
+if oldest[2] then
+  reset = tonumber(oldest[2]) + window - now
+end
+if allowed == 1 then
+  return {1, limit - count, reset, 0}
+end
+return {0, 0, reset, reset}
+`
+
 func SlidingWindowMiddleware(maxRequests int, windowDuration time.Duration) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ip := getIPAddress(r)
+			ip := ClientIP(r)
 			key := "rate:sliding:" + ip + ":" + r.URL.Path
 
-			ctx := RateLimitRedisStore.Ctx
-
-			now := time.Now().UnixNano() / 1e6
-			windowStart := now - int64(windowDuration/time.Millisecond)
-
-			// Add current timestamp to the sorted set.
-			_, err := RateLimitRedisStore.Client.ZAdd(ctx, key, redis.Z{
-				Score:  float64(now),
-				Member: strconv.FormatInt(now, 10),
-			}).Result()
-			if err != nil {
-				next.ServeHTTP(w, r)
-				return
-			}
-			// Remove old entries.
-			RateLimitRedisStore.Client.ZRemRangeByScore(ctx, key, "0", strconv.FormatInt(windowStart, 10))
-
-			// Get the current count.
-			count, err := RateLimitRedisStore.Client.ZCard(ctx, key).Result()
-			if err != nil {
-				next.ServeHTTP(w, r)
-				return
-			}
-			// Optionally, set an expiry on the key.
-			RateLimitRedisStore.Client.Expire(ctx, key, windowDuration*2)
-
-			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(maxRequests))
-			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(maxRequests-int(count)))
-			// For sliding window, you can set reset header as the window duration.
-			w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(windowDuration.Seconds())))
-
-			if count > int64(maxRequests) {
-				w.WriteHeader(http.StatusTooManyRequests)
-				w.Write([]byte("Rate limit exceeded. Try again later."))
+			if !checkRateLimit(w, r, key, AlgorithmSlidingWindow, RateLimit{Requests: maxRequests, Window: windowDuration}) {
+				http.Error(w, "Rate limit exceeded. Try again later.", http.StatusTooManyRequests)
 				return
 			}
 
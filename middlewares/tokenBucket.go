@@ -2,17 +2,18 @@ package middlewares
 
 import (
 	"net/http"
-	"strconv"
 	"time"
 )
 
-// TokenBucketScript is a Lua script for token bucket rate limiting.
+// TokenBucketScript is a Lua script for token bucket rate limiting. The
+// bucket holds up to ARGV[1] tokens and refills completely over ARGV[2]
+// milliseconds; each request takes one.
 const TokenBucketScript = `
 local key = KEYS[1]
 local capacity = tonumber(ARGV[1])
-local refillRate = tonumber(ARGV[2])
+local window = tonumber(ARGV[2])
 local now = tonumber(ARGV[3])
-local requested = tonumber(ARGV[4])
+local refillRate = capacity / window
 
 local bucket = redis.call("HMGET", key, "tokens", "last_refill")
 local tokens = tonumber(bucket[1])
@@ -22,46 +23,33 @@ if tokens == nil then
   last_refill = now
 end
 
-local delta = now - last_refill
-local refill = delta * refillRate
-tokens = math.min(capacity, tokens + refill)
-if tokens < requested then
-  return -1
+local delta = math.max(0, now - last_refill)
+tokens = math.min(capacity, tokens + delta * refillRate)
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
 else
-  tokens = tokens - requested
-  redis.call("HMSET", key, "tokens", tokens, "last_refill", now)
-  redis.call("EXPIRE", key, 3600)
-  return tokens
+  retry = math.ceil((1 - tokens) / refillRate)
 end
+redis.call("HSET", key, "tokens", tokens, "last_refill", now)
+redis.call("PEXPIRE", key, window)
+return {allowed, math.floor(tokens), math.ceil((capacity - tokens) / refillRate), retry}
 `
 
 // TokenBucketMiddleware returns a middleware using token bucket algorithm.
 // capacity: maximum tokens, refillRate: tokens per millisecond.
 func TokenBucketMiddleware(capacity int, refillRate float64) func(http.Handler) http.Handler {
+	window := time.Duration(float64(capacity) / refillRate * float64(time.Millisecond))
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ip := getIPAddress(r)
+			ip := ClientIP(r)
 			key := "rate:token:" + ip + ":" + r.URL.Path
-			ctx := RateLimitRedisStore.Ctx
-			now := time.Now().UnixNano() / 1e6 // current time in milliseconds
-			// requested tokens: 1 per request.
-			res, err := RateLimitRedisStore.Client.Eval(ctx, TokenBucketScript, []string{key},
-				capacity, refillRate, now, 1).Result()
-			if err != nil {
-				next.ServeHTTP(w, r)
+			if !checkRateLimit(w, r, key, AlgorithmTokenBucket, RateLimit{Requests: capacity, Window: window}) {
+				http.Error(w, "Rate limit exceeded. Try again later.", http.StatusTooManyRequests)
 				return
 			}
-			tokensLeft, ok := res.(int64)
-			if !ok || tokensLeft < 0 {
-				w.WriteHeader(http.StatusTooManyRequests)
-				w.Write([]byte("Rate limit exceeded. Try again later."))
-				return
-			}
-			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(capacity))
-			w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(tokensLeft, 10))
-			// For token bucket, reset can be computed roughly from tokens refilled per second.
-			// For simplicity, we can send a fixed value.
-			w.Header().Set("X-RateLimit-Reset", "1")
 			next.ServeHTTP(w, r)
 		})
 	}
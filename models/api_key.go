@@ -0,0 +1,106 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"time"
+)
+
+// apiKeyMarker starts every API key issued by the service, so leaked keys
+// are easy to recognise.
+const apiKeyMarker = "usk_"
+
+// Scopes an API key can be limited to.
+const (
+	ScopeLinksCreate   = "links:create"
+	ScopeLinksRead     = "links:read"
+	ScopeLinksWrite    = "links:write"
+	ScopeLinksDelete   = "links:delete"
+	ScopeAnalyticsRead = "analytics:read"
+	ScopeKeysManage    = "keys:manage"
+	ScopeAdmin         = "admin"
+)
+
+// AllScopes lists every scope.
+var AllScopes = []string{ScopeLinksCreate, ScopeLinksRead, ScopeLinksWrite, ScopeLinksDelete, ScopeAnalyticsRead, ScopeKeysManage, ScopeAdmin}
+
+// DefaultScopes are given to keys issued without a list of scopes: all but
+// admin, which is what a key could do before keys had scopes.
+var DefaultScopes = []string{ScopeLinksCreate, ScopeLinksRead, ScopeLinksWrite, ScopeLinksDelete, ScopeAnalyticsRead, ScopeKeysManage}
+
+// IsValidScope reports whether scope is one of AllScopes.
+func IsValidScope(scope string) bool {
+	return slices.Contains(AllScopes, scope)
+}
+
+// APIKey is an API key of a user. Only its hash is stored; the key itself is
+// shown once, when it is issued.
+type APIKey struct {
+	ID     uint     `gorm:"primaryKey" json:"id"`
+	UserID uint     `gorm:"index;not null" json:"-"`
+	Name   string   `json:"name"`
+	Prefix string   `gorm:"not null" json:"prefix"` // start of the key, to tell keys apart
+	Hash   string   `gorm:"uniqueIndex;not null" json:"-"`
+	Scopes []string `gorm:"serializer:json" json:"scopes"` // nil for keys from before scopes; see GrantedScopes
+	// ExpiresAt is when the key stops working: set when it is issued, or
+	// at the end of the grace period when it is rotated.
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"` // to the minute
+	CreatedAt  time.Time  `json:"created_at"`
+	User       User       `gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
+}
+
+// NewAPIKey generates a key for user. It returns the key, to hand to the
+// user, and the record to store.
+func NewAPIKey(userID uint, name string, scopes []string) (string, APIKey, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", APIKey{}, err
+	}
+	key := apiKeyMarker + base64.RawURLEncoding.EncodeToString(secret)
+	return key, APIKey{UserID: userID, Name: name, Prefix: APIKeyPrefix(key), Hash: HashAPIKey(key), Scopes: scopes}, nil
+}
+
+// HashAPIKey returns the hash keys are stored and looked up by. Keys are
+// random enough that a fast hash is safe, and it lets lookups use an index.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeyPrefix returns the part of key that may be shown to identify it:
+// the marker and 8 characters of an issued key, or the first 4 characters
+// of a key from before keys were issued.
+func APIKeyPrefix(key string) string {
+	if strings.HasPrefix(key, apiKeyMarker) && len(key) > len(apiKeyMarker)+8 {
+		return key[:len(apiKeyMarker)+8]
+	}
+	if len(key) > 8 {
+		return key[:4]
+	}
+	return ""
+}
+
+// Active reports whether the key can be used at now.
+func (k APIKey) Active(now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+// GrantedScopes returns the key's scopes, DefaultScopes for keys from
+// before scopes.
+func (k APIKey) GrantedScopes() []string {
+	if k.Scopes == nil {
+		return DefaultScopes
+	}
+	return k.Scopes
+}
+
+// HasScope reports whether the key grants scope.
+func (k APIKey) HasScope(scope string) bool {
+	return slices.Contains(k.GrantedScopes(), scope)
+}
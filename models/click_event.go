@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// ClickEvent records a single resolution of a short code.
+type ClickEvent struct {
+	ID             uint   `gorm:"primaryKey"`
+	URLShortenerID uint   `gorm:"index"`
+	ShortCode      string `gorm:"index;not null"`
+	Referrer       string
+	UserAgent      string
+	Device         string
+	OS             string
+	Browser        string
+	IPAddress      string    // anonymised, see utils.AnonymizeIP
+	CreatedAt      time.Time `gorm:"index"`
+}
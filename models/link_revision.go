@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// Actions recorded in LinkRevision.Action.
+const (
+	RevisionCreate   = "create"
+	RevisionUpdate   = "update"
+	RevisionRollback = "rollback"
+	RevisionDelete   = "delete"
+)
+
+// LinkRevision records one change to a link. Revisions are numbered from 1
+// per link.
+type LinkRevision struct {
+	ID             uint   `gorm:"primaryKey"`
+	URLShortenerID uint   `gorm:"uniqueIndex:idx_link_revision;not null"`
+	Revision       uint   `gorm:"uniqueIndex:idx_link_revision;not null"`
+	ShortCode      string `gorm:"index;not null"`
+	Action         string `gorm:"not null"`
+	UserID         uint   // who made the change
+	RollbackOf     *uint  // the revision restored by a rollback
+	Changes        string `gorm:"type:text"` // JSON of field -> {old, new}, passwords masked
+	Snapshot       string `gorm:"type:text"` // JSON of the link after the change, for rollbacks
+	CreatedAt      time.Time
+}
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MaxPasswordLength is the longest password bcrypt can hash.
+const MaxPasswordLength = 72
+
+// ErrPasswordTooLong is returned by HashPassword for passwords over
+// MaxPasswordLength bytes.
+var ErrPasswordTooLong = errors.New("password must be at most 72 bytes")
+
+// HashPassword returns the bcrypt hash of a link password.
+func HashPassword(password string) (string, error) {
+	if len(password) > MaxPasswordLength {
+		return "", ErrPasswordTooLong
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// IsPasswordHash reports whether stored looks like a bcrypt hash rather than
+// a plaintext password saved before hashing was introduced.
+func IsPasswordHash(stored string) bool {
+	return len(stored) == 60 && (strings.HasPrefix(stored, "$2a$") ||
+		strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$"))
+}
+
+// CheckPassword reports whether password unlocks the link. Links without a
+// password accept anything. Plaintext values, from rows or cache entries that
+// predate hashing, are compared in constant time until they are rehashed.
+func (u *URLShortener) CheckPassword(password string) bool {
+	if u.Password == nil {
+		return true
+	}
+	if IsPasswordHash(*u.Password) {
+		return bcrypt.CompareHashAndPassword([]byte(*u.Password), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(*u.Password), []byte(password)) == 1
+}
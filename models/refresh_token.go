@@ -0,0 +1,53 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"time"
+)
+
+// refreshTokenMarker starts every refresh token, so they are not mistaken
+// for API keys.
+const refreshTokenMarker = "usr_"
+
+// RefreshToken can be exchanged once for a new access token and a new
+// refresh token of the same family. Only its hash is stored.
+type RefreshToken struct {
+	ID        uint     `gorm:"primaryKey"`
+	UserID    uint     `gorm:"index;not null"`
+	APIKeyID  *uint    `gorm:"index"` // key the family was issued for, if any
+	FamilyID  string   `gorm:"index;not null"`
+	Hash      string   `gorm:"uniqueIndex;not null"`
+	Scopes    []string `gorm:"serializer:json"`
+	ExpiresAt time.Time
+	// UsedAt is set when the token is exchanged; a token used twice has
+	// leaked, and its family is revoked.
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+	CreatedAt time.Time
+	User      User `gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
+
+// NewRefreshToken generates a refresh token of family for user, valid for
+// ttl. It returns the token, to hand to the client, and the record to store.
+func NewRefreshToken(userID uint, apiKeyID *uint, family string, scopes []string, ttl time.Duration) (string, RefreshToken, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", RefreshToken{}, err
+	}
+	token := refreshTokenMarker + base64.RawURLEncoding.EncodeToString(secret)
+	record := RefreshToken{
+		UserID:    userID,
+		APIKeyID:  apiKeyID,
+		FamilyID:  family,
+		Hash:      HashAPIKey(token),
+		Scopes:    scopes,
+		ExpiresAt: time.Now().Add(ttl).UTC(),
+	}
+	return token, record, nil
+}
+
+// Usable reports whether the token can be exchanged at now.
+func (t RefreshToken) Usable(now time.Time) bool {
+	return t.UsedAt == nil && t.RevokedAt == nil && now.Before(t.ExpiresAt)
+}
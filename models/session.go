@@ -0,0 +1,40 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"time"
+)
+
+// Session is a browser login, identified by the session cookie. Only the
+// cookie's hash is stored; CSRFToken must accompany requests that change
+// anything.
+type Session struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"index;not null"`
+	Hash      string `gorm:"uniqueIndex;not null"`
+	CSRFToken string `gorm:"not null"`
+	ExpiresAt time.Time
+	CreatedAt time.Time
+	User      User `gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
+
+// NewSession generates a session for user, valid for ttl. It returns the
+// cookie value, to hand to the browser, and the record to store.
+func NewSession(userID uint, ttl time.Duration) (string, Session, error) {
+	var values [2]string
+	for i := range values {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return "", Session{}, err
+		}
+		values[i] = base64.RawURLEncoding.EncodeToString(b)
+	}
+	session := Session{
+		UserID:    userID,
+		Hash:      HashAPIKey(values[0]),
+		CSRFToken: values[1],
+		ExpiresAt: time.Now().Add(ttl).UTC(),
+	}
+	return values[0], session, nil
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// SigningKey is a key access tokens are signed with. Keys are kept in the
+// database so every instance signs and verifies with the same ones; see
+// package tokens.
+type SigningKey struct {
+	ID         string    `gorm:"primaryKey"` // the kid of the tokens it signs
+	PrivateKey []byte    `gorm:"not null"`   // PKCS #8, DER encoded
+	CreatedAt  time.Time `gorm:"index"`
+}
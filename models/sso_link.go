@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// SSOLink is a link of a user to their identity at the identity provider,
+// started by the user and finished by the provider's callback. Only the hash
+// of the login's state is stored.
+type SSOLink struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"index;not null"`
+	StateHash string `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time
+	CreatedAt time.Time
+	User      User `gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
@@ -2,19 +2,42 @@ package models
 
 import "time"
 
+// Supported values for URLShortener.RedirectType.
+const (
+	RedirectMovedPermanently = "301"
+	RedirectFound            = "302"
+	RedirectTemporary        = "307"
+	RedirectPermanent        = "308"
+	RedirectMetaRefresh      = "meta_refresh"
+	RedirectJavaScript       = "javascript"
+)
+
 // Define the URLShortener model
 type URLShortener struct {
-	ID             uint   `gorm:"primaryKey"`
-	OriginalURL    string `gorm:"size:2083;not null"`
-	ShortCode      string `gorm:"unique;not null"`
-	HitCount       uint   `gorm:"default:0"`
-	ShortenCount   uint   `gorm:"default:1"`
-	CreatedAt      time.Time
-	ApiKey         string
-	Password       *string `json:"password,omitempty"`
+	ID           uint   `gorm:"primaryKey"`
+	OriginalURL  string `gorm:"size:2083;not null"`
+	ShortCode    string `gorm:"unique;not null"`
+	HitCount     uint   `gorm:"default:0"`
+	ShortenCount uint   `gorm:"default:1"`
+	CreatedAt    time.Time
+	ApiKey       string
+	// Password is the bcrypt hash of the link password. It is never
+	// serialized to API clients; see HashPassword and CheckPassword.
+	Password       *string `json:"-"`
+	RedirectType   string  `gorm:"default:'302'"`
 	ExpiredAt      *time.Time
 	LastAccessedAt *time.Time
 	DeletedAt      *time.Time
 	UserID         uint
 	User           User `gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
 }
+
+// IsValidRedirectType reports whether t is one of the supported redirect types.
+func IsValidRedirectType(t string) bool {
+	switch t {
+	case RedirectMovedPermanently, RedirectFound, RedirectTemporary, RedirectPermanent,
+		RedirectMetaRefresh, RedirectJavaScript:
+		return true
+	}
+	return false
+}
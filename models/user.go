@@ -6,9 +6,14 @@ type User struct {
 	ID         uint `gorm:"primaryKey;autoIncrement"`
 	Email      string
 	Name       string
-	ApiKey     string  `gorm:"unique"`
+	ApiKey     string  `gorm:"unique;default:null" json:"-"` // plaintext key from before hashing; see config.HashPlaintextAPIKeys
 	Tier       string  `gorm:"default:'hobby';check: tier IN ('hobby', 'enterprise')"`
 	ProfileImg *[]byte `gorm:"type:blob"`
 	Thumbnail  *[]byte `gorm:"type:blob"`
 	CreatedAt  time.Time
+
+	// OIDCIssuer and OIDCSubject identify users who sign in with single
+	// sign-on; both are NULL for the others.
+	OIDCIssuer  *string `gorm:"column:oidc_issuer;uniqueIndex:idx_users_oidc;default:null" json:"-"`
+	OIDCSubject *string `gorm:"column:oidc_subject;uniqueIndex:idx_users_oidc;default:null" json:"-"`
 }
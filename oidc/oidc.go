@@ -0,0 +1,337 @@
+// Package oidc signs users in with an OpenID Connect provider, using the
+// authorization code flow with PKCE. The ID token returned by the provider
+// is verified with the provider's published keys.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidIDToken is returned by Exchange for ID tokens that are
+// malformed, badly signed, meant for another client or login, or expired.
+var ErrInvalidIDToken = errors.New("invalid ID token")
+
+const (
+	// leeway allows for clocks that are slightly apart.
+	leeway = time.Minute
+	// minKeyRefresh limits how often an ID token signed by an unknown key
+	// makes the provider's keys be fetched again.
+	minKeyRefresh = 10 * time.Second
+)
+
+// Identity is who the provider says signed in.
+type Identity struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// Provider is an OpenID Connect provider this service is registered with as
+// a client.
+type Provider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string // empty for public clients, which rely on PKCE alone
+	RedirectURL  string
+	Scopes       []string
+
+	AuthURL  string
+	TokenURL string
+	JWKSURL  string
+
+	client    *http.Client
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	lastFetch time.Time
+}
+
+// Discover reads the provider's configuration from
+// <issuer>/.well-known/openid-configuration.
+func Discover(ctx context.Context, issuer, clientID, clientSecret, redirectURL string, scopes []string) (*Provider, error) {
+	p := &Provider{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       scopes,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+	var config struct {
+		Issuer   string `json:"issuer"`
+		AuthURL  string `json:"authorization_endpoint"`
+		TokenURL string `json:"token_endpoint"`
+		JWKSURL  string `json:"jwks_uri"`
+	}
+	if err := p.getJSON(ctx, p.Issuer+"/.well-known/openid-configuration", &config); err != nil {
+		return nil, fmt.Errorf("reading the provider configuration: %w", err)
+	}
+	if strings.TrimSuffix(config.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("the provider reports issuer %q, not %q", config.Issuer, p.Issuer)
+	}
+	if config.AuthURL == "" || config.TokenURL == "" || config.JWKSURL == "" {
+		return nil, errors.New("the provider configuration lacks an endpoint")
+	}
+	p.Issuer = config.Issuer
+	p.AuthURL, p.TokenURL, p.JWKSURL = config.AuthURL, config.TokenURL, config.JWKSURL
+	if !slices.Contains(p.Scopes, "openid") {
+		p.Scopes = append([]string{"openid"}, p.Scopes...)
+	}
+	return p, nil
+}
+
+// Login is the state of a login in progress. It is kept by the client
+// between AuthCodeURL and Exchange.
+type Login struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"` // PKCE code verifier
+}
+
+// NewLogin returns a Login with fresh random values.
+func NewLogin() (Login, error) {
+	var values [3]string
+	for i := range values {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return Login{}, err
+		}
+		values[i] = base64.RawURLEncoding.EncodeToString(b)
+	}
+	return Login{State: values[0], Nonce: values[1], Verifier: values[2]}, nil
+}
+
+// Challenge returns the S256 PKCE challenge of verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns where to send the user to sign in.
+func (p *Provider) AuthCodeURL(login Login) string {
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {login.State},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {Challenge(login.Verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		separator = "&"
+	}
+	return p.AuthURL + separator + query.Encode()
+}
+
+// Exchange redeems the code the provider redirected back with, and returns
+// the identity of its verified ID token.
+func (p *Provider) Exchange(ctx context.Context, code string, login Login) (Identity, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"client_id":     {p.ClientID},
+		"code_verifier": {login.Verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Identity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return Identity{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return Identity{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Identity{}, fmt.Errorf("the provider refused the code: %d %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil || tokens.IDToken == "" {
+		return Identity{}, errors.New("the provider returned no ID token")
+	}
+	return p.Verify(ctx, tokens.IDToken, login.Nonce, time.Now())
+}
+
+// idClaims are the claims of an ID token this package reads.
+type idClaims struct {
+	Issuer        string      `json:"iss"`
+	Subject       string      `json:"sub"`
+	Audience      audience    `json:"aud"`
+	AuthorizedBy  string      `json:"azp"`
+	ExpiresAt     int64       `json:"exp"`
+	IssuedAt      int64       `json:"iat"`
+	Nonce         string      `json:"nonce"`
+	Email         string      `json:"email"`
+	EmailVerified interface{} `json:"email_verified"` // some providers send "true"
+	Name          string      `json:"name"`
+}
+
+// audience is the aud claim, a string or an array of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if json.Unmarshal(data, &one) == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// Verify checks an ID token's signature, issuer, audience, expiry and nonce
+// and returns the identity it asserts.
+func (p *Provider) Verify(ctx context.Context, idToken, nonce string, now time.Time) (Identity, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return Identity{}, ErrInvalidIDToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJSON(parts[0], &header); err != nil || header.Alg != "RS256" {
+		return Identity{}, ErrInvalidIDToken
+	}
+	public := p.publicKey(ctx, header.Kid, now)
+	if public == nil {
+		return Identity{}, ErrInvalidIDToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, ErrInvalidIDToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature) != nil {
+		return Identity{}, ErrInvalidIDToken
+	}
+
+	var claims idClaims
+	if err := decodeJSON(parts[1], &claims); err != nil {
+		return Identity{}, ErrInvalidIDToken
+	}
+	switch {
+	case claims.Issuer != p.Issuer, claims.Subject == "":
+		return Identity{}, ErrInvalidIDToken
+	case !slices.Contains(claims.Audience, p.ClientID):
+		return Identity{}, ErrInvalidIDToken
+	case len(claims.Audience) > 1 && claims.AuthorizedBy != p.ClientID:
+		return Identity{}, ErrInvalidIDToken
+	case !now.Before(time.Unix(claims.ExpiresAt, 0).Add(leeway)), time.Unix(claims.IssuedAt, 0).After(now.Add(leeway)):
+		return Identity{}, ErrInvalidIDToken
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return Identity{}, ErrInvalidIDToken
+	}
+	verified := claims.EmailVerified == true || claims.EmailVerified == "true"
+	return Identity{Issuer: claims.Issuer, Subject: claims.Subject, Email: claims.Email, EmailVerified: verified, Name: claims.Name}, nil
+}
+
+// publicKey returns the provider's key with id, fetching the keys again
+// when it is unknown, as after the provider rotated them.
+func (p *Provider) publicKey(ctx context.Context, id string, now time.Time) *rsa.PublicKey {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[id]; ok {
+		return key
+	}
+	if now.Sub(p.lastFetch) < minKeyRefresh {
+		return nil
+	}
+	p.lastFetch = now
+	keys, err := p.fetchKeys(ctx)
+	if err != nil {
+		fmt.Printf("Error fetching the identity provider's keys: %v\n", err)
+		return nil
+	}
+	p.keys = keys
+	return p.keys[id]
+}
+
+func (p *Provider) fetchKeys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.JWKSURL, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func decodeJSON(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,76 @@
+package oidc_test
+
+import (
+	"M2A1-URL-Shortner/oidc"
+	"M2A1-URL-Shortner/oidc/oidctest"
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestLogin(t *testing.T) {
+	ctx := context.Background()
+	idp := oidctest.NewServer("shortener", "https://short.example/auth/oidc/callback")
+	defer idp.Close()
+	idp.SetUser(oidc.Identity{Subject: "u-1", Email: "ada@example.com", EmailVerified: true, Name: "Ada"})
+
+	provider, err := oidc.Discover(ctx, idp.URL+"/", "shortener", "", idp.RedirectURL, []string{"email", "profile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// authorize follows the provider's redirect and returns the code it
+	// sends back to the service.
+	authorize := func(login oidc.Login) string {
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		resp, err := client.Get(provider.AuthCodeURL(login))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		back, _ := url.Parse(resp.Header.Get("Location"))
+		if back.Query().Get("state") != login.State || back.Query().Get("code") == "" {
+			t.Fatalf("Expected a code and the state back, got %s", back)
+		}
+		return back.Query().Get("code")
+	}
+
+	login, _ := oidc.NewLogin()
+	code := authorize(login)
+	identity, err := provider.Exchange(ctx, code, login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Issuer != idp.URL || identity.Subject != "u-1" || identity.Email != "ada@example.com" || !identity.EmailVerified {
+		t.Fatalf("Unexpected identity %+v", identity)
+	}
+	if _, err := provider.Exchange(ctx, code, login); err == nil {
+		t.Fatal("Expected a used code to be refused")
+	}
+
+	// The code is bound to the verifier, and the ID token to the nonce.
+	other, _ := oidc.NewLogin()
+	if _, err := provider.Exchange(ctx, authorize(login), other); err == nil {
+		t.Fatal("Expected another login's verifier to be refused")
+	}
+	stolen := login
+	stolen.Nonce = other.Nonce
+	if _, err := provider.Exchange(ctx, authorize(login), stolen); err != oidc.ErrInvalidIDToken {
+		t.Fatalf("Expected another login's nonce to be refused, got %v", err)
+	}
+
+	now := time.Now()
+	claims := func(aud interface{}, exp time.Time) map[string]interface{} {
+		return map[string]interface{}{"iss": idp.URL, "sub": "u-1", "aud": aud, "iat": now.Unix(), "exp": exp.Unix(), "nonce": login.Nonce}
+	}
+	if _, err := provider.Verify(ctx, idp.Sign(claims([]string{"someone-else", "shortener"}, now.Add(time.Minute))), login.Nonce, now); err != oidc.ErrInvalidIDToken {
+		t.Fatalf("Expected a token with another authorized party to be refused, got %v", err)
+	}
+	if _, err := provider.Verify(ctx, idp.Sign(claims("shortener", now.Add(-2*time.Minute))), login.Nonce, now); err != oidc.ErrInvalidIDToken {
+		t.Fatalf("Expected an expired token to be refused, got %v", err)
+	}
+	if _, err := provider.Verify(ctx, idp.Sign(claims("someone-else", now.Add(time.Minute))), login.Nonce, now); err != oidc.ErrInvalidIDToken {
+		t.Fatalf("Expected a token for another client to be refused, got %v", err)
+	}
+}
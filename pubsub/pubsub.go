@@ -5,22 +5,44 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sync"
 )
 
+// EventsChannel is the Redis channel events are published on, before the
+// store's key prefix.
+const EventsChannel = "events"
+
 type HandlerFunc func(data map[string]interface{})
 
+// PubSub delivers events over Redis, or within this process when it was
+// created by NewLocalPubSub.
 type PubSub struct {
 	redisStore *cache.RedisStore
+
+	mu          sync.RWMutex
+	subscribers map[string][]HandlerFunc
 }
 
 func NewPubSub(redisStore *cache.RedisStore) *PubSub {
 	return &PubSub{redisStore: redisStore}
 }
 
+// NewLocalPubSub returns a PubSub that only delivers events published by this
+// process, for running without Redis.
+func NewLocalPubSub() *PubSub {
+	return &PubSub{subscribers: make(map[string][]HandlerFunc)}
+}
+
 // Subscribe to an event
 func (ps *PubSub) Subscribe(event string, handler HandlerFunc) {
+	if ps.redisStore == nil {
+		ps.mu.Lock()
+		ps.subscribers[event] = append(ps.subscribers[event], handler)
+		ps.mu.Unlock()
+		return
+	}
 	go func() {
-		sub := ps.redisStore.Client.Subscribe(ps.redisStore.Ctx, "events")
+		sub := ps.redisStore.Client.Subscribe(ps.redisStore.Ctx, ps.redisStore.Key(EventsChannel))
 		ch := sub.Channel()
 
 		for msg := range ch {
@@ -51,7 +73,29 @@ func (ps *PubSub) Publish(event string, data map[string]interface{}) error {
 		return err
 	}
 
-	return ps.redisStore.Client.Publish(context.Background(), "events", bytes).Err()
+	if ps.redisStore == nil {
+		return ps.publishLocal(event, bytes)
+	}
+	return ps.redisStore.Client.Publish(context.Background(), ps.redisStore.Key(EventsChannel), bytes).Err()
+}
+
+// publishLocal runs the subscribers of event asynchronously, like the Redis
+// subscriber goroutines. Each one gets its own copy of the data decoded from
+// JSON, so handlers see the same types either way.
+func (ps *PubSub) publishLocal(event string, payload []byte) error {
+	ps.mu.RLock()
+	handlers := ps.subscribers[event]
+	ps.mu.RUnlock()
+	for _, handler := range handlers {
+		var decoded struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		if err := json.Unmarshal(payload, &decoded); err != nil {
+			return err
+		}
+		go handler(decoded.Data)
+	}
+	return nil
 }
 
 // func (ps *PubSub) StartWorker() {
@@ -10,7 +10,7 @@ import (
 
 func SubscribeToEvent(redisStore *cache.RedisStore, eventName string, handler HandlerFunc) {
 	go func() {
-		sub := redisStore.Client.Subscribe(redisStore.Ctx, "events")
+		sub := redisStore.Client.Subscribe(redisStore.Ctx, redisStore.Key(EventsChannel))
 		ch := sub.Channel()
 
 		for msg := range ch {
@@ -0,0 +1,249 @@
+// Package shortcode generates short codes for links.
+package shortcode
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/bits"
+	mathrand "math/rand/v2"
+	"strings"
+	"sync/atomic"
+)
+
+// Alphabets for generated codes. Only characters allowed in the GET /{code}
+// route may be used.
+const (
+	// Base62 is every ASCII letter and digit.
+	Base62 = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+	// Unambiguous is Base62 without characters that are easily confused
+	// when read or typed: 0/O/o, 1/l/I/i.
+	Unambiguous = "ABCDEFGHJKLMNPQRSTUVWXYZabcdefghjkmnpqrstuvwxyz23456789"
+)
+
+// CodeGenerator produces candidate short codes. Codes are not guaranteed to be
+// free; callers must handle collisions with existing codes.
+type CodeGenerator interface {
+	// Generate returns a code of at least length characters.
+	Generate(length int) (string, error)
+}
+
+// ValidateAlphabet checks that alphabet has at least two distinct characters,
+// all of them safe to use in a URL path segment.
+func ValidateAlphabet(alphabet string) error {
+	if len(alphabet) < 2 {
+		return errors.New("alphabet must have at least 2 characters")
+	}
+	seen := make(map[rune]bool, len(alphabet))
+	for _, c := range alphabet {
+		if !strings.ContainsRune(Base62+"_-", c) {
+			return fmt.Errorf("alphabet contains unsupported character %q", c)
+		}
+		if seen[c] {
+			return fmt.Errorf("alphabet contains %q more than once", c)
+		}
+		seen[c] = true
+	}
+	return nil
+}
+
+// RandomGenerator draws every character uniformly from its alphabet using
+// crypto/rand.
+type RandomGenerator struct {
+	alphabet string
+}
+
+// NewRandomGenerator returns a RandomGenerator over alphabet.
+func NewRandomGenerator(alphabet string) (*RandomGenerator, error) {
+	if err := ValidateAlphabet(alphabet); err != nil {
+		return nil, err
+	}
+	return &RandomGenerator{alphabet: alphabet}, nil
+}
+
+// Generate returns a random code of exactly length characters.
+func (g *RandomGenerator) Generate(length int) (string, error) {
+	size := len(g.alphabet)
+	// Reject bytes above the largest multiple of size so every character is
+	// equally likely.
+	limit := 256 - 256%size
+	code := make([]byte, 0, length)
+	buf := make([]byte, length+length/2+1)
+	for len(code) < length {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			if int(b) >= limit {
+				continue
+			}
+			code = append(code, g.alphabet[int(b)%size])
+			if len(code) == length {
+				break
+			}
+		}
+	}
+	return string(code), nil
+}
+
+// CounterGenerator encodes values from an increasing sequence, so codes are
+// unique by construction, and scrambles them so consecutive values do not
+// produce similar looking codes. The encoding is a bijection over the
+// keyspace of each length, in the spirit of Hashids/Sqids.
+type CounterGenerator struct {
+	alphabet string
+	salt     uint64
+	next     func() (uint64, error)
+}
+
+// multiplier is a prime larger than any alphabet, so it is coprime with every
+// keyspace size and multiplying by it permutes the keyspace.
+const multiplier = 1_000_000_007
+
+// NewCounterGenerator returns a CounterGenerator drawing values from next.
+// The alphabet is shuffled with salt, so different salts give different codes
+// for the same sequence.
+func NewCounterGenerator(alphabet string, salt uint64, next func() (uint64, error)) (*CounterGenerator, error) {
+	if err := ValidateAlphabet(alphabet); err != nil {
+		return nil, err
+	}
+	shuffled := []byte(alphabet)
+	rng := mathrand.New(mathrand.NewPCG(salt, salt^0x9e3779b97f4a7c15))
+	rng.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return &CounterGenerator{alphabet: string(shuffled), salt: salt, next: next}, nil
+}
+
+// NewSequence returns an in-process sequence starting at start.
+func NewSequence(start uint64) func() (uint64, error) {
+	var counter atomic.Uint64
+	counter.Store(start)
+	return func() (uint64, error) {
+		return counter.Add(1) - 1, nil
+	}
+}
+
+// Generate encodes the next value of the sequence in at least length
+// characters, using more when the keyspace at length is too small to hold it.
+func (g *CounterGenerator) Generate(length int) (string, error) {
+	n, err := g.next()
+	if err != nil {
+		return "", err
+	}
+	size := uint64(len(g.alphabet))
+
+	space, ok := keyspace(size, length)
+	for ok && n >= space {
+		length++
+		space, ok = keyspace(size, length)
+	}
+	if !ok {
+		return "", fmt.Errorf("counter %d does not fit in a %d character code", n, length)
+	}
+
+	// Affine permutation of the keyspace: x = (n*multiplier + salt) mod space.
+	hi, lo := bits.Mul64(n, multiplier)
+	x := bits.Rem64(hi, lo, space)
+	x = (x + g.salt%space) % space
+
+	digits := make([]uint64, length)
+	for i := length - 1; i >= 0; i-- {
+		digits[i] = x % size
+		x /= size
+	}
+	// Spread every digit into all the others with a forward and a backward
+	// running sum. Both passes are invertible, so the mapping stays a
+	// bijection.
+	for i := 1; i < length; i++ {
+		digits[i] = (digits[i] + digits[i-1]) % size
+	}
+	for i := length - 2; i >= 0; i-- {
+		digits[i] = (digits[i] + digits[i+1]) % size
+	}
+
+	code := make([]byte, length)
+	for i, d := range digits {
+		code[i] = g.alphabet[d]
+	}
+	return string(code), nil
+}
+
+// keyspace returns size^length, reporting false if it overflows uint64.
+func keyspace(size uint64, length int) (uint64, bool) {
+	space := uint64(1)
+	for i := 0; i < length; i++ {
+		hi, lo := bits.Mul64(space, size)
+		if hi != 0 {
+			return 0, false
+		}
+		space = lo
+	}
+	return space, true
+}
+
+// Length tracks how long generated codes should be. It grows by one character
+// whenever growAfter consecutive generated codes collide with existing ones,
+// a sign that the keyspace at the current length is getting crowded.
+type Length struct {
+	current   atomic.Int64
+	streak    atomic.Int64
+	growAfter int64
+	max       int64
+}
+
+// NewLength starts at min characters and never grows beyond max.
+func NewLength(min, growAfter, max int) *Length {
+	l := &Length{growAfter: int64(growAfter), max: int64(max)}
+	l.current.Store(int64(min))
+	return l
+}
+
+// Current returns the length to generate codes with.
+func (l *Length) Current() int {
+	return int(l.current.Load())
+}
+
+// Collided records that a code of length current was already taken.
+func (l *Length) Collided(current int) {
+	if l.streak.Add(1) < l.growAfter {
+		return
+	}
+	l.streak.Store(0)
+	if int64(current) < l.max {
+		// Only one of several concurrent observers of the same crowded
+		// length gets to grow it.
+		l.current.CompareAndSwap(int64(current), int64(current)+1)
+	}
+}
+
+// Succeeded records that a generated code was free.
+func (l *Length) Succeeded() {
+	l.streak.Store(0)
+}
+
+// ResolveAlphabet maps the names "base62" and "unambiguous" to their
+// alphabets; any other non-empty value is used as a literal alphabet.
+func ResolveAlphabet(name string) string {
+	switch strings.ToLower(name) {
+	case "", "base62":
+		return Base62
+	case "unambiguous":
+		return Unambiguous
+	}
+	return name
+}
+
+// New returns the generator named kind, "random" (the default) or "counter",
+// over the alphabet resolved from alphabetName. next and salt are only used
+// by the counter generator.
+func New(kind, alphabetName string, salt uint64, next func() (uint64, error)) (CodeGenerator, error) {
+	alphabet := ResolveAlphabet(alphabetName)
+	switch strings.ToLower(kind) {
+	case "", "random":
+		return NewRandomGenerator(alphabet)
+	case "counter":
+		return NewCounterGenerator(alphabet, salt, next)
+	}
+	return nil, fmt.Errorf("unknown short code generator %q", kind)
+}
@@ -0,0 +1,104 @@
+package shortcode
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRandomGenerator(t *testing.T) {
+	g, err := NewRandomGenerator(Unambiguous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		code, err := g.Generate(6)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(code) != 6 {
+			t.Fatalf("expected 6 characters, got %q", code)
+		}
+		for _, c := range code {
+			if !strings.ContainsRune(Unambiguous, c) {
+				t.Fatalf("code %q contains %q outside the alphabet", code, c)
+			}
+		}
+	}
+}
+
+func TestCounterGeneratorIsUniqueAndGrows(t *testing.T) {
+	// A 4 character alphabet has 64 codes of length 3; the next 192 values
+	// need 4 characters.
+	g, err := NewCounterGenerator("abcd", 42, NewSequence(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for i := 0; i < 256; i++ {
+		code, err := g.Generate(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantLen := 3
+		if i >= 64 {
+			wantLen = 4
+		}
+		if len(code) != wantLen {
+			t.Fatalf("value %d: expected %d characters, got %q", i, wantLen, code)
+		}
+		if seen[code] {
+			t.Fatalf("value %d: duplicate code %q", i, code)
+		}
+		seen[code] = true
+	}
+}
+
+func TestCounterGeneratorLooksNonSequential(t *testing.T) {
+	g, _ := NewCounterGenerator(Base62, 7, NewSequence(1000))
+	first, _ := g.Generate(6)
+	second, _ := g.Generate(6)
+	same := 0
+	for i := range first {
+		if first[i] == second[i] {
+			same++
+		}
+	}
+	if same > 3 {
+		t.Fatalf("consecutive codes %q and %q share %d characters", first, second, same)
+	}
+}
+
+func TestValidateAlphabet(t *testing.T) {
+	for _, alphabet := range []string{"", "a", "aab", "ab/c", "ab c"} {
+		if ValidateAlphabet(alphabet) == nil {
+			t.Errorf("expected %q to be rejected", alphabet)
+		}
+	}
+	for _, alphabet := range []string{Base62, Unambiguous, "ab_-"} {
+		if err := ValidateAlphabet(alphabet); err != nil {
+			t.Errorf("expected %q to be accepted, got %v", alphabet, err)
+		}
+	}
+}
+
+func TestLengthGrowsAfterCollisions(t *testing.T) {
+	l := NewLength(6, 3, 7)
+	l.Collided(6)
+	l.Collided(6)
+	l.Succeeded()
+	l.Collided(6)
+	l.Collided(6)
+	if l.Current() != 6 {
+		t.Fatalf("expected length 6 before 3 consecutive collisions, got %d", l.Current())
+	}
+	l.Collided(6)
+	if l.Current() != 7 {
+		t.Fatalf("expected length 7, got %d", l.Current())
+	}
+	for i := 0; i < 3; i++ {
+		l.Collided(7)
+	}
+	if l.Current() != 7 {
+		t.Fatalf("expected length to stop at max 7, got %d", l.Current())
+	}
+}
@@ -0,0 +1,77 @@
+package tokens
+
+import (
+	"M2A1-URL-Shortner/models"
+	"context"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// Store keeps the signing keys. GormStore shares them between instances
+// through the database; MemoryStore keeps them in this process.
+type Store interface {
+	List(ctx context.Context) ([]models.SigningKey, error)
+	Put(ctx context.Context, key models.SigningKey) error
+	Delete(ctx context.Context, id string) error
+}
+
+// GormStore keeps the signing keys in the signing_keys table.
+type GormStore struct {
+	db *gorm.DB
+}
+
+// NewGormStore keeps signing keys in db.
+func NewGormStore(db *gorm.DB) *GormStore {
+	return &GormStore{db: db}
+}
+
+func (s *GormStore) List(ctx context.Context) ([]models.SigningKey, error) {
+	var keys []models.SigningKey
+	err := s.db.WithContext(ctx).Find(&keys).Error
+	return keys, err
+}
+
+func (s *GormStore) Put(ctx context.Context, key models.SigningKey) error {
+	return s.db.WithContext(ctx).Create(&key).Error
+}
+
+func (s *GormStore) Delete(ctx context.Context, id string) error {
+	return s.db.WithContext(ctx).Delete(&models.SigningKey{}, "id = ?", id).Error
+}
+
+// MemoryStore keeps signing keys in process memory, so tokens do not survive
+// a restart. It is meant for tests.
+type MemoryStore struct {
+	mu   sync.Mutex
+	keys map[string]models.SigningKey
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{keys: make(map[string]models.SigningKey)}
+}
+
+func (s *MemoryStore) List(ctx context.Context) ([]models.SigningKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]models.SigningKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (s *MemoryStore) Put(ctx context.Context, key models.SigningKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[key.ID] = key
+	return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, id)
+	return nil
+}
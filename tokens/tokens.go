@@ -0,0 +1,342 @@
+// Package tokens issues and verifies the short-lived access tokens sent as
+// "Authorization: Bearer": RS256-signed JWTs whose keys are rotated, kept in
+// a Store shared by every instance, and published as a JWKS.
+package tokens
+
+import (
+	"M2A1-URL-Shortner/models"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidToken is returned by Verify for tokens that are malformed,
+// badly signed, signed by an unknown key, from another issuer or expired.
+var ErrInvalidToken = errors.New("invalid access token")
+
+const (
+	keyBits = 2048
+	// leeway allows for clocks that are slightly apart.
+	leeway = 30 * time.Second
+	// minReloadInterval limits how often a token signed by an unknown key
+	// makes Verify re-read the store.
+	minReloadInterval = 10 * time.Second
+)
+
+// Claims are the claims of an access token.
+type Claims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"` // the user ID
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+	Email     string `json:"email,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Tier      string `json:"tier"`
+	Scope     string `json:"scope"`                // space separated
+	APIKeyID  uint   `json:"api_key_id,omitempty"` // key the token was issued for
+}
+
+// UserID returns the user the token was issued to.
+func (c Claims) UserID() (uint, error) {
+	id, err := strconv.ParseUint(c.Subject, 10, 64)
+	if err != nil || id == 0 {
+		return 0, ErrInvalidToken
+	}
+	return uint(id), nil
+}
+
+// Scopes returns the scopes the token grants.
+func (c Claims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// Issuer signs access tokens with the newest of its keys and verifies them
+// with any key it still holds. A new key is made every RotateEvery; the one
+// it replaces is kept until the tokens it signed have expired.
+type Issuer struct {
+	Name        string
+	AccessTTL   time.Duration
+	RotateEvery time.Duration
+
+	store      Store
+	mu         sync.RWMutex
+	keys       []signingKey // newest first
+	lastReload time.Time
+}
+
+type signingKey struct {
+	id        string
+	key       *rsa.PrivateKey
+	createdAt time.Time
+}
+
+// New returns an Issuer keeping its keys in store. Call Start, or Reload,
+// before signing tokens.
+func New(store Store, name string, accessTTL, rotateEvery time.Duration) *Issuer {
+	return &Issuer{Name: name, AccessTTL: accessTTL, RotateEvery: rotateEvery, store: store}
+}
+
+// Start loads the keys and keeps them current until ctx is done: the store
+// is re-read every interval, which picks up keys made by other instances and
+// rotates the key when it is due.
+func (i *Issuer) Start(ctx context.Context, interval time.Duration) error {
+	if err := i.Reload(ctx); err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := i.Reload(ctx); err != nil {
+				fmt.Printf("Error reloading token signing keys: %v\n", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Reload reads the keys from the store, makes a new one when the newest is
+// older than RotateEvery, and deletes keys no token can still be signed by.
+func (i *Issuer) Reload(ctx context.Context) error {
+	stored, err := i.store.List(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	keys := make([]signingKey, 0, len(stored))
+	for _, s := range stored {
+		parsed, err := x509.ParsePKCS8PrivateKey(s.PrivateKey)
+		rsaKey, ok := parsed.(*rsa.PrivateKey)
+		if err != nil || !ok {
+			fmt.Printf("Skipping unreadable token signing key %s: %v\n", s.ID, err)
+			continue
+		}
+		keys = append(keys, signingKey{id: s.ID, key: rsaKey, createdAt: s.CreatedAt})
+	}
+	sort.Slice(keys, func(a, b int) bool { return keys[a].createdAt.After(keys[b].createdAt) })
+
+	if len(keys) == 0 || now.Sub(keys[0].createdAt) >= i.RotateEvery {
+		key, err := newSigningKey(now)
+		if err != nil {
+			return err
+		}
+		if err := i.store.Put(ctx, key.stored()); err != nil {
+			return err
+		}
+		fmt.Printf("Rotated the token signing key to %s\n", key.id)
+		keys = append([]signingKey{key}, keys...)
+	}
+
+	// A key signs until the next one is made, so its tokens are all
+	// expired AccessTTL after that.
+	kept := keys[:1]
+	for n := 1; n < len(keys); n++ {
+		if now.Sub(keys[n-1].createdAt) < i.AccessTTL+leeway {
+			kept = append(kept, keys[n])
+			continue
+		}
+		if err := i.store.Delete(ctx, keys[n].id); err != nil {
+			fmt.Printf("Error deleting token signing key %s: %v\n", keys[n].id, err)
+		}
+	}
+
+	i.mu.Lock()
+	i.keys = kept
+	i.lastReload = now
+	i.mu.Unlock()
+	return nil
+}
+
+// Rotate makes a new signing key at once, for instance when a key may have
+// leaked. Tokens signed by the previous key stay valid until they expire.
+func (i *Issuer) Rotate(ctx context.Context) error {
+	key, err := newSigningKey(time.Now())
+	if err != nil {
+		return err
+	}
+	if err := i.store.Put(ctx, key.stored()); err != nil {
+		return err
+	}
+	return i.Reload(ctx)
+}
+
+func newSigningKey(now time.Time) (signingKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return signingKey{}, err
+	}
+	return signingKey{id: thumbprint(&key.PublicKey), key: key, createdAt: now.UTC()}, nil
+}
+
+func (k signingKey) stored() models.SigningKey {
+	der, _ := x509.MarshalPKCS8PrivateKey(k.key)
+	return models.SigningKey{ID: k.id, PrivateKey: der, CreatedAt: k.createdAt}
+}
+
+// Sign fills in the issuer, times and ID of claims and returns them signed.
+func (i *Issuer) Sign(claims Claims) (string, Claims, error) {
+	i.mu.RLock()
+	var key signingKey
+	if len(i.keys) > 0 {
+		key = i.keys[0]
+	}
+	i.mu.RUnlock()
+	if key.key == nil {
+		return "", claims, errors.New("no token signing key loaded")
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", claims, err
+	}
+	now := time.Now()
+	claims.Issuer = i.Name
+	claims.IssuedAt = now.Unix()
+	claims.ExpiresAt = now.Add(i.AccessTTL).Unix()
+	claims.ID = hex.EncodeToString(id)
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": key.id})
+	if err != nil {
+		return "", claims, err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", claims, err
+	}
+	signingInput := encode(header) + "." + encode(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", claims, err
+	}
+	return signingInput + "." + encode(signature), claims, nil
+}
+
+// Verify checks token's signature, issuer and expiry and returns its claims.
+func (i *Issuer) Verify(ctx context.Context, token string, now time.Time) (Claims, error) {
+	var claims Claims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, ErrInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJSON(parts[0], &header); err != nil || header.Alg != "RS256" {
+		return claims, ErrInvalidToken
+	}
+	public := i.publicKey(ctx, header.Kid, now)
+	if public == nil {
+		return claims, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, ErrInvalidToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature) != nil {
+		return claims, ErrInvalidToken
+	}
+	if err := decodeJSON(parts[1], &claims); err != nil {
+		return claims, ErrInvalidToken
+	}
+	if claims.Issuer != i.Name || !now.Before(time.Unix(claims.ExpiresAt, 0).Add(leeway)) || time.Unix(claims.IssuedAt, 0).After(now.Add(leeway)) {
+		return claims, ErrInvalidToken
+	}
+	if _, err := claims.UserID(); err != nil {
+		return claims, err
+	}
+	return claims, nil
+}
+
+// publicKey returns the public key with id, re-reading the store for keys
+// made by another instance since the last reload.
+func (i *Issuer) publicKey(ctx context.Context, id string, now time.Time) *rsa.PublicKey {
+	find := func() (*rsa.PublicKey, bool) {
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		for _, k := range i.keys {
+			if k.id == id {
+				return &k.key.PublicKey, true
+			}
+		}
+		return nil, now.Sub(i.lastReload) >= minReloadInterval
+	}
+	public, reload := find()
+	if public != nil || !reload || id == "" {
+		return public
+	}
+	if err := i.Reload(ctx); err != nil {
+		fmt.Printf("Error reloading token signing keys: %v\n", err)
+		return nil
+	}
+	public, _ = find()
+	return public
+}
+
+// JWK is the public part of a signing key, as published in a JWKS.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JWKS returns the public keys tokens may currently be signed with, newest
+// first.
+func (i *Issuer) JWKS() []JWK {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	keys := make([]JWK, 0, len(i.keys))
+	for _, k := range i.keys {
+		n, e := publicParts(&k.key.PublicKey)
+		keys = append(keys, JWK{Kty: "RSA", Use: "sig", Alg: "RS256", Kid: k.id, N: n, E: e})
+	}
+	return keys
+}
+
+// thumbprint returns the RFC 7638 thumbprint of key, used as its kid.
+func thumbprint(key *rsa.PublicKey) string {
+	n, e := publicParts(key)
+	sum := sha256.Sum256([]byte(`{"e":"` + e + `","kty":"RSA","n":"` + n + `"}`))
+	return encode(sum[:])
+}
+
+func publicParts(key *rsa.PublicKey) (string, string) {
+	return encode(key.N.Bytes()), encode(big.NewInt(int64(key.E)).Bytes())
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeJSON(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
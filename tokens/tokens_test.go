@@ -0,0 +1,80 @@
+package tokens
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIssuer(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	issuer := New(store, "test", time.Minute, time.Hour)
+	if err := issuer.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	token, claims, err := issuer.Sign(Claims{Subject: "42", Tier: "hobby", Scope: "links:read analytics:read"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	got, err := issuer.Verify(ctx, token, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := got.UserID(); id != 42 || got.ID != claims.ID || len(got.Scopes()) != 2 {
+		t.Fatalf("unexpected claims %+v", got)
+	}
+	if _, err := issuer.Verify(ctx, token, now.Add(2*time.Minute)); err != ErrInvalidToken {
+		t.Fatalf("expected an expired token to be refused, got %v", err)
+	}
+
+	// Tampered claims, a foreign issuer and alg "none" are refused.
+	parts := strings.Split(token, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"test","sub":"1","scope":"admin","iat":0,"exp":9999999999}`))
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":""}`))
+	for _, bad := range []string{parts[0] + "." + forged + "." + parts[2], none + "." + parts[1] + ".", "not-a-token"} {
+		if _, err := issuer.Verify(ctx, bad, now); err != ErrInvalidToken {
+			t.Fatalf("expected %q to be refused, got %v", bad, err)
+		}
+	}
+	if _, err := New(store, "other", time.Minute, time.Hour).Verify(ctx, token, now); err != ErrInvalidToken {
+		t.Fatalf("expected another issuer's token to be refused, got %v", err)
+	}
+
+	// After a rotation both keys are published and old tokens still verify,
+	// until the old key is pruned.
+	if err := issuer.Rotate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if keys := issuer.JWKS(); len(keys) != 2 {
+		t.Fatalf("expected two published keys, got %+v", keys)
+	}
+	if _, err := issuer.Verify(ctx, token, now); err != nil {
+		t.Fatalf("expected a token of the previous key to verify, got %v", err)
+	}
+	issuer.AccessTTL = -time.Minute
+	if err := issuer.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := store.List(ctx); len(keys) != 1 || len(issuer.JWKS()) != 1 {
+		t.Fatalf("expected the previous key to be pruned, got %d keys", len(keys))
+	}
+
+	// Another instance sharing the store verifies tokens of keys it has not
+	// loaded yet.
+	issuer.AccessTTL = time.Minute
+	other := New(store, "test", time.Minute, time.Hour)
+	if err := other.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	issuer.Rotate(ctx)
+	token, _, _ = issuer.Sign(Claims{Subject: "7"})
+	other.lastReload = time.Now().Add(-minReloadInterval)
+	if _, err := other.Verify(ctx, token, time.Now()); err != nil {
+		t.Fatalf("expected a key from the store to be picked up, got %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"M2A1-URL-Shortner/middlewares"
+	"M2A1-URL-Shortner/shortcode"
 	"errors"
 	"fmt"
 	"math/rand"
@@ -11,16 +12,17 @@ import (
 	"time"
 )
 
-func GenerateShortCode(length int) string {
-	const chars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
-	rand.Seed(time.Now().UnixNano()) // Seed the random number generator with the current time
+var randomCodes, _ = shortcode.NewRandomGenerator(shortcode.Base62)
 
-	shortCode := make([]byte, length)
-	for i := 0; i < length; i++ {
-		shortCode[i] = chars[rand.Intn(len(chars))]
+// GenerateShortCode returns a crypto-random base62 code of length characters.
+// Links get their codes from handlers.CodeGenerator; this is kept for callers
+// that just need a random token.
+func GenerateShortCode(length int) string {
+	code, err := randomCodes.Generate(length)
+	if err != nil {
+		panic(err)
 	}
-
-	return string(shortCode)
+	return code
 }
 
 func isRecoverableError(err error) bool {
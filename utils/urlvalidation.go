@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// MaxURLLength matches the size of the original_url column.
+const MaxURLLength = 2083
+
+// FieldError describes why one field of a request was rejected.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// NormalizeURL validates a destination URL and returns it in canonical form:
+// lowercase scheme and host, no default port and consistent
+// percent-encoding. URLs that are not absolute http(s) URLs, carry
+// credentials, point at loopback/private addresses or at one of
+// blockedHosts are rejected with a FieldError for field.
+func NormalizeURL(field, raw string, blockedHosts []string) (string, *FieldError) {
+	fail := func(code, format string, args ...interface{}) (string, *FieldError) {
+		return "", &FieldError{Field: field, Code: code, Message: fmt.Sprintf(format, args...)}
+	}
+
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return fail("required", "is required")
+	}
+	if len(raw) > MaxURLLength {
+		return fail("too_long", "must be at most %d characters", MaxURLLength)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fail("invalid", "is not a valid URL")
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fail("unsupported_scheme", "must be an http or https URL")
+	}
+	if u.Opaque != "" || u.Host == "" {
+		return fail("missing_host", "must be an absolute URL with a host")
+	}
+	if u.User != nil {
+		return fail("credentials", "must not contain a username or password")
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return fail("missing_host", "must be an absolute URL with a host")
+	}
+	port := u.Port()
+	if port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return fail("invalid_port", "has an invalid port")
+		}
+		if (u.Scheme == "http" && n == 80) || (u.Scheme == "https" && n == 443) {
+			port = ""
+		} else {
+			port = strconv.Itoa(n)
+		}
+	}
+	if net.ParseIP(host) == nil && endsInNumber(host) {
+		// Browsers read such hosts as IPv4 addresses written as one number or
+		// in hex/octal parts (http://2130706433, http://0x7f.1), which would
+		// get around the private address check.
+		return fail("invalid_host", "must be a domain name or a standard IP address")
+	}
+	if isInternalHost(host) {
+		return fail("private_address", "must not point at a local or private network address")
+	}
+
+	hostPort := host
+	if strings.Contains(host, ":") {
+		hostPort = "[" + host + "]"
+	}
+	if port != "" {
+		hostPort += ":" + port
+	}
+	for _, blocked := range blockedHosts {
+		blocked = strings.TrimSuffix(strings.ToLower(blocked), ".")
+		if blocked != "" && (blocked == host || blocked == hostPort) {
+			return fail("self_referencing", "must not point at this URL shortener")
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(u.Scheme)
+	b.WriteString("://")
+	b.WriteString(hostPort)
+	b.WriteString(normalizePercentEncoding(u.EscapedPath()))
+	if u.RawQuery != "" || u.ForceQuery {
+		b.WriteString("?")
+		b.WriteString(normalizePercentEncoding(u.RawQuery))
+	}
+	if u.Fragment != "" {
+		b.WriteString("#")
+		b.WriteString(normalizePercentEncoding(u.EscapedFragment()))
+	}
+
+	normalized := b.String()
+	if len(normalized) > MaxURLLength {
+		return fail("too_long", "must be at most %d characters", MaxURLLength)
+	}
+	return normalized, nil
+}
+
+// isInternalHost reports whether host names this machine or a non-public
+// network. Only literal addresses and localhost names are recognised; hosts
+// are not resolved.
+func isInternalHost(host string) bool {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		// 100.64.0.0/10 carrier-grade NAT, not covered by IsPrivate.
+		(ip.To4() != nil && ip.To4()[0] == 100 && ip.To4()[1]&0xc0 == 64)
+}
+
+// endsInNumber reports whether the last label of host is a decimal or
+// 0x-prefixed hex number, which makes browsers parse host as IPv4.
+func endsInNumber(host string) bool {
+	label := host[strings.LastIndex(host, ".")+1:]
+	if strings.HasPrefix(label, "0x") {
+		label = label[2:]
+		return strings.Trim(label, "0123456789abcdef") == ""
+	}
+	return label != "" && strings.Trim(label, "0123456789") == ""
+}
+
+// normalizePercentEncoding uppercases percent-escapes and decodes the ones
+// that stand for unreserved characters (RFC 3986 section 6.2.2.2), so
+// equivalent URLs are stored the same way.
+func normalizePercentEncoding(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			b.WriteByte(s[i])
+			continue
+		}
+		c := unhex(s[i+1])<<4 | unhex(s[i+2])
+		if isUnreserved(c) {
+			b.WriteByte(c)
+		} else {
+			b.WriteString(strings.ToUpper(s[i : i+3]))
+		}
+		i += 2
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
+
+func isUnreserved(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
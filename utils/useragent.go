@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"net"
+	"strings"
+)
+
+// ParseUserAgent makes a best-effort guess at the device type, operating
+// system and browser behind a User-Agent header.
+func ParseUserAgent(userAgent string) (device, osName, browser string) {
+	if userAgent == "" {
+		return "unknown", "unknown", "unknown"
+	}
+	ua := strings.ToLower(userAgent)
+
+	switch {
+	case containsAny(ua, "bot", "crawler", "spider", "slurp", "curl/", "wget/", "python-requests", "go-http-client"):
+		device = "bot"
+	case containsAny(ua, "ipad", "tablet") || (strings.Contains(ua, "android") && !strings.Contains(ua, "mobile")):
+		device = "tablet"
+	case containsAny(ua, "mobi", "iphone", "ipod", "android"):
+		device = "mobile"
+	default:
+		device = "desktop"
+	}
+
+	switch {
+	case strings.Contains(ua, "windows"):
+		osName = "Windows"
+	case containsAny(ua, "iphone", "ipad", "ipod"):
+		osName = "iOS"
+	case containsAny(ua, "mac os x", "macintosh"):
+		osName = "macOS"
+	case strings.Contains(ua, "android"):
+		osName = "Android"
+	case strings.Contains(ua, "cros"):
+		osName = "ChromeOS"
+	case strings.Contains(ua, "linux"):
+		osName = "Linux"
+	default:
+		osName = "Other"
+	}
+
+	// Order matters: most browsers also claim to be Chrome and/or Safari.
+	switch {
+	case containsAny(ua, "edg/", "edge/", "edga/", "edgios/"):
+		browser = "Edge"
+	case containsAny(ua, "opr/", "opera"):
+		browser = "Opera"
+	case strings.Contains(ua, "samsungbrowser"):
+		browser = "Samsung Internet"
+	case containsAny(ua, "firefox/", "fxios/"):
+		browser = "Firefox"
+	case containsAny(ua, "chrome/", "crios/", "chromium/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "safari/"):
+		browser = "Safari"
+	default:
+		browser = "Other"
+	}
+
+	return device, osName, browser
+}
+
+func containsAny(s string, substrs ...string) bool {
+	for _, substr := range substrs {
+		if strings.Contains(s, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// AnonymizeIP drops the host part of an IP address so it can be stored
+// without identifying a single client: the last octet of an IPv4 address and
+// everything after the /48 prefix of an IPv6 address are zeroed.
+func AnonymizeIP(ip string) string {
+	parsed := net.ParseIP(strings.TrimSpace(ip))
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}